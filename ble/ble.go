@@ -21,15 +21,31 @@
 package ble
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 type AdvertisementHandler func(adv Advertisement)
 
 type Advertisement struct {
-	Addr     string
-	Name     string
-	Services []string
+	Addr             string
+	Name             string
+	Services         []string
+	RSSI             int
+	TxPower          int
+	ManufacturerData []byte
+	ServiceData      map[string][]byte
+	Connectable      bool
+}
+
+// Adapter describes a Bluetooth adapter of the host.
+type Adapter struct {
+	ID      string
+	Address string
+	Name    string
 }
 
 type WriteCharacteristicType byte
@@ -39,6 +55,8 @@ const (
 	WithResponse WriteCharacteristicType = 2
 )
 
+const DefaultMTU = 23
+
 type SubscriptionType byte
 
 const (
@@ -57,9 +75,13 @@ type Peripheral interface {
 
 	Disconnect() error
 
+	ExchangeMTU(mtu int) (int, error)
+	MTU() int
+
 	FindService(uuid string) Service
 	FindCharacteristic(uuid string) Characteristic
 
+	ReadCharacteristic(uuid string) ([]byte, error)
 	WriteCharacteristic(uuid string, data []byte, resp WriteCharacteristicType) error
 	Subscribe(uuid string, subType SubscriptionType, callback func([]byte)) error
 	Unsubscribe(uuid string, subType SubscriptionType) error
@@ -73,7 +95,25 @@ type Service interface {
 type Characteristic interface {
 	Uuid() string
 
+	ReadCharacteristic() ([]byte, error)
 	WriteCharacteristic(data []byte, resp WriteCharacteristicType) error
 	Subscribe(subType SubscriptionType, f func([]byte)) error
 	Unsubscribe(subType SubscriptionType) error
 }
+
+// WithSignalHandler cancels the context when the program is interrupted, so
+// that scanning and connecting stop before their timeout.
+func WithSignalHandler(ctx context.Context, cancel context.CancelFunc) (context.Context, context.CancelFunc) {
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -23,12 +23,33 @@ package ble
 import (
 	"github.com/go-ble/ble"
 	"github.com/go-ble/ble/darwin"
+	"github.com/pkg/errors"
 )
 
-func newDevice() (ble.Device, error) {
+// CoreBluetooth always uses the default adapter of the system.
+const defaultAdapter = "default"
+
+func newDevice(adapter string) (ble.Device, error) {
 	return darwin.NewDevice()
 }
 
 func NewClient() (b Client, err error) {
-	return NewGoBleClient(newDevice)
+	return NewAdapterClient("")
+}
+
+func NewAdapterClient(adapter string) (Client, error) {
+	if adapter != "" && adapter != defaultAdapter {
+		return nil, errors.Errorf("invalid adapter '%s', only the default adapter can be used on macOS", adapter)
+	}
+
+	client, err := NewGoBleClient("", newDevice)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Adapters returns the adapter used by CoreBluetooth.
+func Adapters() ([]Adapter, error) {
+	return []Adapter{{ID: defaultAdapter}}, nil
 }
@@ -21,14 +21,122 @@
 package ble
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/go-ble/ble"
 	"github.com/go-ble/ble/linux"
+	"github.com/go-ble/ble/linux/gatt"
+	"github.com/go-ble/ble/linux/hci"
+	"github.com/pkg/errors"
 )
 
-func newDevice() (ble.Device, error) {
-	return linux.NewDevice()
+const sysfsBluetooth = "/sys/class/bluetooth"
+
+func newDevice(adapter string) (ble.Device, error) {
+	id, err := adapterID(adapter)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := hci.NewHCI(hci.OptDeviceID(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create hci")
+	}
+	if err = dev.Init(); err != nil {
+		return nil, errors.Wrap(err, "can't init hci")
+	}
+
+	srv, err := gatt.NewServer()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create server")
+	}
+
+	// Unlike linux.NewDevice, this does not accept incoming connections.
+	// They are only used in the peripheral role.
+	return &linux.Device{HCI: dev, Server: srv}, nil
+}
+
+// adapterID parses an adapter name like "hci1", or just its number.
+func adapterID(adapter string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(adapter, "hci"))
+	if err != nil || id < 0 {
+		return 0, errors.Errorf("invalid adapter '%s', expected a name like 'hci0'", adapter)
+	}
+	return id, nil
 }
 
 func NewClient() (b Client, err error) {
-	return NewGoBleClient(newDevice)
+	return NewAdapterClient("")
+}
+
+// NewAdapterClient returns a client for an adapter like "hci1". An empty
+// name selects the first adapter.
+func NewAdapterClient(adapter string) (Client, error) {
+	if adapter == "" {
+		adapter = defaultAdapter()
+	}
+
+	// Different names of the same adapter must share its device.
+	id, err := adapterID(adapter)
+	if err != nil {
+		return nil, err
+	}
+	adapter = fmt.Sprintf("hci%d", id)
+
+	client, err := NewGoBleClient(adapter, newDevice)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// defaultAdapter returns the name of the first adapter known to the kernel.
+func defaultAdapter() string {
+	adapters, err := Adapters()
+	if err != nil || len(adapters) == 0 {
+		return "hci0"
+	}
+	return adapters[0].ID
+}
+
+// Adapters returns the Bluetooth adapters known to the kernel.
+func Adapters() ([]Adapter, error) {
+	entries, err := ioutil.ReadDir(sysfsBluetooth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list Bluetooth adapters")
+	}
+
+	var adapters []Adapter
+	for _, entry := range entries {
+		// Connections are listed as hciX:handle.
+		name := entry.Name()
+		if strings.Contains(name, ":") {
+			continue
+		}
+		if _, err := adapterID(name); err != nil {
+			continue
+		}
+
+		adapter := Adapter{ID: name}
+		if address, err := ioutil.ReadFile(filepath.Join(sysfsBluetooth, name, "address")); err == nil {
+			adapter.Address = strings.ToUpper(strings.TrimSpace(string(address)))
+		}
+		adapters = append(adapters, adapter)
+	}
+
+	sort.Slice(adapters, func(i, j int) bool {
+		a, _ := adapterID(adapters[i].ID)
+		b, _ := adapterID(adapters[j].ID)
+		return a < b
+	})
+	return adapters, nil
 }
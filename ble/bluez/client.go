@@ -0,0 +1,427 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package bluez implements ble.Client on top of the D-Bus API of BlueZ. Unlike
+// the go-ble backend it does not need raw HCI access, and it shares the
+// adapter with bluetoothd and other BLE applications.
+package bluez
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	bluezService                = "org.bluez"
+	bluezPath                   = "/org/bluez"
+	adapterInterface            = "org.bluez.Adapter1"
+	deviceInterface             = "org.bluez.Device1"
+	gattServiceInterface        = "org.bluez.GattService1"
+	gattCharacteristicInterface = "org.bluez.GattCharacteristic1"
+	objectManagerInterface      = "org.freedesktop.DBus.ObjectManager"
+	propertiesInterface         = "org.freedesktop.DBus.Properties"
+)
+
+const DefaultAdapter = "hci0"
+
+const (
+	pollInterval      = 100 * time.Millisecond
+	signalChannelSize = 256
+)
+
+type managedObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+type Client struct {
+	conn    *dbus.Conn
+	adapter dbus.ObjectPath
+}
+
+// NewSystemClient returns a client for the adapter, e.g. "hci0", of the
+// BlueZ daemon on the system bus.
+func NewSystemClient(adapter string) (*Client, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to D-Bus system bus")
+	}
+	return NewClient(conn, adapter)
+}
+
+// NewClient returns a client for the adapter of the BlueZ daemon on the bus
+// of conn. An empty adapter name selects DefaultAdapter.
+func NewClient(conn *dbus.Conn, adapter string) (*Client, error) {
+	if adapter == "" {
+		adapter = DefaultAdapter
+	}
+
+	c := &Client{
+		conn:    conn,
+		adapter: dbus.ObjectPath(bluezPath + "/" + adapter),
+	}
+
+	objects, err := c.managedObjects(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := objects[c.adapter][adapterInterface]; !ok {
+		return nil, errors.Errorf("Bluetooth adapter '%s' not found", adapter)
+	}
+	return c, nil
+}
+
+// SystemAdapters returns the adapters of the BlueZ daemon on the system bus.
+func SystemAdapters() ([]ble.Adapter, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to D-Bus system bus")
+	}
+	return Adapters(conn)
+}
+
+// Adapters returns the adapters of the BlueZ daemon on the bus of conn.
+func Adapters(conn *dbus.Conn) ([]ble.Adapter, error) {
+	c := &Client{conn: conn}
+	objects, err := c.managedObjects(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var adapters []ble.Adapter
+	for _, path := range sortedPaths(objects) {
+		props, ok := objects[path][adapterInterface]
+		if !ok {
+			continue
+		}
+		adapters = append(adapters, ble.Adapter{
+			ID:      strings.TrimPrefix(string(path), bluezPath+"/"),
+			Address: stringProperty(props, "Address"),
+			Name:    stringProperty(props, "Alias"),
+		})
+	}
+	return adapters, nil
+}
+
+func (c *Client) ConnectName(name string, timeout time.Duration) (ble.Peripheral, error) {
+	ctx, cancel := ble.WithSignalHandler(context.WithTimeout(context.Background(), timeout))
+	defer cancel()
+
+	path, err := c.discover(ctx, func(path dbus.ObjectPath, props map[string]dbus.Variant) bool {
+		return strings.EqualFold(stringProperty(props, "Name"), name)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to BLE peripheral")
+	}
+	return c.connect(ctx, path)
+}
+
+func (c *Client) ConnectAddress(address string, timeout time.Duration) (ble.Peripheral, error) {
+	ctx, cancel := ble.WithSignalHandler(context.WithTimeout(context.Background(), timeout))
+	defer cancel()
+
+	path, err := c.discover(ctx, func(path dbus.ObjectPath, props map[string]dbus.Variant) bool {
+		return strings.EqualFold(stringProperty(props, "Address"), address)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to BLE peripheral")
+	}
+	return c.connect(ctx, path)
+}
+
+func (c *Client) Scan(duration time.Duration, handler ble.AdvertisementHandler) error {
+	ctx, cancel := ble.WithSignalHandler(context.WithTimeout(context.Background(), duration))
+	defer cancel()
+
+	_, err := c.discover(ctx, func(path dbus.ObjectPath, props map[string]dbus.Variant) bool {
+		handler(advertisement(props))
+		return false
+	})
+	return err
+}
+
+// discover runs device discovery until found returns true for a device that
+// is advertising, and returns the path of that device. Devices are reported
+// when they first appear and whenever BlueZ receives a new advertisement.
+func (c *Client) discover(ctx context.Context, found func(path dbus.ObjectPath, props map[string]dbus.Variant) bool) (dbus.ObjectPath, error) {
+	signals := make(chan *dbus.Signal, signalChannelSize)
+	c.conn.Signal(signals)
+	defer c.conn.RemoveSignal(signals)
+
+	matches := [][]dbus.MatchOption{
+		{dbus.WithMatchSender(bluezService), dbus.WithMatchInterface(objectManagerInterface), dbus.WithMatchMember("InterfacesAdded")},
+		{dbus.WithMatchSender(bluezService), dbus.WithMatchInterface(propertiesInterface), dbus.WithMatchMember("PropertiesChanged"), dbus.WithMatchPathNamespace(c.adapter)},
+	}
+	for _, match := range matches {
+		if err := c.conn.AddMatchSignalContext(ctx, match...); err != nil {
+			return "", errors.Wrap(err, "failed to subscribe to BlueZ signals")
+		}
+		defer c.conn.RemoveMatchSignal(match...)
+	}
+
+	adapter := c.conn.Object(bluezService, c.adapter)
+	filter := map[string]interface{}{
+		"Transport":     "le",
+		"DuplicateData": true,
+	}
+	if err := adapter.CallWithContext(ctx, adapterInterface+".SetDiscoveryFilter", 0, filter).Err; err != nil {
+		jww.DEBUG.Printf("Failed to set discovery filter: %v\n", err)
+	}
+	if err := adapter.CallWithContext(ctx, adapterInterface+".StartDiscovery", 0).Err; err != nil {
+		return "", errors.Wrap(err, "failed to start discovery")
+	}
+	defer func() {
+		if err := adapter.Call(adapterInterface+".StopDiscovery", 0).Err; err != nil {
+			jww.DEBUG.Printf("Failed to stop discovery: %v\n", err)
+		}
+	}()
+
+	objects, err := c.managedObjects(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Devices remembered by BlueZ only have an RSSI while they advertise.
+	devices := make(map[dbus.ObjectPath]map[string]dbus.Variant)
+	for _, path := range sortedPaths(objects) {
+		props, ok := objects[path][deviceInterface]
+		if !ok || !c.ownsDevice(path) {
+			continue
+		}
+		devices[path] = props
+		if _, ok := props["RSSI"]; ok && found(path, props) {
+			return path, nil
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+
+		case sig, ok := <-signals:
+			if !ok {
+				return "", errors.New("D-Bus connection closed")
+			}
+
+			var path dbus.ObjectPath
+			switch sig.Name {
+			case objectManagerInterface + ".InterfacesAdded":
+				var interfaces map[string]map[string]dbus.Variant
+				if dbus.Store(sig.Body, &path, &interfaces) != nil || !c.ownsDevice(path) {
+					continue
+				}
+				props, ok := interfaces[deviceInterface]
+				if !ok {
+					continue
+				}
+				devices[path] = props
+
+			case propertiesInterface + ".PropertiesChanged":
+				var iface string
+				var changed map[string]dbus.Variant
+				var invalidated []string
+				path = sig.Path
+				if dbus.Store(sig.Body, &iface, &changed, &invalidated) != nil || iface != deviceInterface || !c.ownsDevice(path) {
+					continue
+				}
+				props, ok := devices[path]
+				if !ok {
+					if props, err = c.properties(ctx, path, deviceInterface); err != nil {
+						continue
+					}
+					devices[path] = props
+				}
+				for name, value := range changed {
+					props[name] = value
+				}
+				for _, name := range invalidated {
+					delete(props, name)
+				}
+				if !advertised(changed) {
+					continue
+				}
+
+			default:
+				continue
+			}
+
+			if found(path, devices[path]) {
+				return path, nil
+			}
+		}
+	}
+}
+
+func (c *Client) connect(ctx context.Context, path dbus.ObjectPath) (ble.Peripheral, error) {
+	device := c.conn.Object(bluezService, path)
+	if err := device.CallWithContext(ctx, deviceInterface+".Connect", 0).Err; err != nil {
+		return nil, errors.Wrap(err, "failed to connect to BLE peripheral")
+	}
+
+	p, err := c.resolve(ctx, path)
+	if err != nil {
+		device.Call(deviceInterface+".Disconnect", 0)
+		return nil, err
+	}
+	return p, nil
+}
+
+// resolve waits until BlueZ has discovered the services of a connected device.
+func (c *Client) resolve(ctx context.Context, path dbus.ObjectPath) (*peripheral, error) {
+	for {
+		props, err := c.properties(ctx, path, deviceInterface)
+		if err != nil {
+			return nil, err
+		}
+		if resolved, _ := props["ServicesResolved"].Value().(bool); resolved {
+			return newPeripheral(ctx, c, path, stringProperty(props, "Address"))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "failed to discover profiles")
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (c *Client) ownsDevice(path dbus.ObjectPath) bool {
+	return strings.HasPrefix(string(path), string(c.adapter)+"/")
+}
+
+func (c *Client) managedObjects(ctx context.Context) (managedObjects, error) {
+	var objects managedObjects
+	err := c.conn.Object(bluezService, "/").CallWithContext(ctx, objectManagerInterface+".GetManagedObjects", 0).Store(&objects)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get BlueZ objects")
+	}
+	return objects, nil
+}
+
+func (c *Client) properties(ctx context.Context, path dbus.ObjectPath, iface string) (map[string]dbus.Variant, error) {
+	var props map[string]dbus.Variant
+	err := c.conn.Object(bluezService, path).CallWithContext(ctx, propertiesInterface+".GetAll", 0, iface).Store(&props)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get properties of %s", path)
+	}
+	return props, nil
+}
+
+// advertised reports whether a property change was caused by an advertisement.
+func advertised(changed map[string]dbus.Variant) bool {
+	for _, name := range []string{"RSSI", "ManufacturerData", "ServiceData", "TxPower"} {
+		if _, ok := changed[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func advertisement(props map[string]dbus.Variant) ble.Advertisement {
+	adv := ble.Advertisement{
+		Addr: stringProperty(props, "Address"),
+		Name: stringProperty(props, "Name"),
+		// BlueZ does not report whether a device is connectable.
+	}
+	if rssi, ok := props["RSSI"].Value().(int16); ok {
+		adv.RSSI = int(rssi)
+	}
+	if txPower, ok := props["TxPower"].Value().(int16); ok {
+		adv.TxPower = int(txPower)
+	}
+	if uuids, ok := props["UUIDs"].Value().([]string); ok {
+		for _, uuid := range uuids {
+			adv.Services = append(adv.Services, shortUuid(uuid))
+		}
+	}
+
+	// BlueZ splits off the company identifier. Restore the raw format that
+	// go-ble reports, using the lowest identifier if there are several.
+	if data, ok := props["ManufacturerData"].Value().(map[uint16]dbus.Variant); ok && len(data) > 0 {
+		var companies []int
+		for company := range data {
+			companies = append(companies, int(company))
+		}
+		sort.Ints(companies)
+		if value, ok := data[uint16(companies[0])].Value().([]byte); ok {
+			adv.ManufacturerData = append([]byte{byte(companies[0]), byte(companies[0] >> 8)}, value...)
+		}
+	}
+
+	if data, ok := props["ServiceData"].Value().(map[string]dbus.Variant); ok {
+		for uuid, value := range data {
+			if value, ok := value.Value().([]byte); ok {
+				if adv.ServiceData == nil {
+					adv.ServiceData = make(map[string][]byte)
+				}
+				adv.ServiceData[shortUuid(uuid)] = value
+			}
+		}
+	}
+	return adv
+}
+
+func stringProperty(props map[string]dbus.Variant, name string) string {
+	value, _ := props[name].Value().(string)
+	return value
+}
+
+func sortedPaths(objects managedObjects) []dbus.ObjectPath {
+	paths := make([]dbus.ObjectPath, 0, len(objects))
+	for path := range objects {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+const bluetoothBaseUuid = "00001000800000805f9b34fb"
+
+// shortUuid returns 16-bit UUIDs in the short form used by go-ble, so that
+// advertised services compare equal regardless of the backend.
+func shortUuid(uuid string) string {
+	normalized := expandUuid(uuid)
+	if strings.HasPrefix(normalized, "0000") && strings.HasSuffix(normalized, bluetoothBaseUuid) {
+		return normalized[4:8]
+	}
+	return strings.ToLower(uuid)
+}
+
+func expandUuid(uuid string) string {
+	normalized := strings.Replace(strings.ToLower(uuid), "-", "", -1)
+	switch len(normalized) {
+	case 4:
+		return "0000" + normalized + bluetoothBaseUuid
+	case 8:
+		return normalized + bluetoothBaseUuid
+	}
+	return normalized
+}
+
+func sameUuid(a string, b string) bool {
+	return expandUuid(a) == expandUuid(b)
+}
@@ -0,0 +1,440 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bluez
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+const (
+	fakeAdapterPath        = dbus.ObjectPath(bluezPath + "/" + DefaultAdapter)
+	fakeDevicePath         = fakeAdapterPath + "/dev_AA_BB_CC_DD_EE_FF"
+	fakeServicePath        = fakeDevicePath + "/service000a"
+	fakeCharacteristicPath = fakeServicePath + "/char000b"
+
+	fakeAddress            = "AA:BB:CC:DD:EE:FF"
+	fakeServiceUUID        = "0000fe59-0000-1000-8000-00805f9b34fb"
+	fakeCharacteristicUUID = "8ec90001-f315-4f60-9fb8-838830daea50"
+	fakeMTU                = 185
+)
+
+// fakeBluez implements the parts of the BlueZ D-Bus API used by Client. It
+// has one device that advertises while discovery runs, with one
+// characteristic that answers each write with a notification.
+type fakeBluez struct {
+	conn *dbus.Conn
+
+	mutex       sync.Mutex
+	device      map[string]dbus.Variant
+	discovery   chan struct{}
+	connected   bool
+	notifying   bool
+	writes      [][]byte
+	writeTypes  []string
+	disconnects int
+}
+
+// startSessionBus starts a private D-Bus daemon and returns its address.
+func startSessionBus(t *testing.T) (string, func()) {
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Skipf("cannot start dbus-daemon: %v", err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address), stop
+}
+
+func newFakeBluez(t *testing.T, address string) *fakeBluez {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeBluez{
+		conn: conn,
+		device: map[string]dbus.Variant{
+			"Address":          dbus.MakeVariant(fakeAddress),
+			"Connected":        dbus.MakeVariant(false),
+			"ServicesResolved": dbus.MakeVariant(false),
+		},
+	}
+
+	conn.ExportMethodTable(map[string]interface{}{
+		"GetManagedObjects": f.managedObjects,
+	}, "/", objectManagerInterface)
+	conn.ExportMethodTable(map[string]interface{}{
+		"SetDiscoveryFilter": func(map[string]dbus.Variant) *dbus.Error { return nil },
+		"StartDiscovery":     f.startDiscovery,
+		"StopDiscovery":      f.stopDiscovery,
+	}, fakeAdapterPath, adapterInterface)
+	conn.ExportMethodTable(map[string]interface{}{
+		"Connect":    f.connect,
+		"Disconnect": f.disconnect,
+	}, fakeDevicePath, deviceInterface)
+	conn.ExportMethodTable(map[string]interface{}{
+		"GetAll": f.deviceProperties,
+	}, fakeDevicePath, propertiesInterface)
+	conn.ExportMethodTable(map[string]interface{}{
+		"ReadValue":  func(map[string]dbus.Variant) ([]byte, *dbus.Error) { return []byte{1, 2, 3}, nil },
+		"WriteValue": f.writeValue,
+		"StartNotify": func() *dbus.Error {
+			f.setNotifying(true)
+			return nil
+		},
+		"StopNotify": func() *dbus.Error {
+			f.setNotifying(false)
+			return nil
+		},
+	}, fakeCharacteristicPath, gattCharacteristicInterface)
+
+	reply, err := conn.RequestName(bluezService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("cannot own %s: %v", bluezService, err)
+	}
+	return f
+}
+
+func (f *fakeBluez) close() {
+	f.stopDiscovery()
+	f.conn.Close()
+}
+
+func (f *fakeBluez) managedObjects() (managedObjects, *dbus.Error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects := managedObjects{
+		fakeAdapterPath: {adapterInterface: {"Address": dbus.MakeVariant("00:11:22:33:44:55")}},
+		fakeDevicePath:  {deviceInterface: f.deviceCopy()},
+	}
+	if f.connected {
+		objects[fakeServicePath] = map[string]map[string]dbus.Variant{gattServiceInterface: {
+			"UUID":   dbus.MakeVariant(fakeServiceUUID),
+			"Device": dbus.MakeVariant(fakeDevicePath),
+		}}
+		objects[fakeCharacteristicPath] = map[string]map[string]dbus.Variant{gattCharacteristicInterface: {
+			"UUID":    dbus.MakeVariant(fakeCharacteristicUUID),
+			"Service": dbus.MakeVariant(fakeServicePath),
+			"MTU":     dbus.MakeVariant(uint16(fakeMTU)),
+		}}
+	}
+	return objects, nil
+}
+
+func (f *fakeBluez) deviceCopy() map[string]dbus.Variant {
+	props := make(map[string]dbus.Variant)
+	for name, value := range f.device {
+		props[name] = value
+	}
+	return props
+}
+
+func (f *fakeBluez) deviceProperties(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.deviceCopy(), nil
+}
+
+// startDiscovery reports an advertisement of the device every 20ms.
+func (f *fakeBluez) startDiscovery() *dbus.Error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.discovery != nil {
+		return dbus.NewError("org.bluez.Error.InProgress", nil)
+	}
+	stop := make(chan struct{})
+	f.discovery = stop
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				f.advertise()
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *fakeBluez) stopDiscovery() *dbus.Error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.discovery != nil {
+		close(f.discovery)
+		f.discovery = nil
+	}
+	delete(f.device, "RSSI")
+	return nil
+}
+
+func (f *fakeBluez) advertise() {
+	changed := map[string]dbus.Variant{
+		"RSSI":             dbus.MakeVariant(int16(-42)),
+		"Name":             dbus.MakeVariant("DfuTarg"),
+		"UUIDs":            dbus.MakeVariant([]string{fakeServiceUUID}),
+		"ManufacturerData": dbus.MakeVariant(map[uint16]dbus.Variant{0x0059: dbus.MakeVariant([]byte{1, 2})}),
+	}
+
+	f.mutex.Lock()
+	for name, value := range changed {
+		f.device[name] = value
+	}
+	f.mutex.Unlock()
+
+	f.conn.Emit(fakeDevicePath, propertiesInterface+".PropertiesChanged", deviceInterface, changed, []string{})
+}
+
+func (f *fakeBluez) connect() *dbus.Error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.connected = true
+	f.device["Connected"] = dbus.MakeVariant(true)
+	f.device["ServicesResolved"] = dbus.MakeVariant(true)
+	return nil
+}
+
+func (f *fakeBluez) disconnect() *dbus.Error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.connected = false
+	f.notifying = false
+	f.disconnects++
+	f.device["Connected"] = dbus.MakeVariant(false)
+	f.device["ServicesResolved"] = dbus.MakeVariant(false)
+	return nil
+}
+
+func (f *fakeBluez) setNotifying(notifying bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.notifying = notifying
+}
+
+func (f *fakeBluez) writeValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	f.mutex.Lock()
+	writeType, _ := options["type"].Value().(string)
+	f.writes = append(f.writes, value)
+	f.writeTypes = append(f.writeTypes, writeType)
+	notifying := f.notifying
+	f.mutex.Unlock()
+
+	if notifying {
+		changed := map[string]dbus.Variant{"Value": dbus.MakeVariant(append([]byte{0x60}, value...))}
+		f.conn.Emit(fakeCharacteristicPath, propertiesInterface+".PropertiesChanged", gattCharacteristicInterface, changed, []string{})
+	}
+	return nil
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeBluez, func()) {
+	address, stopBus := startSessionBus(t)
+	fake := newFakeBluez(t, address)
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		fake.close()
+		stopBus()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		conn.Close()
+		fake.close()
+		stopBus()
+	}
+
+	client, err := NewClient(conn, "")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return client, fake, cleanup
+}
+
+func TestNewClient(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	if client.adapter != fakeAdapterPath {
+		t.Errorf("default adapter is %s, expected %s", client.adapter, fakeAdapterPath)
+	}
+	if _, err := NewClient(client.conn, "hci1"); err == nil {
+		t.Error("NewClient accepted an adapter that does not exist")
+	}
+
+	adapters, err := Adapters(client.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adapters) != 1 || adapters[0].ID != DefaultAdapter || adapters[0].Address != "00:11:22:33:44:55" {
+		t.Errorf("unexpected adapters %+v", adapters)
+	}
+}
+
+func TestScan(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	devices, err := ble.ScanDevices(client, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("found %d devices, expected 1", len(devices))
+	}
+
+	device := devices[0]
+	if device.Addr != fakeAddress || device.Name != "DfuTarg" || device.RSSI != -42 {
+		t.Errorf("unexpected device %+v", device)
+	}
+	if !device.HasService("fe59") {
+		t.Errorf("services %v do not include fe59", device.Services)
+	}
+	if !bytes.Equal(device.ManufacturerData, []byte{0x59, 0x00, 1, 2}) {
+		t.Errorf("manufacturer data is % x", device.ManufacturerData)
+	}
+	if device.Advertisements < 2 {
+		t.Errorf("received %d advertisements, expected repeated advertisements", device.Advertisements)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	client, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	if _, err := client.ConnectName("Unknown", 200*time.Millisecond); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected a timeout connecting to an unknown device, got %v", err)
+	}
+
+	p, err := client.ConnectName("dfutarg", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr() != fakeAddress {
+		t.Errorf("connected to %s, expected %s", p.Addr(), fakeAddress)
+	}
+	if err = p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = client.ConnectAddress(strings.ToLower(fakeAddress), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+
+	if p.FindService("fe59") == nil {
+		t.Error("service fe59 not found")
+	}
+	if mtu, err := p.ExchangeMTU(247); err != nil || mtu != fakeMTU {
+		t.Errorf("MTU is %d, expected %d: %v", mtu, fakeMTU, err)
+	}
+	if data, err := p.ReadCharacteristic(fakeCharacteristicUUID); err != nil || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("read % x: %v", data, err)
+	}
+}
+
+func TestWriteAndNotify(t *testing.T) {
+	client, fake, cleanup := newTestClient(t)
+	defer cleanup()
+
+	p, err := client.ConnectAddress(fakeAddress, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(chan []byte, 2)
+	err = p.Subscribe(fakeCharacteristicUUID, ble.SubscriptionTypeNotification, func(data []byte) {
+		notifications <- data
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.WriteCharacteristic(fakeCharacteristicUUID, []byte{0x09, 0x01}, ble.WithResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.WriteCharacteristic(fakeCharacteristicUUID, []byte{0x09, 0x02}, ble.NoResponse); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range [][]byte{{0x60, 0x09, 0x01}, {0x60, 0x09, 0x02}} {
+		select {
+		case data := <-notifications:
+			if !bytes.Equal(data, expected) {
+				t.Errorf("notification is % x, expected % x", data, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no notification received")
+		}
+	}
+
+	if err = p.Unsubscribe(fakeCharacteristicUUID, ble.SubscriptionTypeNotification); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.WriteCharacteristic(fakeCharacteristicUUID, []byte{0x09, 0x03}, ble.WithResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if strings.Join(fake.writeTypes, ",") != "request,command,request" {
+		t.Errorf("write types are %v", fake.writeTypes)
+	}
+	if fake.notifying || fake.disconnects != 1 {
+		t.Errorf("device is still notifying or not disconnected once")
+	}
+	if len(notifications) != 0 {
+		t.Error("received a notification after unsubscribing")
+	}
+}
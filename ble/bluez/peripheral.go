@@ -0,0 +1,348 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bluez
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+type peripheral struct {
+	client   *Client
+	path     dbus.ObjectPath
+	address  string
+	mtu      int
+	attMtu   int
+	services []*service
+
+	mutex     sync.Mutex
+	callbacks map[dbus.ObjectPath]func([]byte)
+	signals   chan *dbus.Signal
+	done      chan struct{}
+}
+
+type service struct {
+	path            dbus.ObjectPath
+	uuid            string
+	characteristics []*characteristic
+}
+
+type characteristic struct {
+	peripheral *peripheral
+	path       dbus.ObjectPath
+	uuid       string
+}
+
+func newPeripheral(ctx context.Context, client *Client, path dbus.ObjectPath, address string) (*peripheral, error) {
+	objects, err := client.managedObjects(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover profiles")
+	}
+
+	p := &peripheral{
+		client:    client,
+		path:      path,
+		address:   address,
+		mtu:       ble.DefaultMTU,
+		callbacks: make(map[dbus.ObjectPath]func([]byte)),
+	}
+
+	services := make(map[dbus.ObjectPath]*service)
+	for _, objectPath := range sortedPaths(objects) {
+		props, ok := objects[objectPath][gattServiceInterface]
+		if !ok {
+			continue
+		}
+		if device, _ := props["Device"].Value().(dbus.ObjectPath); device != path {
+			continue
+		}
+		s := &service{path: objectPath, uuid: stringProperty(props, "UUID")}
+		services[objectPath] = s
+		p.services = append(p.services, s)
+	}
+
+	for _, objectPath := range sortedPaths(objects) {
+		props, ok := objects[objectPath][gattCharacteristicInterface]
+		if !ok {
+			continue
+		}
+		servicePath, _ := props["Service"].Value().(dbus.ObjectPath)
+		s, ok := services[servicePath]
+		if !ok {
+			continue
+		}
+		// BlueZ exchanges the MTU itself when connecting. Since 5.62 it
+		// reports the result on each characteristic.
+		if mtu, ok := props["MTU"].Value().(uint16); ok {
+			p.attMtu = int(mtu)
+		}
+		s.characteristics = append(s.characteristics, &characteristic{
+			peripheral: p,
+			path:       objectPath,
+			uuid:       stringProperty(props, "UUID"),
+		})
+	}
+
+	return p, nil
+}
+
+func (p *peripheral) Addr() string {
+	return p.address
+}
+
+func (p *peripheral) Disconnect() error {
+	p.mutex.Lock()
+	if p.done != nil {
+		close(p.done)
+		p.client.conn.RemoveSignal(p.signals)
+		p.client.conn.RemoveMatchSignal(p.signalMatch()...)
+		p.done = nil
+	}
+	p.callbacks = make(map[dbus.ObjectPath]func([]byte))
+	p.mutex.Unlock()
+
+	err := p.client.conn.Object(bluezService, p.path).Call(deviceInterface+".Disconnect", 0).Err
+	if err != nil {
+		return errors.Wrap(err, "failed to disconnect BLE peripheral")
+	}
+	return nil
+}
+
+func (p *peripheral) ExchangeMTU(mtu int) (int, error) {
+	if p.attMtu == 0 {
+		jww.DEBUG.Printf("BlueZ does not report the ATT MTU, using %d\n", p.mtu)
+		return p.mtu, nil
+	}
+	p.mtu = p.attMtu
+	if mtu < p.mtu {
+		p.mtu = mtu
+	}
+	return p.mtu, nil
+}
+
+func (p *peripheral) MTU() int {
+	return p.mtu
+}
+
+func (p *peripheral) FindService(uuid string) ble.Service {
+	for _, s := range p.services {
+		if sameUuid(s.uuid, uuid) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (p *peripheral) FindCharacteristic(uuid string) ble.Characteristic {
+	if c := p.findCharacteristic(uuid); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (p *peripheral) findCharacteristic(uuid string) *characteristic {
+	for _, s := range p.services {
+		for _, c := range s.characteristics {
+			if sameUuid(c.uuid, uuid) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func (p *peripheral) ReadCharacteristic(uuid string) ([]byte, error) {
+	c := p.findCharacteristic(uuid)
+	if c == nil {
+		return nil, errors.Errorf("characteristic %s not found", uuid)
+	}
+	return c.ReadCharacteristic()
+}
+
+func (p *peripheral) WriteCharacteristic(uuid string, data []byte, writeType ble.WriteCharacteristicType) error {
+	c := p.findCharacteristic(uuid)
+	if c == nil {
+		return errors.Errorf("characteristic %s not found", uuid)
+	}
+	return c.WriteCharacteristic(data, writeType)
+}
+
+func (p *peripheral) Subscribe(uuid string, subType ble.SubscriptionType, callback func([]byte)) error {
+	c := p.findCharacteristic(uuid)
+	if c == nil {
+		return errors.Errorf("characteristic %s not found", uuid)
+	}
+	return c.Subscribe(subType, callback)
+}
+
+func (p *peripheral) Unsubscribe(uuid string, subType ble.SubscriptionType) error {
+	c := p.findCharacteristic(uuid)
+	if c == nil {
+		return errors.Errorf("characteristic %s not found", uuid)
+	}
+	return c.Unsubscribe(subType)
+}
+
+func (p *peripheral) signalMatch() []dbus.MatchOption {
+	return []dbus.MatchOption{
+		dbus.WithMatchSender(bluezService),
+		dbus.WithMatchInterface(propertiesInterface),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchPathNamespace(p.path),
+	}
+}
+
+// listen starts delivering notifications to the subscribed callbacks.
+func (p *peripheral) listen() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.done != nil {
+		return nil
+	}
+
+	if err := p.client.conn.AddMatchSignal(p.signalMatch()...); err != nil {
+		return errors.Wrap(err, "failed to subscribe to BlueZ signals")
+	}
+
+	p.signals = make(chan *dbus.Signal, signalChannelSize)
+	p.done = make(chan struct{})
+	p.client.conn.Signal(p.signals)
+	go p.dispatch(p.signals, p.done)
+	return nil
+}
+
+func (p *peripheral) dispatch(signals chan *dbus.Signal, done chan struct{}) {
+	prefix := string(p.path) + "/"
+	for {
+		select {
+		case <-done:
+			return
+
+		case sig, ok := <-signals:
+			if !ok {
+				return
+			}
+			if sig.Name != propertiesInterface+".PropertiesChanged" || !strings.HasPrefix(string(sig.Path), prefix) {
+				continue
+			}
+
+			var iface string
+			var changed map[string]dbus.Variant
+			var invalidated []string
+			if dbus.Store(sig.Body, &iface, &changed, &invalidated) != nil || iface != gattCharacteristicInterface {
+				continue
+			}
+			value, ok := changed["Value"].Value().([]byte)
+			if !ok {
+				continue
+			}
+
+			p.mutex.Lock()
+			callback := p.callbacks[sig.Path]
+			p.mutex.Unlock()
+
+			if callback != nil {
+				callback(value)
+			}
+		}
+	}
+}
+
+func (s *service) Uuid() string {
+	return shortUuid(s.uuid)
+}
+
+func (s *service) FindCharacteristic(uuid string) ble.Characteristic {
+	for _, c := range s.characteristics {
+		if sameUuid(c.uuid, uuid) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *characteristic) Uuid() string {
+	return shortUuid(c.uuid)
+}
+
+func (c *characteristic) object() dbus.BusObject {
+	return c.peripheral.client.conn.Object(bluezService, c.path)
+}
+
+func (c *characteristic) ReadCharacteristic() ([]byte, error) {
+	var data []byte
+	err := c.object().Call(gattCharacteristicInterface+".ReadValue", 0, map[string]interface{}{}).Store(&data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read BLE characteristic")
+	}
+	return data, nil
+}
+
+func (c *characteristic) WriteCharacteristic(data []byte, writeType ble.WriteCharacteristicType) error {
+	options := map[string]interface{}{"type": "request"}
+	if writeType == ble.NoResponse {
+		options["type"] = "command"
+	}
+
+	err := c.object().Call(gattCharacteristicInterface+".WriteValue", 0, data, options).Err
+	if err != nil {
+		return errors.Wrap(err, "failed to write to BLE characteristic")
+	}
+	return nil
+}
+
+// Subscribe enables notifications or indications, whichever the
+// characteristic supports. BlueZ does not let the client choose.
+func (c *characteristic) Subscribe(subType ble.SubscriptionType, callback func([]byte)) error {
+	if err := c.peripheral.listen(); err != nil {
+		return err
+	}
+
+	c.peripheral.mutex.Lock()
+	c.peripheral.callbacks[c.path] = callback
+	c.peripheral.mutex.Unlock()
+
+	if err := c.object().Call(gattCharacteristicInterface+".StartNotify", 0).Err; err != nil {
+		c.peripheral.mutex.Lock()
+		delete(c.peripheral.callbacks, c.path)
+		c.peripheral.mutex.Unlock()
+		return errors.Wrap(err, "failed to subscribe to BLE characteristic value changes")
+	}
+	return nil
+}
+
+func (c *characteristic) Unsubscribe(subType ble.SubscriptionType) error {
+	c.peripheral.mutex.Lock()
+	delete(c.peripheral.callbacks, c.path)
+	c.peripheral.mutex.Unlock()
+
+	if err := c.object().Call(gattCharacteristicInterface+".StopNotify", 0).Err; err != nil {
+		return errors.Wrap(err, "failed to unsubscribe from BLE characteristic value changes")
+	}
+	return nil
+}
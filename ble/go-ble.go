@@ -25,19 +25,45 @@ import (
 	"github.com/go-ble/ble"
 	"github.com/pkg/errors"
 	"strings"
+	"sync"
 	"time"
 )
 
-type GoBleInitFunc func() (ble.Device, error)
+type GoBleInitFunc func(adapter string) (ble.Device, error)
+
+type goBleAdapter struct {
+	device ble.Device
+	ready  chan struct{}
+	err    error
+
+	// The adapter can only scan or establish one connection at a time.
+	// Concurrent scans share one scan of the device, which is paused while
+	// a connection is established. Established connections can be used
+	// concurrently.
+	mutex      sync.Mutex
+	deviceScan *deviceScan
+
+	handlersMutex sync.Mutex
+	handlers      map[int]ble.AdvHandler
+	nextHandler   int
+}
+
+// deviceScan is a running scan of the device of an adapter.
+type deviceScan struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
 
 type bleClient struct {
-	device *ble.Device
+	adapter *goBleAdapter
 }
 
 type blePeripheral struct {
 	address string
 	client  ble.Client
 	profile *ble.Profile
+	mtu     int
 }
 
 type bleService struct {
@@ -50,27 +76,49 @@ type bleCharacteristic struct {
 	characteristic *ble.Characteristic
 }
 
-var currentDevice *ble.Device
+// Devices of the adapters in use. An adapter can only be opened once, so
+// clients of the same adapter share the device.
+var (
+	adaptersMutex sync.Mutex
+	openAdapters  = make(map[string]*goBleAdapter)
+)
 
-func NewGoBleClient(init GoBleInitFunc) (*bleClient, error) {
-	if currentDevice == nil {
-		device, err := init()
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to create new BLE device")
+// NewGoBleClient returns a client for the adapter, opening it with init if no
+// other client uses it yet. The adapter name must be normalized, so that
+// names of the same adapter are equal.
+func NewGoBleClient(adapter string, init GoBleInitFunc) (*bleClient, error) {
+	adaptersMutex.Lock()
+	a, ok := openAdapters[adapter]
+	if !ok {
+		a = &goBleAdapter{ready: make(chan struct{}), handlers: make(map[int]ble.AdvHandler)}
+		openAdapters[adapter] = a
+	}
+	adaptersMutex.Unlock()
+
+	// Opening an adapter can take a while. Other adapters can be opened in
+	// the meantime.
+	if !ok {
+		a.device, a.err = init(adapter)
+		if a.err != nil {
+			adaptersMutex.Lock()
+			delete(openAdapters, adapter)
+			adaptersMutex.Unlock()
 		}
-		ble.SetDefaultDevice(device)
-
-		currentDevice = &device
+		close(a.ready)
 	}
 
-	return &bleClient{device: currentDevice}, nil
+	<-a.ready
+	if a.err != nil {
+		return nil, errors.Wrap(a.err, "failed to create new BLE device")
+	}
+	return &bleClient{adapter: a}, nil
 }
 
 func (b *bleClient) ConnectName(name string, timeout time.Duration) (Peripheral, error) {
+	ctx, cancel := WithSignalHandler(context.WithTimeout(context.Background(), timeout))
+	defer cancel()
 
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), timeout))
-
-	client, err := ble.Connect(ctx, func(a ble.Advertisement) bool {
+	client, err := b.adapter.connect(ctx, func(a ble.Advertisement) bool {
 		return strings.ToLower(a.LocalName()) == strings.ToLower(name)
 	})
 	if err != nil {
@@ -88,13 +136,15 @@ func (b *bleClient) ConnectName(name string, timeout time.Duration) (Peripheral,
 		address: addr.String(),
 		client:  client,
 		profile: profile,
+		mtu:     DefaultMTU,
 	}, nil
 }
 
 func (b *bleClient) ConnectAddress(address string, timeout time.Duration) (Peripheral, error) {
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), timeout))
+	ctx, cancel := WithSignalHandler(context.WithTimeout(context.Background(), timeout))
+	defer cancel()
 
-	client, err := ble.Dial(ctx, ble.NewAddr(address))
+	client, err := b.adapter.dial(ctx, ble.NewAddr(address))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to connect to BLE peripheral")
 	}
@@ -108,17 +158,149 @@ func (b *bleClient) ConnectAddress(address string, timeout time.Duration) (Perip
 		address: address,
 		client:  client,
 		profile: profile,
+		mtu:     DefaultMTU,
 	}, nil
 }
 
 func (b *bleClient) Scan(duration time.Duration, handler AdvertisementHandler) (err error) {
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), duration))
+	ctx, cancel := WithSignalHandler(context.WithTimeout(context.Background(), duration))
+	defer cancel()
 
-	err = ble.Scan(ctx, false, b.handleAdvertisement(handler), nil)
+	err = b.adapter.scan(ctx, b.handleAdvertisement(handler))
 
 	return err
 }
 
+// connect scans for the first device accepted by filter and connects to it.
+// This is ble.Connect for a device other than the default device.
+func (a *goBleAdapter) connect(ctx context.Context, filter ble.AdvFilter) (ble.Client, error) {
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan ble.Addr, 1)
+	err := a.scan(scanCtx, func(adv ble.Advertisement) {
+		if filter(adv) {
+			select {
+			case found <- adv.Addr():
+				cancel()
+			default:
+			}
+		}
+	})
+
+	select {
+	case addr := <-found:
+		client, err := a.dial(ctx, addr)
+		return client, errors.Wrap(err, "can't dial")
+	default:
+	}
+	return nil, errors.Wrap(err, "can't scan")
+}
+
+// dial connects to a device. A running scan is paused until the connection
+// is established.
+func (a *goBleAdapter) dial(ctx context.Context, addr ble.Addr) (ble.Client, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.deviceScan != nil {
+		a.deviceScan.stop()
+		a.deviceScan = nil
+	}
+	return a.device.Dial(ctx, addr)
+}
+
+// scan passes advertisements to handler until ctx is done, or the scan of
+// the device fails.
+func (a *goBleAdapter) scan(ctx context.Context, handler ble.AdvHandler) error {
+	a.handlersMutex.Lock()
+	id := a.nextHandler
+	a.nextHandler++
+	a.handlers[id] = handler
+	a.handlersMutex.Unlock()
+
+	defer a.removeHandler(id)
+
+	for {
+		s := a.startScan()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			if s.err != nil {
+				return s.err
+			}
+			// Paused while connecting, resume when the connection is made.
+		}
+	}
+}
+
+// startScan returns the running scan of the device, starting one if needed.
+func (a *goBleAdapter) startScan() *deviceScan {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.deviceScan != nil {
+		select {
+		case <-a.deviceScan.done:
+		default:
+			return a.deviceScan
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &deviceScan{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		err := a.device.Scan(ctx, false, a.dispatch)
+		if ctx.Err() == nil {
+			if err == nil {
+				err = errors.New("scan ended")
+			}
+			s.err = err
+		}
+	}()
+	a.deviceScan = s
+	return s
+}
+
+func (a *goBleAdapter) removeHandler(id int) {
+	a.handlersMutex.Lock()
+	delete(a.handlers, id)
+	a.handlersMutex.Unlock()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.handlersMutex.Lock()
+	idle := len(a.handlers) == 0
+	a.handlersMutex.Unlock()
+
+	if idle && a.deviceScan != nil {
+		a.deviceScan.stop()
+		a.deviceScan = nil
+	}
+}
+
+// dispatch passes an advertisement to the handlers of all scans.
+func (a *goBleAdapter) dispatch(adv ble.Advertisement) {
+	a.handlersMutex.Lock()
+	handlers := make([]ble.AdvHandler, 0, len(a.handlers))
+	for _, handler := range a.handlers {
+		handlers = append(handlers, handler)
+	}
+	a.handlersMutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(adv)
+	}
+}
+
+func (s *deviceScan) stop() {
+	s.cancel()
+	<-s.done
+}
+
 func (p *blePeripheral) Disconnect() (err error) {
 	p.client.CancelConnection()
 	return
@@ -128,6 +310,19 @@ func (p *blePeripheral) Addr() string {
 	return p.address
 }
 
+func (p *blePeripheral) ExchangeMTU(mtu int) (int, error) {
+	txMtu, err := p.client.ExchangeMTU(mtu)
+	if err != nil {
+		return p.mtu, errors.Wrap(err, "failed to exchange MTU")
+	}
+	p.mtu = txMtu
+	return p.mtu, nil
+}
+
+func (p *blePeripheral) MTU() int {
+	return p.mtu
+}
+
 func (p *blePeripheral) FindService(uuid string) Service {
 	bleUuid, _ := ble.Parse(uuid)
 	if s := p.profile.FindService(ble.NewService(bleUuid)); s != nil {
@@ -161,6 +356,18 @@ func writeCharacteristicTypeToBool(writeType WriteCharacteristicType) bool {
 	return false
 }
 
+func (p *blePeripheral) ReadCharacteristic(uuid string) ([]byte, error) {
+	bleUuid, _ := ble.Parse(uuid)
+	if c := p.profile.Find(ble.NewCharacteristic(bleUuid)); c != nil {
+		data, err := p.client.ReadCharacteristic(c.(*ble.Characteristic))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read BLE characteristic")
+		}
+		return data, nil
+	}
+	return nil, errors.Errorf("characteristic %s not found", uuid)
+}
+
 func (p *blePeripheral) WriteCharacteristic(uuid string, data []byte, writeType WriteCharacteristicType) (err error) {
 	bleUuid, _ := ble.Parse(uuid)
 	if c := p.profile.Find(ble.NewCharacteristic(bleUuid)); c != nil {
@@ -230,6 +437,14 @@ func (c *bleCharacteristic) Uuid() string {
 	return c.characteristic.UUID.String()
 }
 
+func (c *bleCharacteristic) ReadCharacteristic() ([]byte, error) {
+	data, err := c.client.ReadCharacteristic(c.characteristic)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read BLE characteristic")
+	}
+	return data, nil
+}
+
 func (c *bleCharacteristic) WriteCharacteristic(data []byte, writeType WriteCharacteristicType) (err error) {
 	err = c.client.WriteCharacteristic(c.characteristic, data, writeCharacteristicTypeToBool(writeType))
 	if err != nil {
@@ -263,6 +478,23 @@ func (c *bleClient) handleAdvertisement(handler AdvertisementHandler) ble.AdvHan
 			services = append(services, s.String())
 		}
 
-		handler(Advertisement{Name: a.LocalName(), Addr: a.Addr().String(), Services: services})
+		var serviceData map[string][]byte
+		for _, d := range a.ServiceData() {
+			if serviceData == nil {
+				serviceData = make(map[string][]byte)
+			}
+			serviceData[d.UUID.String()] = d.Data
+		}
+
+		handler(Advertisement{
+			Name:             a.LocalName(),
+			Addr:             a.Addr().String(),
+			Services:         services,
+			RSSI:             a.RSSI(),
+			TxPower:          a.TxPowerLevel(),
+			ManufacturerData: a.ManufacturerData(),
+			ServiceData:      serviceData,
+			Connectable:      a.Connectable(),
+		})
 	}
 }
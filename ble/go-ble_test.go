@@ -0,0 +1,182 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ble
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/pkg/errors"
+)
+
+// fakeDevice reports an advertisement every millisecond while scanning, and
+// checks that scanning and dialing do not overlap.
+type fakeDevice struct {
+	ble.Device
+
+	mutex    sync.Mutex
+	scanning int
+	scans    int
+	dials    int
+	overlaps int
+}
+
+func (d *fakeDevice) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	d.mutex.Lock()
+	d.scanning++
+	d.scans++
+	if d.scanning > 1 {
+		d.overlaps++
+	}
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		d.scanning--
+		d.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			h(nil)
+		}
+	}
+}
+
+func (d *fakeDevice) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.dials++
+	if d.scanning > 0 {
+		d.overlaps++
+	}
+	return nil, nil
+}
+
+func newFakeAdapter() (*goBleAdapter, *fakeDevice) {
+	device := &fakeDevice{}
+	return &goBleAdapter{device: device, handlers: make(map[int]ble.AdvHandler)}, device
+}
+
+func TestAdapterConcurrentScans(t *testing.T) {
+	adapter, device := newFakeAdapter()
+
+	var wg sync.WaitGroup
+	counts := make([]int, 3)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := adapter.scan(ctx, func(ble.Advertisement) { counts[i]++ })
+			if err != context.DeadlineExceeded {
+				t.Errorf("scan %d: %v", i, err)
+			}
+		}(i)
+	}
+
+	// Connecting does not wait for the scans to end.
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := adapter.dial(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("dial waited for the scans")
+	}
+	wg.Wait()
+
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	if device.overlaps != 0 {
+		t.Errorf("device scanned and dialed concurrently %d times", device.overlaps)
+	}
+	if device.scans != 2 {
+		t.Errorf("device scanned %d times, expected 2 with a pause to dial", device.scans)
+	}
+	if device.scanning != 0 {
+		t.Error("device is still scanning")
+	}
+	for i, count := range counts {
+		if count == 0 {
+			t.Errorf("scan %d received no advertisements", i)
+		}
+	}
+}
+
+type failingDevice struct {
+	ble.Device
+}
+
+func (d *failingDevice) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	return errors.New("scan failed")
+}
+
+func TestAdapterScanError(t *testing.T) {
+	adapter := &goBleAdapter{device: &failingDevice{}, handlers: make(map[int]ble.AdvHandler)}
+
+	err := adapter.scan(context.Background(), func(ble.Advertisement) {})
+	if err == nil || err.Error() != "scan failed" {
+		t.Errorf("expected the scan error, got %v", err)
+	}
+}
+
+func TestNewGoBleClientSharesAdapter(t *testing.T) {
+	opened := 0
+	init := func(adapter string) (ble.Device, error) {
+		opened++
+		if adapter == "fail" {
+			return nil, errors.New("no such adapter")
+		}
+		return &fakeDevice{}, nil
+	}
+
+	a, err := NewGoBleClient("test0", init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewGoBleClient("test0", init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.adapter != b.adapter || opened != 1 {
+		t.Errorf("adapter opened %d times", opened)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = NewGoBleClient("fail", init); err == nil {
+			t.Error("expected an error for an adapter that cannot be opened")
+		}
+	}
+	if opened != 3 {
+		t.Error("opening an adapter is not retried after a failure")
+	}
+}
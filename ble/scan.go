@@ -0,0 +1,136 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ble
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ScannedDevice combines the advertisements and scan responses of a device.
+type ScannedDevice struct {
+	Advertisement
+
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	Advertisements int
+}
+
+// ScanResults keeps track of the unique devices seen during a scan.
+type ScanResults struct {
+	mutex   sync.Mutex
+	devices map[string]*ScannedDevice
+}
+
+func NewScanResults() *ScanResults {
+	return &ScanResults{devices: make(map[string]*ScannedDevice)}
+}
+
+// Add is an AdvertisementHandler that records an advertisement. Fields that
+// are missing from the advertisement, such as the name that is only part of
+// the scan response, keep their previous value.
+func (r *ScanResults) Add(adv Advertisement) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	key := strings.ToLower(adv.Addr)
+	device, ok := r.devices[key]
+	if !ok {
+		device = &ScannedDevice{Advertisement: Advertisement{Addr: adv.Addr}, FirstSeen: now}
+		r.devices[key] = device
+	}
+
+	device.LastSeen = now
+	device.Advertisements++
+	device.RSSI = adv.RSSI
+	device.Connectable = device.Connectable || adv.Connectable
+	if adv.Name != "" {
+		device.Name = adv.Name
+	}
+	if adv.TxPower != 0 {
+		device.TxPower = adv.TxPower
+	}
+	if len(adv.ManufacturerData) > 0 {
+		device.ManufacturerData = append([]byte{}, adv.ManufacturerData...)
+	}
+	for uuid, data := range adv.ServiceData {
+		if device.ServiceData == nil {
+			device.ServiceData = make(map[string][]byte)
+		}
+		device.ServiceData[uuid] = append([]byte{}, data...)
+	}
+	for _, service := range adv.Services {
+		if !device.HasService(service) {
+			device.Services = append(device.Services, service)
+		}
+	}
+}
+
+// Devices returns a copy of the devices seen, in the order they were first seen.
+func (r *ScanResults) Devices() []ScannedDevice {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	devices := make([]ScannedDevice, 0, len(r.devices))
+	for _, device := range r.devices {
+		d := *device
+		d.Services = append([]string{}, device.Services...)
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].FirstSeen.Equal(devices[j].FirstSeen) {
+			return devices[i].Addr < devices[j].Addr
+		}
+		return devices[i].FirstSeen.Before(devices[j].FirstSeen)
+	})
+	return devices
+}
+
+// HasService reports whether the device advertises the service. UUIDs are
+// compared without regard to case and dashes.
+func (adv *Advertisement) HasService(uuid string) bool {
+	for _, service := range adv.Services {
+		if normalizeUuid(service) == normalizeUuid(uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeUuid(uuid string) string {
+	return strings.Replace(strings.ToLower(uuid), "-", "", -1)
+}
+
+// ScanDevices scans for the given duration and returns the devices seen.
+func ScanDevices(client Client, duration time.Duration) ([]ScannedDevice, error) {
+	results := NewScanResults()
+	err := client.Scan(duration, results.Add)
+	if err != nil && errors.Cause(err) != context.DeadlineExceeded {
+		return nil, errors.Wrap(err, "failed to scan for devices")
+	}
+	return results.Devices(), nil
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ble
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanResultsDeduplicate(t *testing.T) {
+	results := NewScanResults()
+	results.Add(Advertisement{Addr: "AA:BB:CC:DD:EE:01", RSSI: -70, Connectable: true, Services: []string{"fe59"}, ManufacturerData: []byte{0x59, 0x00}})
+	results.Add(Advertisement{Addr: "aa:bb:cc:dd:ee:01", Name: "Sensor", RSSI: -60, TxPower: 4, Services: []string{"FE59", "180A"}})
+	results.Add(Advertisement{Addr: "AA:BB:CC:DD:EE:02", Name: "Other", RSSI: -50})
+	results.Add(Advertisement{Addr: "AA:BB:CC:DD:EE:01", RSSI: -80, ServiceData: map[string][]byte{"fe59": {0x01}}})
+
+	devices := results.Devices()
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, expected 2", len(devices))
+	}
+
+	device := devices[0]
+	if device.Addr != "AA:BB:CC:DD:EE:01" || device.Advertisements != 3 {
+		t.Errorf("advertisements of %s were not combined: %+v", device.Addr, device)
+	}
+	// The name of the scan response is kept when later advertisements lack it.
+	if device.Name != "Sensor" || device.TxPower != 4 || !device.Connectable {
+		t.Errorf("fields missing from later advertisements were not kept: %+v", device)
+	}
+	if device.RSSI != -80 {
+		t.Errorf("RSSI is %d, expected the RSSI of the last advertisement", device.RSSI)
+	}
+	if !reflect.DeepEqual(device.Services, []string{"fe59", "180A"}) {
+		t.Errorf("services are %v", device.Services)
+	}
+	if !reflect.DeepEqual(device.ManufacturerData, []byte{0x59, 0x00}) || !reflect.DeepEqual(device.ServiceData, map[string][]byte{"fe59": {0x01}}) {
+		t.Errorf("unexpected data: %+v", device)
+	}
+	if device.LastSeen.Before(device.FirstSeen) {
+		t.Error("last seen is before first seen")
+	}
+
+	if devices[1].Addr != "AA:BB:CC:DD:EE:02" || devices[1].Advertisements != 1 {
+		t.Errorf("unexpected second device %+v", devices[1])
+	}
+}
+
+func TestScanResultsRssi(t *testing.T) {
+	results := NewScanResults()
+	for _, rssi := range []int{-70, -40, -90, -55} {
+		results.Add(Advertisement{Addr: "AA:BB:CC:DD:EE:01", RSSI: rssi})
+		if devices := results.Devices(); devices[0].RSSI != rssi {
+			t.Errorf("RSSI is %d after an advertisement with %d", devices[0].RSSI, rssi)
+		}
+	}
+}
+
+func TestScanResultsCopy(t *testing.T) {
+	results := NewScanResults()
+	results.Add(Advertisement{Addr: "AA:BB:CC:DD:EE:01", Services: []string{"fe59"}})
+
+	devices := results.Devices()
+	devices[0].Services[0] = "180a"
+	devices[0].Name = "Changed"
+
+	if devices := results.Devices(); devices[0].Services[0] != "fe59" || devices[0].Name != "" {
+		t.Errorf("devices returned by Devices share state with the results: %+v", devices[0])
+	}
+}
+
+func TestHasService(t *testing.T) {
+	adv := &Advertisement{Services: []string{"FE59", "8e400001-f315-4f60-9fb8-838830daea50"}}
+
+	tests := []struct {
+		uuid     string
+		expected bool
+	}{
+		{"fe59", true},
+		{"FE59", true},
+		{"8E400001F3154F609FB8838830DAEA50", true},
+		{"8e400001-f315-4f60-9fb8-838830daea50", true},
+		{"180a", false},
+		{"fe5", false},
+	}
+	for _, test := range tests {
+		if adv.HasService(test.uuid) != test.expected {
+			t.Errorf("HasService(%s) is %t", test.uuid, !test.expected)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package sim provides an in-process ble.Client that emulates devices running
+// Nordic's Secure DFU bootloader, so that DFU sessions can be exercised without
+// hardware.
+package sim
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+type Client struct {
+	mutex   sync.Mutex
+	devices []*Device
+}
+
+func NewClient(devices ...*Device) *Client {
+	return &Client{devices: devices}
+}
+
+func (c *Client) AddDevice(device *Device) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.devices = append(c.devices, device)
+}
+
+func (c *Client) Devices() []*Device {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Device{}, c.devices...)
+}
+
+func (c *Client) ConnectName(name string, timeout time.Duration) (ble.Peripheral, error) {
+	return c.connect(timeout, func(d *Device) bool {
+		return strings.ToLower(d.AdvertisedName()) == strings.ToLower(name)
+	})
+}
+
+func (c *Client) ConnectAddress(address string, timeout time.Duration) (ble.Peripheral, error) {
+	return c.connect(timeout, func(d *Device) bool {
+		return strings.ToLower(d.AdvertisedAddress()) == strings.ToLower(address)
+	})
+}
+
+func (c *Client) Scan(duration time.Duration, handler ble.AdvertisementHandler) error {
+	for _, d := range c.Devices() {
+		if d.advertising() {
+			handler(d.advertisement())
+		}
+	}
+	return nil
+}
+
+func (c *Client) connect(timeout time.Duration, match func(d *Device) bool) (ble.Peripheral, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, d := range c.Devices() {
+			if d.advertising() && match(d) {
+				return d.connect(), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Wrap(context.DeadlineExceeded, "failed to connect to BLE peripheral")
+		}
+		time.Sleep(connectPollInterval)
+	}
+}
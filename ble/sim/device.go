@@ -0,0 +1,713 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+)
+
+const (
+	ServiceUUID            = "fe59"
+	ControlPointUUID       = "8ec90001-f315-4f60-9fb8-838830daea50"
+	PacketUUID             = "8ec90002-f315-4f60-9fb8-838830daea50"
+	ButtonlessUnbondedUUID = "8ec90003-f315-4f60-9fb8-838830daea50"
+	ButtonlessBondedUUID   = "8ec90004-f315-4f60-9fb8-838830daea50"
+
+	DeviceInformationUUID = "180a"
+	FirmwareRevisionUUID  = "2a26"
+)
+
+const (
+	opProtocolVersion = 0x00
+	opObjectCreate    = 0x01
+	opReceiptNotifSet = 0x02
+	opCrcGet          = 0x03
+	opObjectExecute   = 0x04
+	opObjectSelect    = 0x06
+	opHardwareVersion = 0x0A
+	opFirmwareVersion = 0x0B
+	opAbort           = 0x0C
+	opResponse        = 0x60
+
+	// PacketData matches data written to the packet characteristic in a Fault.
+	PacketData = 0x100
+)
+
+const (
+	resultSuccess               = 0x01
+	resultOpcodeNotSupported    = 0x02
+	resultInvalidParameter      = 0x03
+	resultInsufficientResources = 0x04
+	resultUnsupportedType       = 0x07
+	resultOperationNotPermitted = 0x08
+	resultExtError              = 0x0B
+
+	extErrorInitCommandInvalid = 0x04
+)
+
+const (
+	objectCommand = 0x01
+	objectData    = 0x02
+)
+
+const (
+	buttonlessEnterBootloader = 0x01
+	buttonlessSetAdvName      = 0x02
+	buttonlessResponse        = 0x20
+)
+
+const (
+	firmwareTypeSoftDevice  = 0x00
+	firmwareTypeApplication = 0x01
+	firmwareTypeBootloader  = 0x02
+)
+
+// Values reported by the simulated bootloader of an nRF52832.
+const (
+	protocolVersion   = 0x01
+	hardwarePart      = 0x52832
+	hardwareVariant   = 0x41414530 // AAE0
+	hardwareRomSize   = 0x80000
+	hardwarePageSize  = 0x1000
+	hardwareRamSize   = 0x10000
+	softDeviceAddress = 0x1000
+	softDeviceSize    = 0x25000
+	softDeviceVersion = 0xB6
+	bootloaderAddress = 0x78000
+	bootloaderSize    = 0x6000
+	bootloaderVersion = 0x01
+)
+
+const connectPollInterval = 10 * time.Millisecond
+
+type Mode int
+
+const (
+	ModeApplication Mode = iota
+	ModeBootloader
+)
+
+type Buttonless int
+
+const (
+	ButtonlessNone Buttonless = iota
+	ButtonlessUnbonded
+	ButtonlessBonded
+)
+
+type FaultType int
+
+const (
+	// The CRC reported by the next matching CRC request or receipt notification is corrupted.
+	FaultCrcMismatch FaultType = iota
+	// The response to the matching request is never sent.
+	FaultDropNotification
+	// The matching request fails with DFU_RESULT_INSUFFICIENT_RESOURCES.
+	FaultInsufficientResources
+	// The device drops the connection instead of handling the matching request.
+	FaultDisconnect
+)
+
+// Fault describes a failure to inject. Opcode is a control point opcode or
+// PacketData. For control point opcodes, After is the number of matching
+// requests that are handled normally before the fault triggers. For
+// PacketData, After is the firmware offset at which the fault triggers.
+type Fault struct {
+	Type   FaultType
+	Opcode int
+	After  int
+}
+
+type ReceivedImage struct {
+	InitPacket []byte
+	Firmware   []byte
+}
+
+type object struct {
+	data     []byte
+	executed int
+	start    int
+	size     int
+}
+
+type Device struct {
+	Address           string
+	Name              string
+	BootloaderAddress string
+	BootloaderName    string
+	Buttonless        Buttonless
+	CommandMaxSize    uint32
+	DataMaxSize       uint32
+	MaxMTU            int
+	RebootDelay       time.Duration
+	// Legacy makes the device implement the legacy DFU protocol of SDK 11
+	// and earlier instead of Secure DFU.
+	Legacy bool
+	// RSSI reported with each advertisement.
+	RSSI int
+	// FirmwareRevision is reported by the Device Information Service of the
+	// application. The service is absent if it is empty.
+	FirmwareRevision string
+
+	mutex       sync.Mutex
+	mode        Mode
+	advName     string
+	unavailable time.Time
+	conn        *peripheral
+	connections int
+	faults      []*Fault
+
+	prn            uint16
+	packetCount    int
+	dropReceipt    bool
+	corruptReceipt bool
+	current        byte
+	command        object
+	data           object
+	initPacket     []byte
+	firmwareSize   int
+	activateToBoot bool
+	images         []ReceivedImage
+	aborts         int
+	legacy         legacyTransfer
+}
+
+func NewDevice(address string, name string, mode Mode, buttonless Buttonless) *Device {
+	return &Device{
+		Address:        address,
+		Name:           name,
+		BootloaderName: "DfuTarg",
+		Buttonless:     buttonless,
+		CommandMaxSize: 256,
+		DataMaxSize:    4096,
+		MaxMTU:         247,
+		RSSI:           -50,
+		mode:           mode,
+	}
+}
+
+func (d *Device) InjectFault(fault Fault) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.faults = append(d.faults, &fault)
+}
+
+func (d *Device) Mode() Mode {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.mode
+}
+
+func (d *Device) Images() []ReceivedImage {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]ReceivedImage{}, d.images...)
+}
+
+func (d *Device) Aborts() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.aborts
+}
+
+func (d *Device) Connections() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.connections
+}
+
+func (d *Device) AdvertisedName() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.mode == ModeApplication {
+		return d.Name
+	}
+	if d.advName != "" {
+		return d.advName
+	}
+	return d.BootloaderName
+}
+
+func (d *Device) AdvertisedAddress() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.mode == ModeBootloader && d.BootloaderAddress != "" {
+		return d.BootloaderAddress
+	}
+	return d.Address
+}
+
+func (d *Device) advertising() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return time.Now().After(d.unavailable)
+}
+
+func (d *Device) advertisement() ble.Advertisement {
+	adv := ble.Advertisement{
+		Addr:        d.AdvertisedAddress(),
+		Name:        d.AdvertisedName(),
+		RSSI:        d.RSSI,
+		Connectable: true,
+	}
+	if d.Legacy {
+		adv.Services = []string{LegacyServiceUUID}
+	} else if d.Mode() == ModeBootloader || d.Buttonless != ButtonlessNone {
+		adv.Services = []string{ServiceUUID}
+	}
+	return adv
+}
+
+func (d *Device) connect() *peripheral {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	services := map[string][]string{}
+	if d.Legacy {
+		if d.mode == ModeBootloader {
+			services[LegacyServiceUUID] = []string{LegacyControlPointUUID, LegacyPacketUUID, LegacyVersionUUID}
+		} else {
+			services[LegacyServiceUUID] = []string{LegacyControlPointUUID, LegacyVersionUUID}
+		}
+	} else if d.mode == ModeBootloader {
+		services[ServiceUUID] = []string{ControlPointUUID, PacketUUID}
+	} else if d.Buttonless == ButtonlessUnbonded {
+		services[ServiceUUID] = []string{ButtonlessUnbondedUUID}
+	} else if d.Buttonless == ButtonlessBonded {
+		services[ServiceUUID] = []string{ButtonlessBondedUUID}
+	}
+	if d.mode == ModeApplication && d.FirmwareRevision != "" {
+		services[DeviceInformationUUID] = []string{FirmwareRevisionUUID}
+	}
+
+	if d.conn != nil {
+		d.conn.close()
+	}
+	d.conn = newPeripheral(d, services)
+	d.connections++
+	return d.conn
+}
+
+// reset reboots the device into the given mode once pending notifications
+// have been delivered.
+func (d *Device) reset(p *peripheral, mode Mode) {
+	d.mode = mode
+	d.unavailable = time.Now().Add(d.RebootDelay)
+	d.prn = 0
+	d.packetCount = 0
+	d.legacy = legacyTransfer{}
+	p.closeAfterPending()
+}
+
+func (d *Device) takeFault(opcode int, offset int) *Fault {
+	for i, f := range d.faults {
+		if f.Opcode != opcode {
+			continue
+		}
+		if opcode == PacketData {
+			if offset < f.After {
+				continue
+			}
+		} else if f.After > 0 {
+			f.After--
+			continue
+		}
+		d.faults = append(d.faults[:i], d.faults[i+1:]...)
+		return f
+	}
+	return nil
+}
+
+func (d *Device) write(p *peripheral, uuid string, data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if p != d.conn {
+		return errors.Wrap(errNotConnected, "failed to write to BLE characteristic")
+	}
+
+	switch uuid {
+	case ControlPointUUID:
+		return d.handleControl(p, data)
+	case PacketUUID:
+		if len(data) > p.MTU()-3 {
+			return errors.New("invalid attribute value length")
+		}
+		d.handlePacket(p, data)
+		return nil
+	case ButtonlessUnbondedUUID, ButtonlessBondedUUID:
+		return d.handleButtonless(p, uuid, data)
+	case LegacyControlPointUUID:
+		return d.handleLegacyControl(p, data)
+	case LegacyPacketUUID:
+		if len(data) > ble.DefaultMTU-3 {
+			return errors.New("invalid attribute value length")
+		}
+		d.handleLegacyPacket(p, data)
+		return nil
+	}
+	return errors.Errorf("write to unsupported characteristic %s", uuid)
+}
+
+func (d *Device) read(p *peripheral, uuid string) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if p != d.conn {
+		return nil, errors.Wrap(errNotConnected, "failed to read BLE characteristic")
+	}
+
+	switch uuid {
+	case LegacyVersionUUID:
+		version := legacyApplicationVersion
+		if d.mode == ModeBootloader {
+			version = legacyBootloaderVersion
+		}
+		return []byte{byte(version), byte(version >> 8)}, nil
+	case FirmwareRevisionUUID:
+		return []byte(d.FirmwareRevision), nil
+	}
+	return nil, errors.Errorf("read from unsupported characteristic %s", uuid)
+}
+
+func (d *Device) handleButtonless(p *peripheral, uuid string, request []byte) error {
+	if !p.isSubscribed(uuid, ble.SubscriptionTypeIndication) {
+		return errors.New("CCCD improperly configured")
+	}
+	if len(request) == 0 {
+		return errors.New("invalid buttonless request")
+	}
+
+	respond := func(result byte) {
+		p.notify(uuid, ble.SubscriptionTypeIndication, []byte{buttonlessResponse, request[0], result})
+	}
+
+	switch request[0] {
+	case buttonlessEnterBootloader:
+		respond(resultSuccess)
+		d.reset(p, ModeBootloader)
+
+	case buttonlessSetAdvName:
+		if uuid != ButtonlessUnbondedUUID || len(request) < 2 || int(request[1]) != len(request)-2 {
+			respond(resultOpcodeNotSupported)
+			return nil
+		}
+		d.advName = string(request[2:])
+		respond(resultSuccess)
+
+	default:
+		respond(resultOpcodeNotSupported)
+	}
+	return nil
+}
+
+func (d *Device) handleControl(p *peripheral, request []byte) error {
+	if len(request) == 0 {
+		return errors.New("empty control point request")
+	}
+	opcode := request[0]
+
+	respond := func(result byte, payload ...byte) {
+		response := append([]byte{opResponse, opcode, result}, payload...)
+		p.notify(ControlPointUUID, ble.SubscriptionTypeNotification, response)
+	}
+
+	crcFault := false
+	if fault := d.takeFault(int(opcode), 0); fault != nil {
+		switch fault.Type {
+		case FaultCrcMismatch:
+			crcFault = true
+		case FaultDropNotification:
+			respond = func(result byte, payload ...byte) {}
+		case FaultInsufficientResources:
+			respond(resultInsufficientResources)
+			return nil
+		case FaultDisconnect:
+			p.close()
+			return nil
+		}
+	}
+
+	switch opcode {
+	case opReceiptNotifSet:
+		if len(request) != 3 {
+			respond(resultInvalidParameter)
+			return nil
+		}
+		d.prn = binary.LittleEndian.Uint16(request[1:])
+		d.packetCount = 0
+		respond(resultSuccess)
+
+	case opObjectSelect:
+		obj := d.object(request[1:])
+		if obj == nil {
+			respond(resultUnsupportedType)
+			return nil
+		}
+		d.current = request[1]
+		maxSize := d.CommandMaxSize
+		if d.current == objectData {
+			maxSize = d.DataMaxSize
+		}
+		respond(resultSuccess, le32(maxSize, uint32(len(obj.data)), crc32.ChecksumIEEE(obj.data))...)
+
+	case opObjectCreate:
+		d.handleCreate(request, respond)
+
+	case opCrcGet:
+		obj := d.object([]byte{d.current})
+		checksum := crc32.ChecksumIEEE(obj.data)
+		if crcFault {
+			checksum ^= 0xFFFFFFFF
+		}
+		respond(resultSuccess, le32(uint32(len(obj.data)), checksum)...)
+
+	case opObjectExecute:
+		d.handleExecute(p, respond)
+
+	case opAbort:
+		d.aborts++
+		respond(resultSuccess)
+
+	case opProtocolVersion:
+		respond(resultSuccess, protocolVersion)
+
+	case opHardwareVersion:
+		respond(resultSuccess, le32(hardwarePart, hardwareVariant, hardwareRomSize, hardwarePageSize, hardwareRamSize)...)
+
+	case opFirmwareVersion:
+		if len(request) != 2 {
+			respond(resultInvalidParameter)
+			return nil
+		}
+		d.handleFirmwareVersion(int(request[1]), respond)
+
+	default:
+		respond(resultOpcodeNotSupported)
+	}
+	return nil
+}
+
+// handleFirmwareVersion reports the bootloader, the SoftDevice and the last
+// application received, in that order.
+func (d *Device) handleFirmwareVersion(image int, respond func(byte, ...byte)) {
+	switch image {
+	case 0:
+		respond(resultSuccess, append([]byte{firmwareTypeBootloader}, le32(bootloaderVersion, bootloaderAddress, bootloaderSize)...)...)
+		return
+	case 1:
+		respond(resultSuccess, append([]byte{firmwareTypeSoftDevice}, le32(softDeviceVersion, softDeviceAddress, softDeviceSize)...)...)
+		return
+	case 2:
+		for i := len(d.images) - 1; i >= 0; i-- {
+			packet, err := initpacket.Decode(d.images[i].InitPacket)
+			if err != nil || packet.GetInitCommand() == nil {
+				continue
+			}
+			init := packet.GetInitCommand()
+			if init.GetType() != initpacket.FwTypeApplication {
+				continue
+			}
+			address := uint32(softDeviceAddress + softDeviceSize)
+			respond(resultSuccess, append([]byte{firmwareTypeApplication}, le32(init.GetFwVersion(), address, uint32(len(d.images[i].Firmware)))...)...)
+			return
+		}
+	}
+	respond(resultInvalidParameter)
+}
+
+func (d *Device) object(request []byte) *object {
+	if len(request) < 1 {
+		return nil
+	}
+	switch request[0] {
+	case objectCommand:
+		return &d.command
+	case objectData:
+		return &d.data
+	}
+	return nil
+}
+
+func (d *Device) handleCreate(request []byte, respond func(byte, ...byte)) {
+	obj := d.object(request[1:])
+	if obj == nil || len(request) != 6 {
+		respond(resultUnsupportedType)
+		return
+	}
+	size := int(binary.LittleEndian.Uint32(request[2:]))
+
+	switch request[1] {
+	case objectCommand:
+		if size > int(d.CommandMaxSize) {
+			respond(resultInsufficientResources)
+			return
+		}
+		d.command = object{size: size}
+
+	case objectData:
+		if d.initPacket == nil {
+			respond(resultOperationNotPermitted)
+			return
+		}
+		if size > int(d.DataMaxSize) || d.data.executed+size > d.firmwareSize {
+			respond(resultInvalidParameter)
+			return
+		}
+		// Data of an object that was not executed is discarded.
+		d.data.data = d.data.data[:d.data.executed]
+		d.data.start = d.data.executed
+		d.data.size = size
+	}
+
+	d.current = request[1]
+	d.packetCount = 0
+	respond(resultSuccess)
+}
+
+func (d *Device) handleExecute(p *peripheral, respond func(byte, ...byte)) {
+	obj := d.object([]byte{d.current})
+	if obj == nil {
+		respond(resultOperationNotPermitted)
+		return
+	}
+
+	if obj.size == 0 {
+		// Nothing received since the last execute.
+		if obj.executed == len(obj.data) && len(obj.data) > 0 {
+			respond(resultSuccess)
+			d.activateIfComplete(p)
+		} else {
+			respond(resultOperationNotPermitted)
+		}
+		return
+	}
+	if len(obj.data) != obj.start+obj.size {
+		respond(resultOperationNotPermitted)
+		return
+	}
+	obj.executed = len(obj.data)
+	obj.size = 0
+
+	if d.current == objectCommand {
+		var init *initpacket.InitCommand
+		if packet, err := initpacket.Decode(obj.data); err == nil {
+			init = packet.GetInitCommand()
+		}
+		if init == nil || init.FirmwareSize() == 0 {
+			respond(resultExtError, extErrorInitCommandInvalid)
+			return
+		}
+		if !bytes.Equal(d.initPacket, obj.data) {
+			d.data = object{}
+		}
+		d.initPacket = append([]byte{}, obj.data...)
+		d.firmwareSize = int(init.FirmwareSize())
+		d.activateToBoot = init.GetType() != initpacket.FwTypeApplication
+		respond(resultSuccess)
+		return
+	}
+
+	respond(resultSuccess)
+	d.activateIfComplete(p)
+}
+
+func (d *Device) activateIfComplete(p *peripheral) {
+	if d.current != objectData || d.data.executed != d.firmwareSize {
+		return
+	}
+
+	d.images = append(d.images, ReceivedImage{
+		InitPacket: d.initPacket,
+		Firmware:   append([]byte{}, d.data.data...),
+	})
+
+	mode := ModeApplication
+	if d.activateToBoot {
+		mode = ModeBootloader
+	}
+
+	d.command = object{}
+	d.data = object{}
+	d.initPacket = nil
+	d.firmwareSize = 0
+	d.advName = ""
+	d.reset(p, mode)
+}
+
+func (d *Device) handlePacket(p *peripheral, data []byte) {
+	obj := d.object([]byte{d.current})
+	if obj == nil || obj.size == 0 {
+		return
+	}
+
+	if d.current == objectData {
+		if fault := d.takeFault(PacketData, len(obj.data)+len(data)); fault != nil {
+			switch fault.Type {
+			case FaultDisconnect:
+				p.close()
+				return
+			case FaultCrcMismatch:
+				d.corruptReceipt = true
+			case FaultDropNotification:
+				d.dropReceipt = true
+			case FaultInsufficientResources:
+				// Only applies to control point requests.
+			}
+		}
+	}
+
+	if len(obj.data)+len(data) > obj.start+obj.size {
+		data = data[:obj.start+obj.size-len(obj.data)]
+	}
+	obj.data = append(obj.data, data...)
+
+	d.packetCount++
+	if d.prn != 0 && d.packetCount%int(d.prn) == 0 {
+		if d.dropReceipt {
+			d.dropReceipt = false
+			return
+		}
+		checksum := crc32.ChecksumIEEE(obj.data)
+		if d.corruptReceipt {
+			d.corruptReceipt = false
+			checksum ^= 0xFFFFFFFF
+		}
+		response := append([]byte{opResponse, opCrcGet, resultSuccess}, le32(uint32(len(obj.data)), checksum)...)
+		p.notify(ControlPointUUID, ble.SubscriptionTypeNotification, response)
+	}
+}
+
+func le32(values ...uint32) []byte {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[4*i:], v)
+	}
+	return buf
+}
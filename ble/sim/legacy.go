@@ -0,0 +1,226 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sim
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+const (
+	LegacyServiceUUID      = "00001530-1212-efde-1523-785feabcd123"
+	LegacyControlPointUUID = "00001531-1212-efde-1523-785feabcd123"
+	LegacyPacketUUID       = "00001532-1212-efde-1523-785feabcd123"
+	LegacyVersionUUID      = "00001534-1212-efde-1523-785feabcd123"
+)
+
+const (
+	legacyApplicationVersion = 0x0001
+	legacyBootloaderVersion  = 0x0008
+)
+
+const (
+	legacyOpStartDfu         = 0x01
+	legacyOpInitDfuParams    = 0x02
+	legacyOpReceiveFirmware  = 0x03
+	legacyOpValidate         = 0x04
+	legacyOpActivateAndReset = 0x05
+	legacyOpReset            = 0x06
+	legacyOpReceiptNotifReq  = 0x08
+	legacyOpResponse         = 0x10
+	legacyOpReceiptNotif     = 0x11
+
+	legacyImageApplication = 0x04
+)
+
+const (
+	legacyResultSuccess          = 0x01
+	legacyResultInvalidState     = 0x02
+	legacyResultNotSupported     = 0x03
+	legacyResultDataSizeExceeded = 0x04
+)
+
+type legacyState int
+
+const (
+	legacyIdle legacyState = iota
+	legacyAwaitSizes
+	legacyAwaitInit
+	legacyInit
+	legacyAwaitFirmware
+	legacyFirmware
+	legacyReceived
+	legacyValidated
+)
+
+type legacyTransfer struct {
+	state      legacyState
+	imageType  byte
+	size       int
+	initPacket []byte
+	firmware   []byte
+}
+
+func (d *Device) handleLegacyControl(p *peripheral, request []byte) error {
+	if len(request) == 0 {
+		return errors.New("empty control point request")
+	}
+	opcode := request[0]
+	t := &d.legacy
+
+	respond := func(result byte) {
+		p.notify(LegacyControlPointUUID, ble.SubscriptionTypeNotification, []byte{legacyOpResponse, opcode, result})
+	}
+
+	if d.mode == ModeApplication {
+		if opcode == legacyOpStartDfu {
+			d.reset(p, ModeBootloader)
+		} else {
+			respond(legacyResultNotSupported)
+		}
+		return nil
+	}
+
+	switch opcode {
+	case legacyOpStartDfu:
+		if len(request) != 2 || request[1] < 0x01 || request[1] > legacyImageApplication {
+			respond(legacyResultNotSupported)
+			return nil
+		}
+		*t = legacyTransfer{state: legacyAwaitSizes, imageType: request[1]}
+
+	case legacyOpInitDfuParams:
+		switch {
+		case len(request) == 2 && request[1] == 0x00 && t.state == legacyAwaitInit:
+			t.state = legacyInit
+		case len(request) == 2 && request[1] == 0x01 && t.state == legacyInit:
+			t.state = legacyAwaitFirmware
+			respond(legacyResultSuccess)
+		default:
+			respond(legacyResultInvalidState)
+		}
+
+	case legacyOpReceiptNotifReq:
+		if len(request) == 3 {
+			d.prn = binary.LittleEndian.Uint16(request[1:])
+		}
+
+	case legacyOpReceiveFirmware:
+		if t.state != legacyAwaitFirmware {
+			respond(legacyResultInvalidState)
+			return nil
+		}
+		t.state = legacyFirmware
+		d.packetCount = 0
+
+	case legacyOpValidate:
+		if t.state != legacyReceived {
+			respond(legacyResultInvalidState)
+			return nil
+		}
+		t.state = legacyValidated
+		respond(legacyResultSuccess)
+
+	case legacyOpActivateAndReset:
+		if t.state != legacyValidated {
+			respond(legacyResultInvalidState)
+			return nil
+		}
+		d.images = append(d.images, ReceivedImage{InitPacket: t.initPacket, Firmware: t.firmware})
+		mode := ModeBootloader
+		if t.imageType == legacyImageApplication {
+			mode = ModeApplication
+		}
+		d.reset(p, mode)
+
+	case legacyOpReset:
+		d.reset(p, ModeApplication)
+
+	default:
+		respond(legacyResultNotSupported)
+	}
+	return nil
+}
+
+func (d *Device) handleLegacyPacket(p *peripheral, data []byte) {
+	t := &d.legacy
+
+	respond := func(opcode byte, result byte) {
+		p.notify(LegacyControlPointUUID, ble.SubscriptionTypeNotification, []byte{legacyOpResponse, opcode, result})
+	}
+
+	switch t.state {
+	case legacyAwaitSizes:
+		if len(data) != 12 {
+			respond(legacyOpStartDfu, legacyResultDataSizeExceeded)
+			t.state = legacyIdle
+			return
+		}
+		sd := binary.LittleEndian.Uint32(data[0:])
+		bl := binary.LittleEndian.Uint32(data[4:])
+		app := binary.LittleEndian.Uint32(data[8:])
+		valid := false
+		switch t.imageType {
+		case 0x01:
+			valid = sd != 0 && bl == 0 && app == 0
+		case 0x02:
+			valid = sd == 0 && bl != 0 && app == 0
+		case 0x03:
+			valid = sd != 0 && bl != 0 && app == 0
+		case legacyImageApplication:
+			valid = sd == 0 && bl == 0 && app != 0
+		}
+		if !valid {
+			respond(legacyOpStartDfu, legacyResultNotSupported)
+			t.state = legacyIdle
+			return
+		}
+		t.size = int(sd + bl + app)
+		t.state = legacyAwaitInit
+		respond(legacyOpStartDfu, legacyResultSuccess)
+
+	case legacyInit:
+		t.initPacket = append(t.initPacket, data...)
+
+	case legacyFirmware:
+		t.firmware = append(t.firmware, data...)
+		if len(t.firmware) > t.size {
+			respond(legacyOpReceiveFirmware, legacyResultDataSizeExceeded)
+			t.state = legacyIdle
+			return
+		}
+
+		// The response to the receive firmware request takes the place of
+		// the receipt notification for the last packet.
+		d.packetCount++
+		if d.prn != 0 && d.packetCount%int(d.prn) == 0 && len(t.firmware) < t.size {
+			p.notify(LegacyControlPointUUID, ble.SubscriptionTypeNotification,
+				append([]byte{legacyOpReceiptNotif}, le32(uint32(len(t.firmware)))...))
+		}
+
+		if len(t.firmware) == t.size {
+			t.state = legacyReceived
+			respond(legacyOpReceiveFirmware, legacyResultSuccess)
+		}
+	}
+}
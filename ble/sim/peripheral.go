@@ -0,0 +1,269 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sim
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+var errNotConnected = errors.New("peripheral is not connected")
+
+type subscription struct {
+	uuid    string
+	subType ble.SubscriptionType
+}
+
+type peripheral struct {
+	device   *Device
+	services []*service
+
+	mutex         sync.Mutex
+	connected     bool
+	mtu           int
+	subscriptions map[subscription]func([]byte)
+	queue         chan func()
+	done          chan struct{}
+}
+
+type service struct {
+	peripheral      *peripheral
+	uuid            string
+	characteristics []*characteristic
+}
+
+type characteristic struct {
+	peripheral *peripheral
+	uuid       string
+}
+
+func newPeripheral(device *Device, services map[string][]string) *peripheral {
+	p := &peripheral{
+		device:        device,
+		connected:     true,
+		mtu:           ble.DefaultMTU,
+		subscriptions: make(map[subscription]func([]byte)),
+		queue:         make(chan func(), 1024),
+		done:          make(chan struct{}),
+	}
+
+	for serviceUuid, characteristicUuids := range services {
+		s := &service{peripheral: p, uuid: serviceUuid}
+		for _, uuid := range characteristicUuids {
+			s.characteristics = append(s.characteristics, &characteristic{peripheral: p, uuid: uuid})
+		}
+		p.services = append(p.services, s)
+	}
+
+	go p.deliver()
+	return p
+}
+
+// Notifications are delivered from a separate goroutine, in order, just like
+// a real BLE stack would do.
+func (p *peripheral) deliver() {
+	for {
+		select {
+		case f := <-p.queue:
+			f()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *peripheral) isConnected() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.connected
+}
+
+func (p *peripheral) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.connected {
+		p.connected = false
+		p.subscriptions = make(map[subscription]func([]byte))
+		close(p.done)
+	}
+}
+
+// closeAfterPending drops the connection once all queued notifications have
+// been delivered.
+func (p *peripheral) closeAfterPending() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.connected {
+		p.queue <- p.close
+	}
+}
+
+func (p *peripheral) notify(uuid string, subType ble.SubscriptionType, data []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	callback, ok := p.subscriptions[subscription{uuid, subType}]
+	if !p.connected || !ok {
+		return
+	}
+
+	value := append([]byte{}, data...)
+	p.queue <- func() { callback(value) }
+}
+
+func (p *peripheral) isSubscribed(uuid string, subType ble.SubscriptionType) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.subscriptions[subscription{uuid, subType}]
+	return ok
+}
+
+func (p *peripheral) Addr() string {
+	return p.device.AdvertisedAddress()
+}
+
+func (p *peripheral) ExchangeMTU(mtu int) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.connected {
+		return p.mtu, errNotConnected
+	}
+	if mtu > p.device.MaxMTU {
+		mtu = p.device.MaxMTU
+	}
+	if mtu > ble.DefaultMTU {
+		p.mtu = mtu
+	}
+	return p.mtu, nil
+}
+
+func (p *peripheral) MTU() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.mtu
+}
+
+func (p *peripheral) Disconnect() error {
+	p.close()
+	return nil
+}
+
+func (p *peripheral) FindService(uuid string) ble.Service {
+	for _, s := range p.services {
+		if strings.ToLower(s.uuid) == strings.ToLower(uuid) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (p *peripheral) FindCharacteristic(uuid string) ble.Characteristic {
+	for _, s := range p.services {
+		if c := s.FindCharacteristic(uuid); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *peripheral) ReadCharacteristic(uuid string) ([]byte, error) {
+	if c := p.FindCharacteristic(uuid); c != nil {
+		return c.ReadCharacteristic()
+	}
+	return nil, errors.Errorf("characteristic %s not found", uuid)
+}
+
+func (p *peripheral) WriteCharacteristic(uuid string, data []byte, resp ble.WriteCharacteristicType) error {
+	if c := p.FindCharacteristic(uuid); c != nil {
+		return c.WriteCharacteristic(data, resp)
+	}
+	return nil
+}
+
+func (p *peripheral) Subscribe(uuid string, subType ble.SubscriptionType, callback func([]byte)) error {
+	if c := p.FindCharacteristic(uuid); c != nil {
+		return c.Subscribe(subType, callback)
+	}
+	return nil
+}
+
+func (p *peripheral) Unsubscribe(uuid string, subType ble.SubscriptionType) error {
+	if c := p.FindCharacteristic(uuid); c != nil {
+		return c.Unsubscribe(subType)
+	}
+	return nil
+}
+
+func (s *service) Uuid() string {
+	return s.uuid
+}
+
+func (s *service) FindCharacteristic(uuid string) ble.Characteristic {
+	for _, c := range s.characteristics {
+		if strings.ToLower(c.uuid) == strings.ToLower(uuid) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *characteristic) Uuid() string {
+	return c.uuid
+}
+
+func (c *characteristic) ReadCharacteristic() ([]byte, error) {
+	if !c.peripheral.isConnected() {
+		return nil, errors.Wrap(errNotConnected, "failed to read BLE characteristic")
+	}
+	return c.peripheral.device.read(c.peripheral, c.uuid)
+}
+
+func (c *characteristic) WriteCharacteristic(data []byte, resp ble.WriteCharacteristicType) error {
+	if !c.peripheral.isConnected() {
+		return errors.Wrap(errNotConnected, "failed to write to BLE characteristic")
+	}
+	return c.peripheral.device.write(c.peripheral, c.uuid, append([]byte{}, data...))
+}
+
+func (c *characteristic) Subscribe(subType ble.SubscriptionType, callback func([]byte)) error {
+	p := c.peripheral
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.connected {
+		return errors.Wrap(errNotConnected, "failed to subscribe to BLE characteristic value changes")
+	}
+	p.subscriptions[subscription{c.uuid, subType}] = callback
+	return nil
+}
+
+func (c *characteristic) Unsubscribe(subType ble.SubscriptionType) error {
+	p := c.peripheral
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.connected {
+		return errors.Wrap(errNotConnected, "failed to unsubscribe from BLE characteristic value changes")
+	}
+	delete(p.subscriptions, subscription{c.uuid, subType})
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Recorder is a ble.Client that writes the traffic of another client to a
+// trace. Failing to write the trace does not affect the traffic itself.
+type Recorder struct {
+	client ble.Client
+
+	mutex       sync.Mutex
+	encoder     *json.Encoder
+	start       time.Time
+	connections int
+	err         error
+}
+
+type recordedPeripheral struct {
+	recorder   *Recorder
+	peripheral ble.Peripheral
+	conn       int
+}
+
+type recordedService struct {
+	recorder *Recorder
+	service  ble.Service
+	conn     int
+	uuid     string
+}
+
+type recordedCharacteristic struct {
+	recorder       *Recorder
+	characteristic ble.Characteristic
+	conn           int
+	uuid           string
+}
+
+func NewRecorder(client ble.Client, w io.Writer) *Recorder {
+	r := &Recorder{
+		client:  client,
+		encoder: json.NewEncoder(w),
+		start:   time.Now(),
+	}
+	r.record(&Event{Type: EventStart, WallTime: r.start.Format(time.RFC3339Nano)})
+	return r
+}
+
+// Err returns the first error that occurred while writing the trace.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(event *Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	event.Time = time.Since(r.start).Seconds()
+	if err := r.encoder.Encode(event); err != nil {
+		jww.WARN.Printf("Failed to write trace: %v\n", err)
+		r.err = errors.Wrap(err, "failed to write trace")
+	}
+}
+
+// failed records the error of a call that does not return a value.
+func (r *Recorder) failed(conn int, err error) error {
+	if err != nil {
+		r.record(&Event{Type: EventResult, Connection: conn, Error: err.Error()})
+	}
+	return err
+}
+
+func (r *Recorder) ConnectName(name string, timeout time.Duration) (ble.Peripheral, error) {
+	r.record(&Event{Type: EventConnectName, Name: name})
+	return r.connected(r.client.ConnectName(name, timeout))
+}
+
+func (r *Recorder) ConnectAddress(address string, timeout time.Duration) (ble.Peripheral, error) {
+	r.record(&Event{Type: EventConnectAddress, Address: address})
+	return r.connected(r.client.ConnectAddress(address, timeout))
+}
+
+func (r *Recorder) connected(peripheral ble.Peripheral, err error) (ble.Peripheral, error) {
+	if err != nil {
+		r.record(&Event{Type: EventResult, Error: err.Error()})
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	r.connections++
+	conn := r.connections
+	r.mutex.Unlock()
+
+	r.record(&Event{Type: EventResult, Connection: conn, Address: peripheral.Addr(), MTU: peripheral.MTU()})
+	return &recordedPeripheral{recorder: r, peripheral: peripheral, conn: conn}, nil
+}
+
+func (r *Recorder) Scan(duration time.Duration, handler ble.AdvertisementHandler) error {
+	r.record(&Event{Type: EventScan, Duration: duration.Seconds()})
+	err := r.client.Scan(duration, func(adv ble.Advertisement) {
+		r.record(&Event{Type: EventAdvertisement, Advertisement: &adv})
+		handler(adv)
+	})
+	// Always recorded, to mark the end of the advertisements.
+	r.record(&Event{Type: EventResult, Error: errorMessage(err)})
+	return err
+}
+
+func (r *Recorder) findCharacteristic(conn int, service string, uuid string, find func() ble.Characteristic) ble.Characteristic {
+	r.record(&Event{Type: EventFindCharacteristic, Connection: conn, Service: service, UUID: uuid})
+	c := find()
+	r.record(&Event{Type: EventResult, Connection: conn, Found: c != nil})
+	if c == nil {
+		return nil
+	}
+	return &recordedCharacteristic{recorder: r, characteristic: c, conn: conn, uuid: uuid}
+}
+
+func (r *Recorder) read(conn int, uuid string, read func() ([]byte, error)) ([]byte, error) {
+	r.record(&Event{Type: EventRead, Connection: conn, UUID: uuid})
+	data, err := read()
+	r.record(&Event{Type: EventResult, Connection: conn, Data: data, Error: errorMessage(err)})
+	return data, err
+}
+
+func (r *Recorder) write(conn int, uuid string, data []byte, writeType ble.WriteCharacteristicType, write func() error) error {
+	r.record(&Event{Type: EventWrite, Connection: conn, UUID: uuid, Data: data, WriteType: writeType})
+	return r.failed(conn, write())
+}
+
+func (r *Recorder) subscribe(conn int, uuid string, subType ble.SubscriptionType, callback func([]byte), subscribe func(func([]byte)) error) error {
+	r.record(&Event{Type: EventSubscribe, Connection: conn, UUID: uuid, SubscriptionType: subType})
+	return r.failed(conn, subscribe(func(data []byte) {
+		r.record(&Event{Type: EventNotification, Connection: conn, UUID: uuid, SubscriptionType: subType, Data: data})
+		callback(data)
+	}))
+}
+
+func (r *Recorder) unsubscribe(conn int, uuid string, subType ble.SubscriptionType, unsubscribe func() error) error {
+	r.record(&Event{Type: EventUnsubscribe, Connection: conn, UUID: uuid, SubscriptionType: subType})
+	return r.failed(conn, unsubscribe())
+}
+
+func (p *recordedPeripheral) Addr() string {
+	return p.peripheral.Addr()
+}
+
+func (p *recordedPeripheral) Disconnect() error {
+	p.recorder.record(&Event{Type: EventDisconnect, Connection: p.conn})
+	return p.recorder.failed(p.conn, p.peripheral.Disconnect())
+}
+
+func (p *recordedPeripheral) ExchangeMTU(mtu int) (int, error) {
+	p.recorder.record(&Event{Type: EventExchangeMTU, Connection: p.conn, MTU: mtu})
+	result, err := p.peripheral.ExchangeMTU(mtu)
+	p.recorder.record(&Event{Type: EventResult, Connection: p.conn, MTU: result, Error: errorMessage(err)})
+	return result, err
+}
+
+func (p *recordedPeripheral) MTU() int {
+	return p.peripheral.MTU()
+}
+
+func (p *recordedPeripheral) FindService(uuid string) ble.Service {
+	p.recorder.record(&Event{Type: EventFindService, Connection: p.conn, UUID: uuid})
+	s := p.peripheral.FindService(uuid)
+	p.recorder.record(&Event{Type: EventResult, Connection: p.conn, Found: s != nil})
+	if s == nil {
+		return nil
+	}
+	return &recordedService{recorder: p.recorder, service: s, conn: p.conn, uuid: uuid}
+}
+
+func (p *recordedPeripheral) FindCharacteristic(uuid string) ble.Characteristic {
+	return p.recorder.findCharacteristic(p.conn, "", uuid, func() ble.Characteristic {
+		return p.peripheral.FindCharacteristic(uuid)
+	})
+}
+
+func (p *recordedPeripheral) ReadCharacteristic(uuid string) ([]byte, error) {
+	return p.recorder.read(p.conn, uuid, func() ([]byte, error) {
+		return p.peripheral.ReadCharacteristic(uuid)
+	})
+}
+
+func (p *recordedPeripheral) WriteCharacteristic(uuid string, data []byte, writeType ble.WriteCharacteristicType) error {
+	return p.recorder.write(p.conn, uuid, data, writeType, func() error {
+		return p.peripheral.WriteCharacteristic(uuid, data, writeType)
+	})
+}
+
+func (p *recordedPeripheral) Subscribe(uuid string, subType ble.SubscriptionType, callback func([]byte)) error {
+	return p.recorder.subscribe(p.conn, uuid, subType, callback, func(callback func([]byte)) error {
+		return p.peripheral.Subscribe(uuid, subType, callback)
+	})
+}
+
+func (p *recordedPeripheral) Unsubscribe(uuid string, subType ble.SubscriptionType) error {
+	return p.recorder.unsubscribe(p.conn, uuid, subType, func() error {
+		return p.peripheral.Unsubscribe(uuid, subType)
+	})
+}
+
+func (s *recordedService) Uuid() string {
+	return s.service.Uuid()
+}
+
+func (s *recordedService) FindCharacteristic(uuid string) ble.Characteristic {
+	return s.recorder.findCharacteristic(s.conn, s.uuid, uuid, func() ble.Characteristic {
+		return s.service.FindCharacteristic(uuid)
+	})
+}
+
+func (c *recordedCharacteristic) Uuid() string {
+	return c.characteristic.Uuid()
+}
+
+func (c *recordedCharacteristic) ReadCharacteristic() ([]byte, error) {
+	return c.recorder.read(c.conn, c.uuid, c.characteristic.ReadCharacteristic)
+}
+
+func (c *recordedCharacteristic) WriteCharacteristic(data []byte, writeType ble.WriteCharacteristicType) error {
+	return c.recorder.write(c.conn, c.uuid, data, writeType, func() error {
+		return c.characteristic.WriteCharacteristic(data, writeType)
+	})
+}
+
+func (c *recordedCharacteristic) Subscribe(subType ble.SubscriptionType, callback func([]byte)) error {
+	return c.recorder.subscribe(c.conn, c.uuid, subType, callback, func(callback func([]byte)) error {
+		return c.characteristic.Subscribe(subType, callback)
+	})
+}
+
+func (c *recordedCharacteristic) Unsubscribe(subType ble.SubscriptionType) error {
+	return c.recorder.unsubscribe(c.conn, c.uuid, subType, func() error {
+		return c.characteristic.Unsubscribe(subType)
+	})
+}
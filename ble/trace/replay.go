@@ -0,0 +1,393 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// ReplayClient is a ble.Client that plays back a recorded trace. Every call
+// must match the next call in the trace, and gets the recorded result. The
+// notifications that followed a call are delivered after the call, in order.
+// Replay does not wait for the recorded timing.
+type ReplayClient struct {
+	events []*Event
+
+	mutex         sync.Mutex
+	next          int
+	err           error
+	callbacks     map[subscription]func([]byte)
+	notifications chan *Event
+	closed        bool
+}
+
+type subscription struct {
+	conn    int
+	uuid    string
+	subType ble.SubscriptionType
+}
+
+type replayPeripheral struct {
+	client  *ReplayClient
+	conn    int
+	address string
+	mtu     int
+}
+
+type replayService struct {
+	client *ReplayClient
+	conn   int
+	uuid   string
+}
+
+type replayCharacteristic struct {
+	client *ReplayClient
+	conn   int
+	uuid   string
+}
+
+func NewReplayClient(r io.Reader) (*ReplayClient, error) {
+	var events []*Event
+	decoder := json.NewDecoder(r)
+	for {
+		event := new(Event)
+		err := decoder.Decode(event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "trace line %d", len(events)+1)
+		}
+		events = append(events, event)
+	}
+
+	client := &ReplayClient{
+		events:        events,
+		callbacks:     make(map[subscription]func([]byte)),
+		notifications: make(chan *Event, len(events)),
+	}
+	go client.deliver()
+	return client, nil
+}
+
+func OpenReplay(filename string) (*ReplayClient, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open trace")
+	}
+	defer f.Close()
+	return NewReplayClient(f)
+}
+
+// Err returns the first call that did not match the trace.
+func (r *ReplayClient) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// Complete reports whether all calls in the trace have been replayed.
+func (r *ReplayClient) Complete() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, event := range r.events[r.next:] {
+		if event.isCall() {
+			return false
+		}
+	}
+	return true
+}
+
+// Names returns the names the recorded client connected to, in order.
+func (r *ReplayClient) Names() []string {
+	var names []string
+	for _, event := range r.events {
+		if event.Type == EventConnectName {
+			names = append(names, event.Name)
+		}
+	}
+	return names
+}
+
+// Close stops the delivery of notifications.
+func (r *ReplayClient) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.notifications)
+	}
+}
+
+// call matches a call against the next call in the trace, and returns its
+// result and the advertisements that followed it. Notifications are queued
+// for delivery.
+func (r *ReplayClient) call(call *Event) (*Event, []*ble.Advertisement, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	for r.next < len(r.events) && r.events[r.next].Type == EventStart {
+		r.next++
+	}
+	if r.next == len(r.events) {
+		r.err = errors.Errorf("trace ended, got %s", call)
+		jww.ERROR.Printf("Replay failed: %v\n", r.err)
+		return nil, nil, r.err
+	}
+
+	expected := r.events[r.next]
+	if !expected.matches(call) {
+		r.err = errors.Errorf("trace line %d: expected %s, got %s", r.next+1, expected, call)
+		jww.ERROR.Printf("Replay failed: %v\n", r.err)
+		return nil, nil, r.err
+	}
+	r.next++
+
+	var result *Event
+	var advertisements []*ble.Advertisement
+	for ; r.next < len(r.events) && !r.events[r.next].isCall(); r.next++ {
+		event := r.events[r.next]
+		switch event.Type {
+		case EventResult:
+			if result == nil {
+				result = event
+			}
+		case EventNotification:
+			if !r.closed {
+				r.notifications <- event
+			}
+		case EventAdvertisement:
+			if event.Advertisement != nil {
+				advertisements = append(advertisements, event.Advertisement)
+			}
+		}
+	}
+
+	if result == nil {
+		result = &Event{Type: EventResult}
+	}
+	return result, advertisements, nil
+}
+
+func (r *ReplayClient) deliver() {
+	for event := range r.notifications {
+		r.mutex.Lock()
+		callback := r.callbacks[subscription{event.Connection, strings.ToLower(event.UUID), event.SubscriptionType}]
+		r.mutex.Unlock()
+
+		if callback != nil {
+			callback(event.Data)
+		} else {
+			jww.DEBUG.Printf("Dropping notification without subscription: %s\n", event)
+		}
+	}
+}
+
+func (r *ReplayClient) setCallback(conn int, uuid string, subType ble.SubscriptionType, callback func([]byte)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := subscription{conn, strings.ToLower(uuid), subType}
+	if callback == nil {
+		delete(r.callbacks, key)
+	} else {
+		r.callbacks[key] = callback
+	}
+}
+
+func (r *ReplayClient) ConnectName(name string, timeout time.Duration) (ble.Peripheral, error) {
+	return r.connect(&Event{Type: EventConnectName, Name: name})
+}
+
+func (r *ReplayClient) ConnectAddress(address string, timeout time.Duration) (ble.Peripheral, error) {
+	return r.connect(&Event{Type: EventConnectAddress, Address: address})
+}
+
+func (r *ReplayClient) connect(call *Event) (ble.Peripheral, error) {
+	result, _, err := r.call(call)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, replayError(result.Error)
+	}
+	return &replayPeripheral{client: r, conn: result.Connection, address: result.Address, mtu: result.MTU}, nil
+}
+
+func (r *ReplayClient) Scan(duration time.Duration, handler ble.AdvertisementHandler) error {
+	result, advertisements, err := r.call(&Event{Type: EventScan})
+	if err != nil {
+		return err
+	}
+	for _, adv := range advertisements {
+		handler(*adv)
+	}
+	return replayError(result.Error)
+}
+
+func (r *ReplayClient) findCharacteristic(conn int, service string, uuid string) ble.Characteristic {
+	result, _, err := r.call(&Event{Type: EventFindCharacteristic, Connection: conn, Service: service, UUID: uuid})
+	if err != nil || !result.Found {
+		return nil
+	}
+	return &replayCharacteristic{client: r, conn: conn, uuid: uuid}
+}
+
+func (r *ReplayClient) read(conn int, uuid string) ([]byte, error) {
+	result, _, err := r.call(&Event{Type: EventRead, Connection: conn, UUID: uuid})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, replayError(result.Error)
+}
+
+func (r *ReplayClient) write(conn int, uuid string, data []byte, writeType ble.WriteCharacteristicType) error {
+	result, _, err := r.call(&Event{Type: EventWrite, Connection: conn, UUID: uuid, Data: data, WriteType: writeType})
+	if err != nil {
+		return err
+	}
+	return replayError(result.Error)
+}
+
+func (r *ReplayClient) subscribe(conn int, uuid string, subType ble.SubscriptionType, callback func([]byte)) error {
+	// Registered before the call, so the notifications that follow it
+	// are not dropped.
+	r.setCallback(conn, uuid, subType, callback)
+	result, _, err := r.call(&Event{Type: EventSubscribe, Connection: conn, UUID: uuid, SubscriptionType: subType})
+	if err == nil {
+		err = replayError(result.Error)
+	}
+	if err != nil {
+		r.setCallback(conn, uuid, subType, nil)
+	}
+	return err
+}
+
+func (r *ReplayClient) unsubscribe(conn int, uuid string, subType ble.SubscriptionType) error {
+	result, _, err := r.call(&Event{Type: EventUnsubscribe, Connection: conn, UUID: uuid, SubscriptionType: subType})
+	if err != nil {
+		return err
+	}
+	if err = replayError(result.Error); err == nil {
+		r.setCallback(conn, uuid, subType, nil)
+	}
+	return err
+}
+
+func (p *replayPeripheral) Addr() string {
+	return p.address
+}
+
+func (p *replayPeripheral) Disconnect() error {
+	result, _, err := p.client.call(&Event{Type: EventDisconnect, Connection: p.conn})
+	if err != nil {
+		return err
+	}
+	return replayError(result.Error)
+}
+
+func (p *replayPeripheral) ExchangeMTU(mtu int) (int, error) {
+	result, _, err := p.client.call(&Event{Type: EventExchangeMTU, Connection: p.conn, MTU: mtu})
+	if err != nil {
+		return 0, err
+	}
+	if result.Error == "" {
+		p.client.mutex.Lock()
+		p.mtu = result.MTU
+		p.client.mutex.Unlock()
+	}
+	return result.MTU, replayError(result.Error)
+}
+
+func (p *replayPeripheral) MTU() int {
+	p.client.mutex.Lock()
+	defer p.client.mutex.Unlock()
+	return p.mtu
+}
+
+func (p *replayPeripheral) FindService(uuid string) ble.Service {
+	result, _, err := p.client.call(&Event{Type: EventFindService, Connection: p.conn, UUID: uuid})
+	if err != nil || !result.Found {
+		return nil
+	}
+	return &replayService{client: p.client, conn: p.conn, uuid: uuid}
+}
+
+func (p *replayPeripheral) FindCharacteristic(uuid string) ble.Characteristic {
+	return p.client.findCharacteristic(p.conn, "", uuid)
+}
+
+func (p *replayPeripheral) ReadCharacteristic(uuid string) ([]byte, error) {
+	return p.client.read(p.conn, uuid)
+}
+
+func (p *replayPeripheral) WriteCharacteristic(uuid string, data []byte, writeType ble.WriteCharacteristicType) error {
+	return p.client.write(p.conn, uuid, data, writeType)
+}
+
+func (p *replayPeripheral) Subscribe(uuid string, subType ble.SubscriptionType, callback func([]byte)) error {
+	return p.client.subscribe(p.conn, uuid, subType, callback)
+}
+
+func (p *replayPeripheral) Unsubscribe(uuid string, subType ble.SubscriptionType) error {
+	return p.client.unsubscribe(p.conn, uuid, subType)
+}
+
+func (s *replayService) Uuid() string {
+	return s.uuid
+}
+
+func (s *replayService) FindCharacteristic(uuid string) ble.Characteristic {
+	return s.client.findCharacteristic(s.conn, s.uuid, uuid)
+}
+
+func (c *replayCharacteristic) Uuid() string {
+	return c.uuid
+}
+
+func (c *replayCharacteristic) ReadCharacteristic() ([]byte, error) {
+	return c.client.read(c.conn, c.uuid)
+}
+
+func (c *replayCharacteristic) WriteCharacteristic(data []byte, writeType ble.WriteCharacteristicType) error {
+	return c.client.write(c.conn, c.uuid, data, writeType)
+}
+
+func (c *replayCharacteristic) Subscribe(subType ble.SubscriptionType, callback func([]byte)) error {
+	return c.client.subscribe(c.conn, c.uuid, subType, callback)
+}
+
+func (c *replayCharacteristic) Unsubscribe(subType ble.SubscriptionType) error {
+	return c.client.unsubscribe(c.conn, c.uuid, subType)
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+func TestReplaySubscriptionTypes(t *testing.T) {
+	events := []string{
+		`{"type":"connect_address","address":"aa:bb"}`,
+		`{"type":"result","conn":1,"address":"aa:bb","mtu":23}`,
+		`{"type":"subscribe","conn":1,"uuid":"2a05","subscription_type":2}`,
+		`{"type":"result","conn":1}`,
+		`{"type":"subscribe","conn":1,"uuid":"2a05","subscription_type":1}`,
+		`{"type":"result","conn":1}`,
+		`{"type":"write","conn":1,"uuid":"2a05","data":"01","write_type":2}`,
+		`{"type":"result","conn":1}`,
+		`{"type":"notification","conn":1,"uuid":"2a05","subscription_type":2,"data":"0a"}`,
+		`{"type":"notification","conn":1,"uuid":"2a05","subscription_type":1,"data":"0b"}`,
+		`{"type":"unsubscribe","conn":1,"uuid":"2a05","subscription_type":1}`,
+		`{"type":"result","conn":1}`,
+		`{"type":"write","conn":1,"uuid":"2a05","data":"02","write_type":2}`,
+		`{"type":"result","conn":1}`,
+		`{"type":"notification","conn":1,"uuid":"2a05","subscription_type":1,"data":"0c"}`,
+		`{"type":"notification","conn":1,"uuid":"2a05","subscription_type":2,"data":"0d"}`,
+	}
+	client, err := NewReplayClient(strings.NewReader(strings.Join(events, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	p, err := client.ConnectAddress("AA:BB", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 4)
+	subscribe := func(subType ble.SubscriptionType, prefix string) {
+		err := p.Subscribe("2a05", subType, func(data []byte) {
+			received <- fmt.Sprintf("%s%x", prefix, data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribe(ble.SubscriptionTypeIndication, "i")
+	subscribe(ble.SubscriptionTypeNotification, "n")
+
+	var got []string
+	receive := func(count int) {
+		for ; count > 0; count-- {
+			select {
+			case value := <-received:
+				got = append(got, value)
+			case <-time.After(time.Second):
+				t.Fatalf("received %v", got)
+			}
+		}
+	}
+
+	if err = p.WriteCharacteristic("2a05", []byte{1}, ble.WithResponse); err != nil {
+		t.Fatal(err)
+	}
+	receive(2)
+	if err = p.Unsubscribe("2a05", ble.SubscriptionTypeNotification); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.WriteCharacteristic("2a05", []byte{2}, ble.WithResponse); err != nil {
+		t.Fatal(err)
+	}
+	receive(1)
+
+	if strings.Join(got, ",") != "i0a,n0b,i0d" {
+		t.Errorf("received %v, expected each value on the subscription of its type", got)
+	}
+	if !client.Complete() || client.Err() != nil {
+		t.Errorf("replay incomplete: %v", client.Err())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"type":"connect_address","address":"aa:bb"}` + "\n")
+	buf.WriteString(`{"type":"result","conn":1,"address":"aa:bb"}` + "\n")
+
+	client, err := NewReplayClient(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.ConnectName("Sensor", time.Second); err == nil {
+		t.Fatal("expected a mismatch")
+	}
+	if client.Err() == nil || !strings.Contains(client.Err().Error(), "trace line 1") {
+		t.Errorf("unexpected replay error %v", client.Err())
+	}
+	if _, err = client.ConnectAddress("aa:bb", time.Second); err == nil {
+		t.Error("replay continued after a mismatch")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package trace records the BLE traffic of a ble.Client to a JSON lines file,
+// and replays such a trace as a ble.Client. A trace of a failed update can be
+// replayed against the dfu package to reproduce the failure.
+//
+// Each call is recorded before it is made. Calls that return a value, and
+// calls that fail, are followed by a result event. Notifications and
+// advertisements are recorded when they are received.
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+type EventType string
+
+const (
+	EventStart              EventType = "start"
+	EventConnectAddress     EventType = "connect_address"
+	EventConnectName        EventType = "connect_name"
+	EventScan               EventType = "scan"
+	EventDisconnect         EventType = "disconnect"
+	EventExchangeMTU        EventType = "exchange_mtu"
+	EventFindService        EventType = "find_service"
+	EventFindCharacteristic EventType = "find_characteristic"
+	EventRead               EventType = "read"
+	EventWrite              EventType = "write"
+	EventSubscribe          EventType = "subscribe"
+	EventUnsubscribe        EventType = "unsubscribe"
+	EventResult             EventType = "result"
+	EventNotification       EventType = "notification"
+	EventAdvertisement      EventType = "advertisement"
+)
+
+// Event is a single line of a trace.
+type Event struct {
+	// Seconds since the start of the recording.
+	Time float64   `json:"t"`
+	Type EventType `json:"type"`
+	// Connection numbers the peripherals in the order they were connected.
+	Connection int `json:"conn,omitempty"`
+
+	Address          string                      `json:"address,omitempty"`
+	Name             string                      `json:"name,omitempty"`
+	Service          string                      `json:"service,omitempty"`
+	UUID             string                      `json:"uuid,omitempty"`
+	Data             Bytes                       `json:"data,omitempty"`
+	WriteType        ble.WriteCharacteristicType `json:"write_type,omitempty"`
+	SubscriptionType ble.SubscriptionType        `json:"subscription_type,omitempty"`
+	MTU              int                         `json:"mtu,omitempty"`
+	Duration         float64                     `json:"duration,omitempty"`
+	Found            bool                        `json:"found,omitempty"`
+	Advertisement    *ble.Advertisement          `json:"advertisement,omitempty"`
+	Error            string                      `json:"error,omitempty"`
+	WallTime         string                      `json:"wall_time,omitempty"`
+}
+
+// Bytes is a byte slice that is stored as a hex string.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return errors.Wrap(err, "invalid hex data")
+	}
+	*b = decoded
+	return nil
+}
+
+// isCall reports whether the event was caused by the client, as opposed to
+// received from the peripheral or describing the outcome of a call.
+func (e *Event) isCall() bool {
+	switch e.Type {
+	case EventStart, EventResult, EventNotification, EventAdvertisement:
+		return false
+	}
+	return true
+}
+
+func (e *Event) matches(call *Event) bool {
+	return e.Type == call.Type &&
+		e.Connection == call.Connection &&
+		strings.EqualFold(e.Address, call.Address) &&
+		e.Name == call.Name &&
+		strings.EqualFold(e.Service, call.Service) &&
+		strings.EqualFold(e.UUID, call.UUID) &&
+		string(e.Data) == string(call.Data) &&
+		e.WriteType == call.WriteType &&
+		e.SubscriptionType == call.SubscriptionType &&
+		e.MTU == call.MTU
+}
+
+func (e *Event) String() string {
+	s := string(e.Type)
+	if e.Connection != 0 {
+		s += " conn=" + strconv.Itoa(e.Connection)
+	}
+	if e.Address != "" {
+		s += " address=" + e.Address
+	}
+	if e.Name != "" {
+		s += " name=" + e.Name
+	}
+	if e.UUID != "" {
+		s += " uuid=" + e.UUID
+	}
+	if len(e.Data) > 0 {
+		s += " data=" + hex.EncodeToString(e.Data)
+	}
+	return s
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// replayError recreates a recorded error. Context errors keep their
+// identity, because callers check for them with errors.Cause.
+func replayError(message string) error {
+	if message == "" {
+		return nil
+	}
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled} {
+		if message == err.Error() {
+			return err
+		}
+		if suffix := ": " + err.Error(); strings.HasSuffix(message, suffix) {
+			return errors.Wrap(err, strings.TrimSuffix(message, suffix))
+		}
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/spf13/cobra"
+)
+
+type adaptersCommand struct {
+	*baseCommand
+
+	json bool
+}
+
+type adapterReport struct {
+	ID      string `json:"id"`
+	Address string `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+func newAdaptersCommand() *adaptersCommand {
+	c := &adaptersCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "adapters",
+		Short: "List Bluetooth adapters",
+		Long: `This command lists the Bluetooth adapters that can be selected with --adapter.
+The batch and rollout commands accept several adapters, and spread the devices
+they update over them.`,
+		Example: `nrf-dfu adapters
+nrf-dfu adapters --backend bluez --json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runAdapters()
+		},
+	})
+
+	c.cmd.Flags().BoolVar(&c.json, "json", false, "Output in JSON format")
+
+	return c
+}
+
+func (c *adaptersCommand) runAdapters() error {
+	adapters, err := c.listAdapters()
+	if err != nil {
+		return errors.Wrap(err, "failed to list Bluetooth adapters")
+	}
+
+	if c.json {
+		reports := []*adapterReport{}
+		for _, adapter := range adapters {
+			reports = append(reports, &adapterReport{ID: adapter.ID, Address: adapter.Address, Name: adapter.Name})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	}
+
+	if len(adapters) == 0 {
+		return errors.New("No Bluetooth adapters found.")
+	}
+	printAdapters(adapters)
+	return nil
+}
+
+func printAdapters(adapters []ble.Adapter) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "ADAPTER\tADDRESS\tNAME\n")
+	for _, adapter := range adapters {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", adapter.ID, adapter.Address, adapter.Name)
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gopkg.in/cheggaaa/pb.v2"
+)
+
+type batchCommand struct {
+	*baseCommand
+
+	timeout          time.Duration
+	responseTimeout  time.Duration
+	addresses        []string
+	addressFile      string
+	concurrency      int
+	retries          int
+	prn              uint16
+	mtu              int
+	firmwareFilename string
+	publicKey        string
+	retry            retryOptions
+	verify           verifyOptions
+}
+
+// batchUpdate updates the firmware of a single device.
+type batchUpdate func(ctx context.Context, address string, progress dfu.DfuProgress) error
+
+type batchResult struct {
+	Address  string
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+func newBatchCommand() *batchCommand {
+	c := &batchCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "batch",
+		Short: "Perform device firmware upgrade of multiple devices",
+		Long: `This command upgrades the firmware of several nRF51 or nRF52 devices with the
+same firmware archive, updating up to --concurrency devices at the same time.
+Addresses are given with --address, or read from a file with one address per
+line using --address-file. Use --address-file - to read them from stdin.
+Failed steps of an update are retried as configured with --attempts, and a
+summary is shown when all devices are done.
+When several adapters are given with --adapter, the concurrent updates are
+spread evenly over them.`,
+		Example: `nrf-dfu batch --firmware FW.zip --address 4b668b2e16e4 --address 5c779c3f27f5
+nrf-dfu batch --firmware FW.zip --address-file devices.txt --concurrency 4 --attempts 3
+nrf-dfu batch --firmware FW.zip --address-file devices.txt --adapter hci0,hci1`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runBatch()
+		},
+	})
+
+	c.cmd.Flags().DurationVarP(&c.timeout, "timeout", "t", 30*time.Second, "Timeout for connecting to a device")
+	c.cmd.Flags().DurationVar(&c.responseTimeout, "response-timeout", dfu.DefaultResponseTimeout, "Timeout for receiving a response from a device")
+	c.cmd.Flags().StringVarP(&c.firmwareFilename, "firmware", "f", "", "Filename of the firmware archive")
+	c.cmd.Flags().StringVar(&c.publicKey, "public-key", "", "PEM file with the key used to verify the signature of the firmware archive")
+	c.cmd.Flags().StringSliceVarP(&c.addresses, "address", "a", nil, "Address of a device to be upgraded (can be repeated)")
+	c.cmd.Flags().StringVar(&c.addressFile, "address-file", "", "File with the addresses of the devices to be upgraded, or - for stdin")
+	c.cmd.Flags().IntVarP(&c.concurrency, "concurrency", "c", 4, "Maximum number of devices upgraded at the same time")
+	c.cmd.Flags().IntVar(&c.mtu, "mtu", dfu.DefaultMTU, "Maximum BLE ATT MTU to negotiate with the devices")
+	c.cmd.Flags().Uint16Var(&c.prn, "prn", dfu.DefaultPacketReceiptNotification, "Number of packets between receipt notifications (0 disables flow control)")
+	c.retry.addFlags(c.cmd)
+	c.verify.addFlags(c.cmd)
+
+	c.cmd.Flags().IntVarP(&c.retries, "retries", "r", 0, "Number of times a failed step is retried")
+	c.cmd.Flags().MarkDeprecated("retries", "use --attempts instead")
+	c.retry.addRetryDelayFlag(c.cmd)
+	return c
+}
+
+func (c *batchCommand) runBatch() error {
+	if c.firmwareFilename == "" {
+		return errors.New("No firmware specified. Use --firmware to specify a firmware archive.")
+	}
+	if c.concurrency < 1 {
+		return errors.New("--concurrency must be at least 1.")
+	}
+	retryPolicy, err := c.retryPolicy()
+	if err != nil {
+		return err
+	}
+	verification, err := c.verify.verification()
+	if err != nil {
+		return err
+	}
+
+	addresses, err := c.readAddresses()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := dfu.OpenPackage(c.firmwareFilename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read firmware archive")
+	}
+
+	// Verify the package once, instead of failing every device.
+	var key *ecdsa.PublicKey
+	if c.publicKey != "" {
+		if pkg.IsLegacy() {
+			return errors.New("--public-key cannot be used with a legacy firmware archive.")
+		}
+		key, err = signing.LoadPublicKey(c.publicKey)
+		if err != nil {
+			return err
+		}
+	}
+	if !pkg.IsLegacy() {
+		err = pkg.Verify(key)
+		if err != nil {
+			return errors.Wrap(err, "firmware verification failed")
+		}
+	}
+
+	bleClients, err := c.newBleClients()
+	if err != nil {
+		return errors.Wrap(err, "failed to create new BLE client")
+	}
+	pool := newClientPool(bleClients, c.concurrency)
+
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	jww.INFO.Printf("Upgrading firmware of %d devices with '%s'\n", len(addresses), c.firmwareFilename)
+
+	update := func(ctx context.Context, address string, progress dfu.DfuProgress) error {
+		bleClient := pool.get()
+		defer pool.put(bleClient)
+
+		updater := dfu.NewDfu(bleClient, c.timeout)
+		updater.SetDeviceAddress(address)
+		updater.SetPacketReceiptNotification(c.prn)
+		updater.SetMTU(c.mtu)
+		updater.SetResponseTimeout(c.responseTimeout)
+		updater.SetRetryPolicy(retryPolicy)
+		updater.SetVerification(verification)
+		return updater.UpdatePackage(ctx, pkg, progress)
+	}
+
+	runner := &batchRunner{concurrency: c.concurrency, update: update}
+	results := runner.run(ctx, addresses)
+	printBatchSummary(os.Stdout, results)
+	return batchError(results)
+}
+
+// retryPolicy maps the deprecated --retries onto the retry policy.
+func (c *batchCommand) retryPolicy() (dfu.RetryPolicy, error) {
+	if c.retries < 0 {
+		return dfu.RetryPolicy{}, errors.New("--retries cannot be negative.")
+	}
+	if c.cmd.Flags().Changed("retries") {
+		c.retry.setRetries(c.retries)
+	}
+	return c.retry.retryPolicy()
+}
+
+func (c *batchCommand) readAddresses() ([]string, error) {
+	addresses := append([]string{}, c.addresses...)
+
+	if c.addressFile != "" {
+		var r io.Reader = os.Stdin
+		if c.addressFile != "-" {
+			f, err := os.Open(c.addressFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot read address file")
+			}
+			defer f.Close()
+			r = f
+		}
+
+		fileAddresses, err := parseAddresses(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read address file")
+		}
+		addresses = append(addresses, fileAddresses...)
+	}
+
+	if len(addresses) == 0 {
+		return nil, errors.New("No addresses specified. Use --address or --address-file to specify the devices to upgrade.")
+	}
+
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		key := strings.ToLower(address)
+		if seen[key] {
+			return nil, errors.Errorf("Address '%s' specified more than once.", address)
+		}
+		seen[key] = true
+	}
+	return addresses, nil
+}
+
+// parseAddresses reads one address per line. Empty lines and lines starting
+// with # are skipped.
+func parseAddresses(r io.Reader) ([]string, error) {
+	var addresses []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// clientPool hands out the BLE clients of the adapters in use, so that
+// concurrent updates are spread evenly over the adapters.
+type clientPool chan ble.Client
+
+func newClientPool(clients []ble.Client, size int) clientPool {
+	pool := make(clientPool, size)
+	for i := 0; i < size; i++ {
+		pool <- clients[i%len(clients)]
+	}
+	return pool
+}
+
+func (p clientPool) get() ble.Client {
+	return <-p
+}
+
+func (p clientPool) put(client ble.Client) {
+	p <- client
+}
+
+// batchRunner updates devices with at most concurrency updates in progress
+// at a time, and shows a progress bar of the devices that are done.
+type batchRunner struct {
+	concurrency int
+	update      batchUpdate
+	// finished, if set, is called as soon as a device is done.
+	finished func(result *batchResult)
+}
+
+// run returns the results in the order of addresses.
+func (r *batchRunner) run(ctx context.Context, addresses []string) []*batchResult {
+	results := make([]*batchResult, len(addresses))
+
+	bar := pb.ProgressBarTemplate(`{{ white "Devices:" }} {{counters . }} {{bar . | green}} {{ string . "status" }}`).Start(len(addresses))
+	var mutex sync.Mutex
+	failed := 0
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, r.concurrency)
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			results[i] = r.runDevice(ctx, address)
+
+			mutex.Lock()
+			if results[i].Err != nil {
+				failed++
+			}
+			bar.Set("status", fmt.Sprintf("%d failed", failed))
+			bar.Increment()
+			mutex.Unlock()
+
+			if r.finished != nil {
+				r.finished(results[i])
+			}
+		}(i, address)
+	}
+	wg.Wait()
+
+	bar.Finish()
+	return results
+}
+
+func (r *batchRunner) runDevice(ctx context.Context, address string) *batchResult {
+	result := &batchResult{Address: address}
+	start := time.Now()
+
+	// Retries happen within the update, as configured by its retry policy.
+	if result.Err = ctx.Err(); result.Err == nil {
+		result.Attempts++
+		result.Err = r.update(ctx, address, nil)
+		if result.Err != nil {
+			jww.DEBUG.Printf("Upgrade of '%s' failed: %v\n", address, result.Err)
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return result
+}
+
+func printBatchSummary(out io.Writer, results []*batchResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "\nADDRESS\tRESULT\tDURATION\tERROR\n")
+	for _, result := range results {
+		status := "ok"
+		message := ""
+		if result.Err != nil {
+			status = "failed"
+			message = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Address, status, result.Duration.Round(time.Second), message)
+	}
+}
+
+func batchError(results []*batchResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d devices failed to upgrade", failed, len(results))
+	}
+	return nil
+}
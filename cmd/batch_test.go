@@ -0,0 +1,87 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+)
+
+func TestBatchRunnerSingleUpdate(t *testing.T) {
+	var mutex sync.Mutex
+	calls := map[string]int{}
+	update := func(ctx context.Context, address string, progress dfu.DfuProgress) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls[address]++
+		if address == "bb" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	runner := &batchRunner{concurrency: 2, update: update}
+	results := runner.run(context.Background(), []string{"aa", "bb", "cc"})
+
+	for _, result := range results {
+		if calls[result.Address] != 1 || result.Attempts != 1 {
+			t.Errorf("%s updated %d times, %d attempts", result.Address, calls[result.Address], result.Attempts)
+		}
+		if (result.Err != nil) != (result.Address == "bb") {
+			t.Errorf("%s: unexpected result %v", result.Address, result.Err)
+		}
+	}
+	if err := batchError(results); err == nil {
+		t.Error("expected an error for the failed device")
+	}
+}
+
+func TestBatchDeprecatedRetryFlags(t *testing.T) {
+	tests := []struct {
+		args     []string
+		attempts int
+		backoff  time.Duration
+	}{
+		{nil, dfu.DefaultRetryPolicy.Attempts, dfu.DefaultRetryPolicy.Backoff},
+		{[]string{"--retries", "0"}, 1, dfu.DefaultRetryPolicy.Backoff},
+		{[]string{"--retries", "2", "--retry-delay", "3s"}, 3, 3 * time.Second},
+		{[]string{"--retries", "2", "--attempts", "4"}, 4, dfu.DefaultRetryPolicy.Backoff},
+	}
+
+	for _, test := range tests {
+		c := newBatchCommand()
+		if err := c.cmd.ParseFlags(test.args); err != nil {
+			t.Fatal(err)
+		}
+		policy, err := c.retryPolicy()
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+		if policy.Attempts != test.attempts || policy.Backoff != test.backoff {
+			t.Errorf("%v: got %d attempts after %v, want %d after %v", test.args, policy.Attempts, policy.Backoff, test.attempts, test.backoff)
+		}
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rcaelers/nrf-dfu/ble"
 	"github.com/rcaelers/nrf-dfu/dfu"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
@@ -33,8 +32,12 @@ import (
 type bootCommand struct {
 	*baseCommand
 
-	timeout time.Duration
-	address string
+	timeout         time.Duration
+	responseTimeout time.Duration
+	address         string
+	selector        deviceSelector
+	recorder        traceRecorder
+	retry           retryOptions
 }
 
 func newBootCommand() *bootCommand {
@@ -47,7 +50,9 @@ func newBootCommand() *bootCommand {
 device into DFU mode. The device supports the Buttonless DFU service.
 Note that the dfu command automatically reboots into DFU mode if needed.`,
 		Example: `nrf-dfu boot --address 4b668b2e16e41429fca7af1b0dc50644
-nrf-dfu boot --address 4b668b2e16e41429fca7af1b0dc50644 --timeout=20s`,
+nrf-dfu boot --address 4b668b2e16e41429fca7af1b0dc50644 --timeout=20s
+nrf-dfu boot --name-match 'Sensor-*' --select first
+nrf-dfu boot --address 4b668b2e16e41429fca7af1b0dc50644 --record trace.jsonl`,
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return c.runBoot()
@@ -55,27 +60,59 @@ nrf-dfu boot --address 4b668b2e16e41429fca7af1b0dc50644 --timeout=20s`,
 	})
 
 	c.cmd.Flags().DurationVarP(&c.timeout, "timeout", "t", 30*time.Second, "Timeout for connecting to device")
+	c.cmd.Flags().DurationVar(&c.responseTimeout, "response-timeout", dfu.DefaultResponseTimeout, "Timeout for receiving a response from the device")
 	c.cmd.Flags().StringVarP(&c.address, "address", "a", "", "Address of device to be rebooted")
+	c.selector.addFlags(c.cmd)
+	c.recorder.addFlags(c.cmd)
+	c.retry.addFlags(c.cmd)
 
 	return c
 }
 
 func (c *bootCommand) runBoot() error {
-	if c.address == "" {
-		return errors.New("No address specified. Use --address to specifiy device address")
+	if c.address == "" && !c.selector.enabled() {
+		return errors.New("No device specified. Use --address to specifiy device address or --name or --name-match to specify device name")
+	}
+	if c.address != "" && c.selector.enabled() {
+		return errors.New("Both address and name specified. Use either --address or --name/--name-match.")
+	}
+	if err := c.selector.validate(); err != nil {
+		return err
+	}
+	retryPolicy, err := c.retry.retryPolicy()
+	if err != nil {
+		return err
 	}
 
-	jww.INFO.Printf("Rebooting device '%s' into DFU mode\n", c.address)
-
-	bleClient, err := ble.NewClient()
+	bleClient, err := c.newBleClient()
 	if err != nil {
 		return errors.Wrap(err, "failed to create new BLE client")
 	}
+	defer c.recorder.close()
+	bleClient, err = c.recorder.wrap(bleClient)
+	if err != nil {
+		return err
+	}
+
+	if c.selector.enabled() {
+		c.address, err = c.selector.resolve(bleClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	jww.INFO.Printf("Rebooting device '%s' into DFU mode\n", c.address)
 
 	dfu := dfu.NewDfu(bleClient, c.timeout)
 
 	dfu.SetDeviceAddress(c.address)
-	err = dfu.EnterBootloader()
+	dfu.SetResponseTimeout(c.responseTimeout)
+	dfu.SetRetryPolicy(retryPolicy)
+
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	err = dfu.EnterBootloader(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to boot device into DFU mode")
 	}
@@ -21,11 +21,12 @@
 package cmd
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rcaelers/nrf-dfu/ble"
 	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 	"gopkg.in/cheggaaa/pb.v2"
@@ -35,8 +36,22 @@ type dfuCommand struct {
 	*baseCommand
 
 	timeout          time.Duration
+	responseTimeout  time.Duration
 	address          string
+	port             string
+	baudRate         int
+	prn              uint16
+	mtu              int
 	firmwareFilename string
+	binFilename      string
+	hexFilename      string
+	datFilename      string
+	startAddress     string
+	publicKey        string
+	selector         deviceSelector
+	recorder         traceRecorder
+	retry            retryOptions
+	verify           verifyOptions
 }
 
 func newDfuCommand() *dfuCommand {
@@ -48,41 +63,103 @@ func newDfuCommand() *dfuCommand {
 		Args:  cobra.NoArgs,
 		Long: `This command can be used to perform a firmware upgrade of an nRF51 or nRF52
 device. If the device supports the Buttonless DFU service, this service will
-be used to first reboot the device into DFU mode.`,
+be used to first reboot the device into DFU mode. Devices running the legacy
+bootloader of nRF5 SDK 11 and earlier are detected automatically. Devices
+running a serial bootloader can be upgraded over UART or USB CDC using --port.`,
 		Example: `nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --firmware FW.zip
-nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --firmware FW.zip --timeout=20s`,
+nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --firmware FW.zip --timeout=20s
+nrf-dfu dfu --name Sensor-0042 --firmware FW.zip
+nrf-dfu dfu --name-match 'Sensor-*' --select rssi --firmware FW.zip
+nrf-dfu dfu --port /dev/ttyACM0 --firmware FW.zip
+nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --firmware FW.zip --record trace.jsonl
+nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --firmware FW.zip --expect-revision 1.2.0
+nrf-dfu dfu --address 4b668b2e16e41429fca7af1b0dc50644 --hex app.hex --dat app.dat --start-address 0x26000`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return c.runDfu()
 		},
 	})
 
 	c.cmd.Flags().DurationVarP(&c.timeout, "timeout", "t", 30*time.Second, "Timeout for connecting to device")
+	c.cmd.Flags().DurationVar(&c.responseTimeout, "response-timeout", dfu.DefaultResponseTimeout, "Timeout for receiving a response from the device")
 	c.cmd.Flags().StringVarP(&c.firmwareFilename, "firmware", "f", "", "Filename of the firmware archive")
+	c.cmd.Flags().StringVar(&c.binFilename, "bin", "", "Filename of a raw binary firmware image")
+	c.cmd.Flags().StringVar(&c.hexFilename, "hex", "", "Filename of an Intel HEX firmware image")
+	c.cmd.Flags().StringVar(&c.datFilename, "dat", "", "Filename of the init packet for --bin or --hex")
+	c.cmd.Flags().StringVar(&c.startAddress, "start-address", "", "Flash address at which the --hex image starts (default: lowest address in the file)")
+	c.cmd.Flags().StringVar(&c.publicKey, "public-key", "", "PEM file with the key used to verify the signature of the firmware archive")
 	c.cmd.Flags().StringVarP(&c.address, "address", "a", "", "Address of device to be upgraded")
+	c.selector.addFlags(c.cmd)
+	c.cmd.Flags().StringVarP(&c.port, "port", "p", "", "Serial port of device to be upgraded")
+	c.cmd.Flags().IntVarP(&c.baudRate, "baud", "b", 115200, "Baud rate of the serial port")
+	c.cmd.Flags().IntVar(&c.mtu, "mtu", dfu.DefaultMTU, "Maximum BLE ATT MTU to negotiate with the device")
+	c.cmd.Flags().Uint16Var(&c.prn, "prn", dfu.DefaultPacketReceiptNotification, "Number of packets between receipt notifications (0 disables flow control)")
+	c.recorder.addFlags(c.cmd)
+	c.retry.addFlags(c.cmd)
+	c.verify.addFlags(c.cmd)
 	return c
 }
 
 func (c *dfuCommand) runDfu() error {
-	if c.address == "" {
-		return errors.New("No address specified. Use --addr to specify device address.")
+	targets := 0
+	for _, target := range []bool{c.address != "", c.port != "", c.selector.enabled()} {
+		if target {
+			targets++
+		}
+	}
+	if targets == 0 {
+		return errors.New("No device specified. Use --address to specify device address, --name or --name-match to specify device name, or --port to specify serial port.")
+	}
+	if targets > 1 {
+		return errors.New("Multiple devices specified. Use only one of --address, --name, --name-match and --port.")
+	}
+	if err := c.selector.validate(); err != nil {
+		return err
 	}
-	if c.firmwareFilename == "" {
-		return errors.New("No firmware filename specified. Use --firmware to specify firmware archive filename.")
+	if c.port != "" && c.recorder.enabled() {
+		return errors.New("--record can only be used with BLE devices.")
+	}
+	if c.port != "" && c.verify.enabled() {
+		return errors.New("--verify and --expect-revision can only be used with BLE devices.")
+	}
+	retryPolicy, err := c.retry.retryPolicy()
+	if err != nil {
+		return err
+	}
+	verification, err := c.verify.verification()
+	if err != nil {
+		return err
 	}
 
-	jww.INFO.Printf("Upgrading firmware of device '%s' with '%s'\n", c.address, c.firmwareFilename)
+	pkg, err := c.loadPackage()
+	if err != nil {
+		return err
+	}
 
-	bleClient, err := ble.NewClient()
+	defer c.recorder.close()
+	dfu, err := c.newDfu()
 	if err != nil {
-		return errors.Wrap(err, "failed to create new BLE client")
+		return err
 	}
+	dfu.SetPacketReceiptNotification(c.prn)
+	dfu.SetMTU(c.mtu)
+	dfu.SetResponseTimeout(c.responseTimeout)
+	dfu.SetRetryPolicy(retryPolicy)
+	dfu.SetVerification(verification)
 
-	dfu := dfu.NewDfu(bleClient, c.timeout)
-	dfu.SetDeviceAddress(c.address)
+	if c.publicKey != "" {
+		key, err := signing.LoadPublicKey(c.publicKey)
+		if err != nil {
+			return err
+		}
+		dfu.SetPublicKey(key)
+	}
+
+	ctx, cancel := newSignalContext()
+	defer cancel()
 
 	var bar *pb.ProgressBar = nil
 
-	err = dfu.Update(c.firmwareFilename, func(value int64, maxValue int64, info string) {
+	err = dfu.UpdatePackage(ctx, pkg, func(value int64, maxValue int64, info string) {
 		if bar == nil {
 			bar = pb.ProgressBarTemplate(`{{ white "DFU:" }} {{bar . | green}} {{speed . "%s byte/s" | white }}`).Start(100)
 		}
@@ -100,3 +177,91 @@ func (c *dfuCommand) runDfu() error {
 
 	return err
 }
+
+func (c *dfuCommand) newDfu() (dfu.FirmwareUpdater, error) {
+	if c.port != "" {
+		jww.INFO.Printf("Upgrading firmware of device on '%s' with '%s'\n", c.port, c.firmwareSource())
+		return dfu.NewSerialDfu(c.port, c.baudRate, c.timeout), nil
+	}
+
+	bleClient, err := c.newBleClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new BLE client")
+	}
+	bleClient, err = c.recorder.wrap(bleClient)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.selector.enabled() {
+		c.address, err = c.selector.resolve(bleClient)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jww.INFO.Printf("Upgrading firmware of device '%s' with '%s'\n", c.address, c.firmwareSource())
+
+	updater := dfu.NewDfu(bleClient, c.timeout)
+	updater.SetDeviceAddress(c.address)
+	return updater, nil
+}
+
+func (c *dfuCommand) firmwareSource() string {
+	switch {
+	case c.binFilename != "":
+		return c.binFilename
+	case c.hexFilename != "":
+		return c.hexFilename
+	}
+	return c.firmwareFilename
+}
+
+func (c *dfuCommand) loadPackage() (*dfu.Package, error) {
+	sources := 0
+	for _, filename := range []string{c.firmwareFilename, c.binFilename, c.hexFilename} {
+		if filename != "" {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return nil, errors.New("No firmware specified. Use --firmware to specify a firmware archive, or --bin or --hex together with --dat.")
+	}
+	if sources > 1 {
+		return nil, errors.New("Multiple firmware files specified. Use only one of --firmware, --bin and --hex.")
+	}
+	if c.startAddress != "" && c.hexFilename == "" {
+		return nil, errors.New("--start-address can only be used with --hex.")
+	}
+
+	if c.firmwareFilename != "" {
+		if c.datFilename != "" {
+			return nil, errors.New("--dat cannot be used with --firmware. The firmware archive contains the init packet.")
+		}
+		pkg, err := dfu.OpenPackage(c.firmwareFilename)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read firmware archive")
+		}
+		return pkg, nil
+	}
+
+	if c.datFilename == "" {
+		return nil, errors.New("No init packet specified. Use --dat to specify the init packet of the firmware.")
+	}
+
+	var startAddress *uint32
+	if c.startAddress != "" {
+		address, err := strconv.ParseUint(c.startAddress, 0, 32)
+		if err != nil {
+			return nil, errors.Errorf("Invalid start address '%s'.", c.startAddress)
+		}
+		start := uint32(address)
+		startAddress = &start
+	}
+
+	pkg, err := dfu.NewImagePackage(c.datFilename, c.firmwareSource(), startAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read firmware")
+	}
+	return pkg, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+type infoCommand struct {
+	*baseCommand
+
+	timeout         time.Duration
+	responseTimeout time.Duration
+	address         string
+	port            string
+	baudRate        int
+	json            bool
+	enterBootloader bool
+	retry           retryOptions
+}
+
+type infoReport struct {
+	ProtocolVersion byte            `json:"protocol_version"`
+	Hardware        *infoHardware   `json:"hardware,omitempty"`
+	Firmware        []*infoFirmware `json:"firmware"`
+}
+
+type infoHardware struct {
+	Part        string `json:"part"`
+	Variant     string `json:"variant"`
+	RomSize     uint32 `json:"rom_size"`
+	RomPageSize uint32 `json:"rom_page_size"`
+	RamSize     uint32 `json:"ram_size"`
+}
+
+type infoFirmware struct {
+	Type    string `json:"type"`
+	Version uint32 `json:"version"`
+	Address uint32 `json:"address"`
+	Length  uint32 `json:"length"`
+}
+
+func newInfoCommand() *infoCommand {
+	c := &infoCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "info",
+		Short: "Show bootloader and firmware versions of a device",
+		Long: `This command shows the protocol version of the bootloader of an nRF51 or
+nRF52 device in DFU mode, the hardware it runs on, and the type, version,
+address and length of each firmware image on the device. A device that runs
+its application is only rebooted into DFU mode with --enter-bootloader.`,
+		Example: `nrf-dfu info --address 4b668b2e16e41429fca7af1b0dc50644
+nrf-dfu info --address 4b668b2e16e41429fca7af1b0dc50644 --enter-bootloader
+nrf-dfu info --port /dev/ttyACM0 --json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runInfo()
+		},
+	})
+
+	c.cmd.Flags().DurationVarP(&c.timeout, "timeout", "t", 30*time.Second, "Timeout for connecting to device")
+	c.cmd.Flags().DurationVar(&c.responseTimeout, "response-timeout", dfu.DefaultResponseTimeout, "Timeout for receiving a response from the device")
+	c.cmd.Flags().StringVarP(&c.address, "address", "a", "", "Address of device")
+	c.cmd.Flags().StringVarP(&c.port, "port", "p", "", "Serial port of device")
+	c.cmd.Flags().IntVarP(&c.baudRate, "baud", "b", 115200, "Baud rate of the serial port")
+	c.cmd.Flags().BoolVar(&c.json, "json", false, "Output in JSON format")
+	c.cmd.Flags().BoolVar(&c.enterBootloader, "enter-bootloader", false, "Reboot a device in application mode into the bootloader")
+	c.retry.addFlags(c.cmd)
+
+	return c
+}
+
+func (c *infoCommand) runInfo() error {
+	if c.address == "" && c.port == "" {
+		return errors.New("No address or port specified. Use --address to specify device address or --port to specify serial port.")
+	}
+	if c.address != "" && c.port != "" {
+		return errors.New("Both address and port specified. Use either --address or --port.")
+	}
+	retryPolicy, err := c.retry.retryPolicy()
+	if err != nil {
+		return err
+	}
+
+	updater, err := c.newDfu()
+	if err != nil {
+		return err
+	}
+	updater.SetResponseTimeout(c.responseTimeout)
+	updater.SetRetryPolicy(retryPolicy)
+
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	info, err := updater.Info(ctx, c.enterBootloader)
+	if err == dfu.ErrApplicationMode {
+		return errors.New("Device is in application mode. Use --enter-bootloader to reboot it into the bootloader.")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to query device information")
+	}
+
+	report := newInfoReport(info)
+	if c.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	printInfoReport(report)
+	return nil
+}
+
+func (c *infoCommand) newDfu() (dfu.FirmwareUpdater, error) {
+	if c.port != "" {
+		jww.INFO.Printf("Querying device on '%s'\n", c.port)
+		return dfu.NewSerialDfu(c.port, c.baudRate, c.timeout), nil
+	}
+
+	jww.INFO.Printf("Querying device '%s'\n", c.address)
+
+	bleClient, err := c.newBleClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new BLE client")
+	}
+
+	updater := dfu.NewDfu(bleClient, c.timeout)
+	updater.SetDeviceAddress(c.address)
+	return updater, nil
+}
+
+func newInfoReport(info *dfu.DeviceInfo) *infoReport {
+	report := &infoReport{ProtocolVersion: info.ProtocolVersion, Firmware: []*infoFirmware{}}
+	if info.Hardware != nil {
+		report.Hardware = &infoHardware{
+			Part:        fmt.Sprintf("nRF%X", info.Hardware.Part),
+			Variant:     formatVariant(info.Hardware.Variant),
+			RomSize:     info.Hardware.RomSize,
+			RomPageSize: info.Hardware.RomPageSize,
+			RamSize:     info.Hardware.RamSize,
+		}
+	}
+	for _, firmware := range info.Firmware {
+		report.Firmware = append(report.Firmware, &infoFirmware{
+			Type:    firmware.Type.String(),
+			Version: firmware.Version,
+			Address: firmware.Address,
+			Length:  firmware.Length,
+		})
+	}
+	return report
+}
+
+// formatVariant returns the variant as its four character code, e.g. AAE0.
+func formatVariant(variant uint32) string {
+	code := []byte{byte(variant >> 24), byte(variant >> 16), byte(variant >> 8), byte(variant)}
+	for _, b := range code {
+		if b < ' ' || b > '~' {
+			return fmt.Sprintf("0x%08X", variant)
+		}
+	}
+	return string(code)
+}
+
+func printInfoReport(report *infoReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Protocol version:\t%d\n", report.ProtocolVersion)
+	if hardware := report.Hardware; hardware != nil {
+		fmt.Fprintf(w, "Part:\t%s\n", hardware.Part)
+		fmt.Fprintf(w, "Variant:\t%s\n", hardware.Variant)
+		fmt.Fprintf(w, "ROM size:\t%d bytes\n", hardware.RomSize)
+		fmt.Fprintf(w, "ROM page size:\t%d bytes\n", hardware.RomPageSize)
+		fmt.Fprintf(w, "RAM size:\t%d bytes\n", hardware.RamSize)
+	}
+
+	for _, firmware := range report.Firmware {
+		fmt.Fprintf(w, "\nImage:\t%s\n", firmware.Type)
+		fmt.Fprintf(w, "  Version:\t%d\n", firmware.Version)
+		fmt.Fprintf(w, "  Address:\t0x%08X\n", firmware.Address)
+		fmt.Fprintf(w, "  Length:\t%d bytes\n", firmware.Length)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	"github.com/spf13/cobra"
+)
+
+type inspectCommand struct {
+	*baseCommand
+
+	json      bool
+	publicKey string
+}
+
+type inspectReport struct {
+	Filename string          `json:"filename"`
+	Size     int64           `json:"size"`
+	Images   []*inspectImage `json:"images"`
+}
+
+type inspectImage struct {
+	Type            dfu.ImageType      `json:"type"`
+	FirmwareFile    string             `json:"firmware_file"`
+	FirmwareSize    int                `json:"firmware_size"`
+	FirmwareCrc32   uint32             `json:"firmware_crc32"`
+	FirmwareSha256  string             `json:"firmware_sha256"`
+	InitPacketFile  string             `json:"init_packet_file"`
+	InitPacketSize  int                `json:"init_packet_size"`
+	InitPacket      *inspectInitPacket `json:"init_packet,omitempty"`
+	InitPacketError string             `json:"init_packet_error,omitempty"`
+	HashError       string             `json:"hash_error,omitempty"`
+	HashValid       bool               `json:"hash_valid"`
+	SignatureError  string             `json:"signature_error,omitempty"`
+	SignatureValid  *bool              `json:"signature_valid,omitempty"`
+}
+
+type inspectInitPacket struct {
+	FirmwareType  string   `json:"fw_type"`
+	FwVersion     *uint32  `json:"fw_version,omitempty"`
+	HwVersion     *uint32  `json:"hw_version,omitempty"`
+	SdReq         []uint32 `json:"sd_req"`
+	SdSize        uint32   `json:"sd_size"`
+	BlSize        uint32   `json:"bl_size"`
+	AppSize       uint32   `json:"app_size"`
+	HashType      string   `json:"hash_type,omitempty"`
+	Hash          string   `json:"hash,omitempty"`
+	IsDebug       bool     `json:"is_debug"`
+	Signed        bool     `json:"signed"`
+	SignatureType string   `json:"signature_type,omitempty"`
+	Signature     string   `json:"signature,omitempty"`
+}
+
+func newInspectCommand() *inspectCommand {
+	c := &inspectCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "inspect FIRMWARE",
+		Short: "Show the contents of a firmware archive",
+		Long: `This command shows the images in a firmware archive, together with their
+sizes, checksums and the contents of their init packets. No device is needed.`,
+		Example: `nrf-dfu inspect FW.zip
+nrf-dfu inspect FW.zip --json`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runInspect(args[0])
+		},
+	})
+
+	c.cmd.Flags().BoolVar(&c.json, "json", false, "Output in JSON format")
+	c.cmd.Flags().StringVar(&c.publicKey, "public-key", "", "PEM file with the key used to verify the signatures of the images")
+
+	return c
+}
+
+func (c *inspectCommand) runInspect(filename string) error {
+	pkg, err := dfu.OpenPackage(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read firmware archive")
+	}
+
+	var key *ecdsa.PublicKey
+	if c.publicKey != "" {
+		key, err = signing.LoadPublicKey(c.publicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	report := &inspectReport{Filename: filename, Size: pkg.Size()}
+	for _, image := range pkg.Images {
+		report.Images = append(report.Images, newInspectImage(image, key))
+	}
+
+	if c.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	printInspectReport(report)
+	return nil
+}
+
+func newInspectImage(image *dfu.Image, key *ecdsa.PublicKey) *inspectImage {
+	sha := sha256.Sum256(image.Firmware)
+	info := &inspectImage{
+		Type:           image.Type,
+		FirmwareFile:   image.FirmwareFile,
+		FirmwareSize:   len(image.Firmware),
+		FirmwareCrc32:  crc32.ChecksumIEEE(image.Firmware),
+		FirmwareSha256: hex.EncodeToString(sha[:]),
+		InitPacketFile: image.InitDataFile,
+		InitPacketSize: len(image.InitData),
+	}
+
+	packet, err := initpacket.Decode(image.InitData)
+	if err != nil {
+		info.InitPacketError = err.Error()
+		return info
+	}
+
+	if err = image.VerifyHash(); err != nil {
+		info.HashError = err.Error()
+	} else {
+		info.HashValid = true
+	}
+	if key != nil {
+		valid := true
+		if err = image.VerifySignature(key); err != nil {
+			info.SignatureError = err.Error()
+			valid = false
+		}
+		info.SignatureValid = &valid
+	}
+
+	init := packet.GetInitCommand()
+	if init == nil {
+		info.InitPacketError = "init packet does not contain an init command"
+		return info
+	}
+	info.InitPacket = &inspectInitPacket{
+		FirmwareType: init.GetType().String(),
+		FwVersion:    init.FwVersion,
+		HwVersion:    init.HwVersion,
+		SdReq:        init.SdReq,
+		SdSize:       init.GetSdSize(),
+		BlSize:       init.GetBlSize(),
+		AppSize:      init.GetAppSize(),
+		IsDebug:      init.GetIsDebug(),
+		Signed:       packet.IsSigned(),
+	}
+	if init.Hash != nil {
+		info.InitPacket.HashType = init.Hash.HashType.String()
+		info.InitPacket.Hash = hex.EncodeToString(init.Hash.Hash)
+	}
+	if packet.IsSigned() {
+		info.InitPacket.SignatureType = packet.SignedCommand.SignatureType.String()
+		info.InitPacket.Signature = hex.EncodeToString(packet.SignedCommand.Signature)
+	}
+	return info
+}
+
+func printInspectReport(report *inspectReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Package:\t%s\n", report.Filename)
+	fmt.Fprintf(w, "Size:\t%d bytes\n", report.Size)
+
+	for _, image := range report.Images {
+		fmt.Fprintf(w, "\nImage:\t%s\n", image.Type)
+		fmt.Fprintf(w, "  Firmware file:\t%s\n", image.FirmwareFile)
+		fmt.Fprintf(w, "  Firmware size:\t%d bytes\n", image.FirmwareSize)
+		fmt.Fprintf(w, "  Firmware CRC32:\t0x%08X\n", image.FirmwareCrc32)
+		fmt.Fprintf(w, "  Firmware SHA-256:\t%s\n", image.FirmwareSha256)
+		fmt.Fprintf(w, "  Init packet file:\t%s\n", image.InitPacketFile)
+		fmt.Fprintf(w, "  Init packet size:\t%d bytes\n", image.InitPacketSize)
+
+		if image.InitPacket == nil {
+			fmt.Fprintf(w, "  Init packet error:\t%s\n", image.InitPacketError)
+			continue
+		}
+
+		init := image.InitPacket
+		fmt.Fprintf(w, "  Firmware type:\t%s\n", init.FirmwareType)
+		fmt.Fprintf(w, "  Firmware version:\t%s\n", formatOptional(init.FwVersion))
+		fmt.Fprintf(w, "  Hardware version:\t%s\n", formatOptional(init.HwVersion))
+		fmt.Fprintf(w, "  SoftDevice requirements:\t%s\n", formatSdReq(init.SdReq))
+		fmt.Fprintf(w, "  SoftDevice size:\t%d bytes\n", init.SdSize)
+		fmt.Fprintf(w, "  Bootloader size:\t%d bytes\n", init.BlSize)
+		fmt.Fprintf(w, "  Application size:\t%d bytes\n", init.AppSize)
+		if init.HashType != "" {
+			fmt.Fprintf(w, "  Hash type:\t%s\n", init.HashType)
+			fmt.Fprintf(w, "  Hash:\t%s\n", init.Hash)
+		}
+		if image.HashValid {
+			fmt.Fprintf(w, "  Hash verification:\tvalid\n")
+		} else {
+			fmt.Fprintf(w, "  Hash verification:\t%s\n", image.HashError)
+		}
+		fmt.Fprintf(w, "  Debug:\t%t\n", init.IsDebug)
+		if init.Signed {
+			fmt.Fprintf(w, "  Signature type:\t%s\n", init.SignatureType)
+			fmt.Fprintf(w, "  Signature:\t%s\n", init.Signature)
+		} else {
+			fmt.Fprintf(w, "  Signature:\tnone\n")
+		}
+		if image.SignatureValid != nil && *image.SignatureValid {
+			fmt.Fprintf(w, "  Signature verification:\tvalid\n")
+		} else if image.SignatureValid != nil {
+			fmt.Fprintf(w, "  Signature verification:\t%s\n", image.SignatureError)
+		}
+	}
+}
+
+func formatOptional(value *uint32) string {
+	if value == nil {
+		return "not set"
+	}
+	return fmt.Sprintf("%d", *value)
+}
+
+func formatSdReq(sdReq []uint32) string {
+	if len(sdReq) == 0 {
+		return "none"
+	}
+	values := make([]string, len(sdReq))
+	for i, sd := range sdReq {
+		values[i] = fmt.Sprintf("0x%02X", sd)
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+type keysCommand struct {
+	*baseCommand
+}
+
+type keysGenerateCommand struct {
+	*baseCommand
+}
+
+type keysDisplayCommand struct {
+	*baseCommand
+
+	key    string
+	format string
+}
+
+func newKeysCommand() *keysCommand {
+	c := &keysCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "keys",
+		Short: "Manage signing keys",
+		Args:  cobra.NoArgs,
+	})
+
+	c.AddCommand(newKeysGenerateCommand())
+	c.AddCommand(newKeysDisplayCommand())
+
+	return c
+}
+
+func newKeysGenerateCommand() *keysGenerateCommand {
+	c := &keysGenerateCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "generate KEYFILE",
+		Short: "Generate a private key",
+		Long: `This command generates an ECDSA P-256 private key for signing DFU packages
+and stores it as a PEM file. Existing files are not overwritten.`,
+		Example: `nrf-dfu keys generate private.pem`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runGenerate(args[0])
+		},
+	})
+
+	return c
+}
+
+func (c *keysGenerateCommand) runGenerate(filename string) error {
+	key, err := signing.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := signing.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot create key file")
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write key file")
+	}
+
+	jww.INFO.Printf("Private key written to '%s'\n", filename)
+	return nil
+}
+
+func newKeysDisplayCommand() *keysDisplayCommand {
+	c := &keysDisplayCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "display KEYFILE",
+		Short: "Display a key",
+		Long: `This command displays the public or private part of a private key file.
+The code format produces the dfu_public_key.c file needed to build a
+bootloader that accepts packages signed with the key. The dbgcode format
+produces the same file, guarded for use in debug builds only.`,
+		Example: `nrf-dfu keys display --key pk --format code private.pem
+nrf-dfu keys display --key pk --format pem private.pem
+nrf-dfu keys display --key sk --format pem private.pem`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runDisplay(args[0])
+		},
+	})
+
+	c.cmd.Flags().StringVar(&c.key, "key", "pk", "Key to display: pk (public key) or sk (private key)")
+	c.cmd.Flags().StringVar(&c.format, "format", "code", "Output format: code, dbgcode, pem or hex")
+
+	return c
+}
+
+func (c *keysDisplayCommand) runDisplay(filename string) error {
+	key, err := signing.LoadPrivateKey(filename)
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	switch {
+	case c.key == "sk" && c.format == "pem":
+		output, err = signing.EncodePrivateKey(key)
+	case c.key == "sk" && c.format == "hex":
+		output = []byte(hex.EncodeToString(signing.RawPrivateKey(key)) + "\n")
+	case c.key == "sk":
+		return errors.Errorf("Format '%s' is not supported for private keys. Use pem or hex.", c.format)
+	case c.key == "pk" && c.format == "pem":
+		output, err = signing.EncodePublicKey(&key.PublicKey)
+	case c.key == "pk" && c.format == "hex":
+		output = []byte(hex.EncodeToString(signing.RawPublicKey(&key.PublicKey)) + "\n")
+	case c.key == "pk" && c.format == "code":
+		output = publicKeyCode(signing.RawPublicKey(&key.PublicKey), false)
+	case c.key == "pk" && c.format == "dbgcode":
+		output = publicKeyCode(signing.RawPublicKey(&key.PublicKey), true)
+	case c.key == "pk":
+		return errors.Errorf("Unknown format '%s'. Use code, dbgcode, pem or hex.", c.format)
+	default:
+		return errors.Errorf("Unknown key '%s'. Use pk or sk.", c.key)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(output)
+	return err
+}
+
+// publicKeyCode returns the C source of the public key array that the
+// bootloader is built with.
+func publicKeyCode(raw []byte, debug bool) []byte {
+	var b bytes.Buffer
+
+	if debug {
+		fmt.Fprintln(&b, "/* This file was generated with a throwaway private key, that is only intended for a debug version of the DFU project.")
+		fmt.Fprintln(&b, "   Do not use it in production. */")
+		fmt.Fprintln(&b)
+		fmt.Fprintln(&b, "#ifdef NRF_DFU_DEBUG_VERSION")
+	} else {
+		fmt.Fprintln(&b, "/* This file was automatically generated by nrf-dfu */")
+	}
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, `#include "stdint.h"`)
+	fmt.Fprintln(&b, `#include "compiler_abstraction.h"`)
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "/** @brief Public key used to verify DFU images */")
+	fmt.Fprintf(&b, "__ALIGN(4) const uint8_t pk[%d] =\n", len(raw))
+	fmt.Fprintln(&b, "{")
+	half := len(raw) / 2
+	fmt.Fprintf(&b, "    %s,\n", formatCBytes(raw[:half]))
+	fmt.Fprintf(&b, "    %s\n", formatCBytes(raw[half:]))
+	fmt.Fprintln(&b, "};")
+	if debug {
+		fmt.Fprintln(&b)
+		fmt.Fprintln(&b, "#else")
+		fmt.Fprintln(&b, `#error "Debug public key not valid for production. Generate a key with 'nrf-dfu keys generate'."`)
+		fmt.Fprintln(&b, "#endif")
+	}
+
+	return b.Bytes()
+}
+
+func formatCBytes(data []byte) string {
+	values := make([]string, len(data))
+	for i, v := range data {
+		values[i] = fmt.Sprintf("0x%02x", v)
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+type pkgCommand struct {
+	*baseCommand
+}
+
+type pkgGenerateCommand struct {
+	*baseCommand
+
+	application        string
+	applicationVersion uint32
+	bootloader         string
+	bootloaderVersion  uint32
+	softDevice         string
+	hwVersion          uint32
+	sdReq              string
+	sdId               string
+	keyFile            string
+}
+
+func newPkgCommand() *pkgCommand {
+	c := &pkgCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "pkg",
+		Short: "Manage DFU packages",
+		Args:  cobra.NoArgs,
+	})
+
+	c.AddCommand(newPkgGenerateCommand())
+
+	return c
+}
+
+func newPkgGenerateCommand() *pkgGenerateCommand {
+	c := &pkgGenerateCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "generate PACKAGE",
+		Short: "Generate a DFU package",
+		Long: `This command generates a Secure DFU package from raw binary or Intel HEX
+firmware files. Files with a .hex extension are read as Intel HEX.
+If a SoftDevice and a bootloader are both given, they are combined into one
+image. The package is signed if a private key is specified.`,
+		Example: `nrf-dfu pkg generate --application app.hex --application-version 1 --hw-version 52 --sd-req 0xB6 --key-file private.pem FW.zip
+nrf-dfu pkg generate --softdevice sd.hex --bootloader bl.hex --bootloader-version 2 --hw-version 52 --sd-req 0xB6 --key-file private.pem FW.zip`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runGenerate(args[0])
+		},
+	})
+
+	c.cmd.Flags().StringVar(&c.application, "application", "", "Application firmware file")
+	c.cmd.Flags().Uint32Var(&c.applicationVersion, "application-version", 0, "Version of the application firmware")
+	c.cmd.Flags().StringVar(&c.bootloader, "bootloader", "", "Bootloader firmware file")
+	c.cmd.Flags().Uint32Var(&c.bootloaderVersion, "bootloader-version", 0, "Version of the bootloader firmware")
+	c.cmd.Flags().StringVar(&c.softDevice, "softdevice", "", "SoftDevice firmware file")
+	c.cmd.Flags().Uint32Var(&c.hwVersion, "hw-version", 0, "Hardware version of the device")
+	c.cmd.Flags().StringVar(&c.sdReq, "sd-req", "", "Comma separated list of SoftDevice firmware IDs required on the device")
+	c.cmd.Flags().StringVar(&c.sdId, "sd-id", "", "Comma separated list of SoftDevice firmware IDs required by the application, if a SoftDevice is included")
+	c.cmd.Flags().StringVar(&c.keyFile, "key-file", "", "PEM file with the private key used to sign the package")
+
+	return c
+}
+
+func (c *pkgGenerateCommand) runGenerate(filename string) error {
+	flags := c.cmd.Flags()
+	if c.application == "" && c.bootloader == "" && c.softDevice == "" {
+		return errors.New("No firmware specified. Use --application, --bootloader or --softdevice to specify firmware.")
+	}
+	if c.application != "" && !flags.Changed("application-version") {
+		return errors.New("No application version specified. Use --application-version to specify the version.")
+	}
+	if c.bootloader != "" && !flags.Changed("bootloader-version") {
+		return errors.New("No bootloader version specified. Use --bootloader-version to specify the version.")
+	}
+	if !flags.Changed("hw-version") {
+		return errors.New("No hardware version specified. Use --hw-version to specify the version.")
+	}
+
+	sdReq, err := parseFirmwareIds(c.sdReq)
+	if err != nil {
+		return errors.Wrap(err, "invalid --sd-req")
+	}
+	if len(sdReq) == 0 {
+		return errors.New("No SoftDevice requirements specified. Use --sd-req to specify the required SoftDevices.")
+	}
+	sdId, err := parseFirmwareIds(c.sdId)
+	if err != nil {
+		return errors.Wrap(err, "invalid --sd-id")
+	}
+
+	options := &dfu.PackageOptions{
+		Application:        c.application,
+		ApplicationVersion: c.applicationVersion,
+		Bootloader:         c.bootloader,
+		BootloaderVersion:  c.bootloaderVersion,
+		SoftDevice:         c.softDevice,
+		HwVersion:          c.hwVersion,
+		SdReq:              sdReq,
+		SdId:               sdId,
+	}
+
+	if c.keyFile != "" {
+		options.Key, err = signing.LoadPrivateKey(c.keyFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		jww.WARN.Println("No private key specified, the package will not be signed.")
+	}
+
+	pkg, err := dfu.GeneratePackage(options)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate package")
+	}
+
+	err = pkg.Write(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to write package")
+	}
+
+	jww.INFO.Printf("Package written to '%s'\n", filename)
+	return nil
+}
+
+func parseFirmwareIds(list string) ([]uint32, error) {
+	var ids []uint32
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 0, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid firmware ID '%s'", field)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
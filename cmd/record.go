@@ -0,0 +1,80 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/ble/trace"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// traceRecorder records the BLE traffic of a command to a trace file.
+type traceRecorder struct {
+	filename string
+	file     *os.File
+	recorder *trace.Recorder
+}
+
+func (t *traceRecorder) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&t.filename, "record", "", "Record the BLE traffic to a JSON lines trace file")
+}
+
+func (t *traceRecorder) enabled() bool {
+	return t.filename != ""
+}
+
+// wrap returns a client that records the traffic of client, or client itself
+// if no trace file was specified.
+func (t *traceRecorder) wrap(client ble.Client) (ble.Client, error) {
+	if !t.enabled() {
+		return client, nil
+	}
+
+	f, err := os.Create(t.filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create trace file")
+	}
+	t.file = f
+	t.recorder = trace.NewRecorder(client, f)
+	return t.recorder, nil
+}
+
+func (t *traceRecorder) close() {
+	if t.file == nil {
+		return
+	}
+
+	err := t.recorder.Err()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	t.file = nil
+
+	if err != nil {
+		jww.WARN.Printf("Trace '%s' is incomplete: %v\n", t.filename, err)
+		return
+	}
+	jww.INFO.Printf("BLE trace written to '%s'\n", t.filename)
+}
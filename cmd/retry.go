@@ -0,0 +1,105 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/spf13/cobra"
+)
+
+// retryOptions configures how a single update retries connecting, service
+// discovery and sending objects.
+type retryOptions struct {
+	policy    dfu.RetryPolicy
+	retryable []string
+	cmd       *cobra.Command
+}
+
+func (o *retryOptions) addFlags(cmd *cobra.Command) {
+	o.policy = dfu.DefaultRetryPolicy
+	o.cmd = cmd
+
+	var classes []string
+	for _, class := range dfu.DefaultRetryPolicy.Retryable {
+		classes = append(classes, string(class))
+	}
+
+	cmd.Flags().IntVar(&o.policy.Attempts, "attempts", o.policy.Attempts, "Number of attempts to connect, to discover the DFU service and to send each object")
+	cmd.Flags().DurationVar(&o.policy.Backoff, "backoff", o.policy.Backoff, "Delay before the first retry, doubled for every further retry")
+	cmd.Flags().DurationVar(&o.policy.MaxBackoff, "max-backoff", o.policy.MaxBackoff, "Maximum delay between retries")
+	cmd.Flags().Float64Var(&o.policy.Jitter, "jitter", o.policy.Jitter, "Fraction by which the delay between retries is varied randomly")
+	cmd.Flags().StringSliceVar(&o.retryable, "retry-on", classes, "Failures to retry: "+o.classNames())
+}
+
+// addRetryDelayFlag adds --retry-delay, the former name of --backoff.
+func (o *retryOptions) addRetryDelayFlag(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&o.policy.Backoff, "retry-delay", o.policy.Backoff, "Delay before the first retry")
+	cmd.Flags().MarkDeprecated("retry-delay", "use --backoff instead")
+}
+
+// setRetries sets the number of attempts from a number of retries, as given
+// before --attempts existed. An explicit --attempts takes precedence.
+func (o *retryOptions) setRetries(retries int) {
+	if !o.cmd.Flags().Changed("attempts") {
+		o.policy.Attempts = retries + 1
+	}
+}
+
+func (o *retryOptions) classNames() string {
+	var names []string
+	for _, class := range dfu.ErrorClasses {
+		names = append(names, string(class))
+	}
+	return strings.Join(names, ", ")
+}
+
+// retryPolicy validates the options and returns the policy they describe.
+func (o *retryOptions) retryPolicy() (dfu.RetryPolicy, error) {
+	policy := o.policy
+	if policy.Attempts < 1 {
+		return policy, errors.New("--attempts must be at least 1.")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return policy, errors.New("--jitter must be between 0 and 1.")
+	}
+
+	policy.Retryable = nil
+	for _, name := range o.retryable {
+		class, ok := o.class(name)
+		if !ok {
+			return policy, errors.Errorf("Unknown failure '%s' in --retry-on. Use %s.", name, o.classNames())
+		}
+		policy.Retryable = append(policy.Retryable, class)
+	}
+	return policy, nil
+}
+
+func (o *retryOptions) class(name string) (dfu.ErrorClass, bool) {
+	for _, class := range dfu.ErrorClasses {
+		if strings.EqualFold(name, string(class)) {
+			return class, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,639 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gopkg.in/yaml.v2"
+)
+
+type rolloutCommand struct {
+	*baseCommand
+
+	timeout         time.Duration
+	responseTimeout time.Duration
+	prn             uint16
+	mtu             int
+	stateFilename   string
+	publicKey       string
+	retry           retryOptions
+	verify          verifyOptions
+}
+
+// rolloutPlan describes which firmware goes to which devices, and in which
+// waves. Plans are written in YAML or JSON.
+type rolloutPlan struct {
+	// Firmware archive per hardware revision. Paths are relative to the plan.
+	Firmware map[string]string `yaml:"firmware"`
+	Targets  []rolloutTarget   `yaml:"targets"`
+	// Number of devices per wave. Devices beyond the listed waves are
+	// updated in waves of the last size. All devices form a single wave if
+	// no waves are listed.
+	Waves []int `yaml:"waves"`
+	// Fraction of the devices in a wave that must succeed before the next
+	// wave starts.
+	SuccessThreshold *float64 `yaml:"success_threshold"`
+	// Number of failed devices that halts the rollout when exceeded.
+	FailureBudget int           `yaml:"failure_budget"`
+	Concurrency   int           `yaml:"concurrency"`
+	ScanDuration  time.Duration `yaml:"scan_duration"`
+	// Deprecated: the number of retries of each step, used when --attempts
+	// is not given.
+	Retries int `yaml:"retries"`
+}
+
+// rolloutTarget selects devices by address, or by a regular expression
+// matched against the names of advertising devices.
+type rolloutTarget struct {
+	Hardware  string   `yaml:"hardware"`
+	Addresses []string `yaml:"addresses"`
+	Name      string   `yaml:"name"`
+
+	namePattern *regexp.Regexp
+}
+
+const (
+	rolloutDefaultHardware     = "default"
+	rolloutDefaultConcurrency  = 4
+	rolloutDefaultScanDuration = 10 * time.Second
+)
+
+type rolloutStatus string
+
+const (
+	rolloutPending rolloutStatus = "pending"
+	rolloutDone    rolloutStatus = "done"
+	rolloutFailed  rolloutStatus = "failed"
+)
+
+// rolloutState records the progress of a rollout, so that an interrupted or
+// halted rollout can be resumed.
+type rolloutState struct {
+	Devices []*rolloutDevice `json:"devices"`
+	Halted  string           `json:"halted,omitempty"`
+
+	filename string
+	mutex    sync.Mutex
+}
+
+type rolloutDevice struct {
+	Address  string        `json:"address"`
+	Hardware string        `json:"hardware"`
+	Wave     int           `json:"wave"`
+	Status   rolloutStatus `json:"status"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error,omitempty"`
+	Updated  *time.Time    `json:"updated,omitempty"`
+}
+
+func newRolloutCommand() *rolloutCommand {
+	c := &rolloutCommand{}
+
+	c.baseCommand = newBaseCommand(&cobra.Command{
+		Use:   "rollout PLAN",
+		Short: "Roll out firmware to a fleet of devices in waves",
+		Long: `This command upgrades a fleet of nRF51 or nRF52 devices as described by a
+YAML or JSON plan. The plan selects devices by address or by a regular
+expression matched against their advertised name, assigns a firmware archive
+per hardware revision, and divides the devices into waves:
+
+  firmware:
+    rev-a: sensor-rev-a.zip
+    rev-b: sensor-rev-b.zip
+  targets:
+    - hardware: rev-a
+      addresses: [4b668b2e16e4, 5c779c3f27f5]
+    - hardware: rev-b
+      name: ^SENSOR-B-
+  waves: [1, 5, 20]
+  success_threshold: 0.9
+  failure_budget: 2
+  concurrency: 4
+
+A wave starts when the previous wave reached the success threshold. The
+rollout halts when more devices failed than the failure budget allows.
+Progress is kept in a state file, so running the command again resumes an
+interrupted or halted rollout. Devices that failed are then retried.`,
+		Example: `nrf-dfu rollout plan.yaml
+nrf-dfu rollout plan.yaml --state plan.state.json`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.runRollout(args[0])
+		},
+	})
+
+	c.cmd.Flags().DurationVarP(&c.timeout, "timeout", "t", 30*time.Second, "Timeout for connecting to a device")
+	c.cmd.Flags().DurationVar(&c.responseTimeout, "response-timeout", dfu.DefaultResponseTimeout, "Timeout for receiving a response from a device")
+	c.cmd.Flags().StringVar(&c.stateFilename, "state", "", "File that records the progress of the rollout (default: PLAN.state.json)")
+	c.cmd.Flags().StringVar(&c.publicKey, "public-key", "", "PEM file with the key used to verify the signatures of the firmware archives")
+	c.cmd.Flags().IntVar(&c.mtu, "mtu", dfu.DefaultMTU, "Maximum BLE ATT MTU to negotiate with the devices")
+	c.cmd.Flags().Uint16Var(&c.prn, "prn", dfu.DefaultPacketReceiptNotification, "Number of packets between receipt notifications (0 disables flow control)")
+	c.retry.addFlags(c.cmd)
+	c.retry.addRetryDelayFlag(c.cmd)
+	c.verify.addFlags(c.cmd)
+	return c
+}
+
+func (c *rolloutCommand) runRollout(planFilename string) error {
+	plan, err := loadRolloutPlan(planFilename)
+	if err != nil {
+		return err
+	}
+
+	if plan.Retries > 0 {
+		jww.WARN.Println("'retries' in the rollout plan is deprecated. Use --attempts instead.")
+		c.retry.setRetries(plan.Retries)
+	}
+	retryPolicy, err := c.retry.retryPolicy()
+	if err != nil {
+		return err
+	}
+	verification, err := c.verify.verification()
+	if err != nil {
+		return err
+	}
+
+	var key *ecdsa.PublicKey
+	if c.publicKey != "" {
+		key, err = signing.LoadPublicKey(c.publicKey)
+		if err != nil {
+			return err
+		}
+	}
+	packages, err := plan.loadPackages(filepath.Dir(planFilename), key)
+	if err != nil {
+		return err
+	}
+
+	bleClients, err := c.newBleClients()
+	if err != nil {
+		return errors.Wrap(err, "failed to create new BLE client")
+	}
+	pool := newClientPool(bleClients, plan.Concurrency)
+
+	stateFilename := c.stateFilename
+	if stateFilename == "" {
+		stateFilename = planFilename + ".state.json"
+	}
+	state, err := loadRolloutState(stateFilename)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		devices, err := plan.resolveDevices(bleClients[0])
+		if err != nil {
+			return err
+		}
+		state = &rolloutState{Devices: devices, filename: stateFilename}
+		if err = state.save(); err != nil {
+			return err
+		}
+	} else {
+		jww.INFO.Printf("Resuming rollout from '%s'\n", stateFilename)
+		if err = plan.checkState(state); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := newSignalContext()
+	defer cancel()
+
+	update := func(ctx context.Context, address string, progress dfu.DfuProgress) error {
+		bleClient := pool.get()
+		defer pool.put(bleClient)
+
+		updater := dfu.NewDfu(bleClient, c.timeout)
+		updater.SetDeviceAddress(address)
+		updater.SetPacketReceiptNotification(c.prn)
+		updater.SetMTU(c.mtu)
+		updater.SetResponseTimeout(c.responseTimeout)
+		updater.SetRetryPolicy(retryPolicy)
+		updater.SetVerification(verification)
+		return updater.UpdatePackage(ctx, packages[state.device(address).Hardware], progress)
+	}
+
+	err = plan.run(ctx, state, &batchRunner{concurrency: plan.Concurrency, update: update})
+	printRolloutSummary(os.Stdout, state)
+	return err
+}
+
+func loadRolloutPlan(filename string) (*rolloutPlan, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read rollout plan")
+	}
+
+	// YAML is a superset of JSON, so this reads both.
+	plan := &rolloutPlan{}
+	if err = yaml.UnmarshalStrict(data, plan); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse rollout plan '%s'", filename)
+	}
+	if err = plan.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid rollout plan '%s'", filename)
+	}
+	return plan, nil
+}
+
+func (plan *rolloutPlan) validate() error {
+	if len(plan.Firmware) == 0 {
+		return errors.New("no firmware specified")
+	}
+	if len(plan.Targets) == 0 {
+		return errors.New("no targets specified")
+	}
+
+	for i := range plan.Targets {
+		target := &plan.Targets[i]
+		if target.Hardware == "" {
+			target.Hardware = rolloutDefaultHardware
+		}
+		if _, ok := plan.Firmware[target.Hardware]; !ok {
+			return errors.Errorf("no firmware specified for hardware '%s'", target.Hardware)
+		}
+		if len(target.Addresses) == 0 && target.Name == "" {
+			return errors.Errorf("target %d selects no devices, specify addresses or name", i+1)
+		}
+		if target.Name != "" {
+			pattern, err := regexp.Compile(target.Name)
+			if err != nil {
+				return errors.Wrapf(err, "invalid name pattern of target %d", i+1)
+			}
+			target.namePattern = pattern
+		}
+	}
+
+	for _, size := range plan.Waves {
+		if size < 1 {
+			return errors.Errorf("invalid wave size %d", size)
+		}
+	}
+
+	if plan.SuccessThreshold == nil {
+		threshold := 1.0
+		plan.SuccessThreshold = &threshold
+	}
+	if *plan.SuccessThreshold < 0 || *plan.SuccessThreshold > 1 {
+		return errors.Errorf("success threshold %g is not between 0 and 1", *plan.SuccessThreshold)
+	}
+	if plan.FailureBudget < 0 {
+		return errors.New("failure budget cannot be negative")
+	}
+	if plan.Concurrency == 0 {
+		plan.Concurrency = rolloutDefaultConcurrency
+	}
+	if plan.Concurrency < 0 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if plan.Retries < 0 {
+		return errors.New("retries cannot be negative")
+	}
+	if plan.ScanDuration == 0 {
+		plan.ScanDuration = rolloutDefaultScanDuration
+	}
+	return nil
+}
+
+// loadPackages reads and verifies the firmware archive of each hardware
+// revision, so that a bad archive stops the rollout before it starts.
+func (plan *rolloutPlan) loadPackages(dir string, key *ecdsa.PublicKey) (map[string]*dfu.Package, error) {
+	packages := make(map[string]*dfu.Package)
+	for hardware, filename := range plan.Firmware {
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		pkg, err := dfu.OpenPackage(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read firmware archive '%s'", filename)
+		}
+		if !pkg.IsLegacy() {
+			if err = pkg.Verify(key); err != nil {
+				return nil, errors.Wrapf(err, "firmware verification of '%s' failed", filename)
+			}
+		}
+		packages[hardware] = pkg
+	}
+	return packages, nil
+}
+
+// resolveDevices returns the devices selected by the targets and assigns
+// them to waves. Devices selected by name are found by scanning.
+func (plan *rolloutPlan) resolveDevices(client ble.Client) ([]*rolloutDevice, error) {
+	var devices []*rolloutDevice
+	hardware := make(map[string]string)
+
+	add := func(address string, target *rolloutTarget) error {
+		key := strings.ToLower(address)
+		if previous, ok := hardware[key]; ok {
+			if previous != target.Hardware {
+				return errors.Errorf("device '%s' is targeted as both '%s' and '%s'", address, previous, target.Hardware)
+			}
+			return nil
+		}
+		hardware[key] = target.Hardware
+		devices = append(devices, &rolloutDevice{Address: address, Hardware: target.Hardware, Status: rolloutPending})
+		return nil
+	}
+
+	scan := false
+	for i := range plan.Targets {
+		target := &plan.Targets[i]
+		for _, address := range target.Addresses {
+			if err := add(address, target); err != nil {
+				return nil, err
+			}
+		}
+		scan = scan || target.namePattern != nil
+	}
+
+	if scan {
+		jww.INFO.Printf("Scanning for %s to find targets by name\n", plan.ScanDuration)
+		advertisements, err := ble.ScanDevices(client, plan.ScanDuration)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(advertisements, func(i, j int) bool {
+			return advertisements[i].Addr < advertisements[j].Addr
+		})
+		for i := range plan.Targets {
+			target := &plan.Targets[i]
+			if target.namePattern == nil {
+				continue
+			}
+			for _, adv := range advertisements {
+				if target.namePattern.MatchString(adv.Name) {
+					if err := add(adv.Addr, target); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New("no devices match the targets of the rollout plan")
+	}
+
+	for i, device := range devices {
+		device.Wave = plan.wave(i)
+	}
+	return devices, nil
+}
+
+// wave returns the wave, numbered from 1, of the device at index.
+func (plan *rolloutPlan) wave(index int) int {
+	if len(plan.Waves) == 0 {
+		return 1
+	}
+
+	wave := 1
+	for _, size := range plan.Waves {
+		if index < size {
+			return wave
+		}
+		index -= size
+		wave++
+	}
+	return wave + index/plan.Waves[len(plan.Waves)-1]
+}
+
+// checkState verifies that a saved rollout still matches the plan.
+func (plan *rolloutPlan) checkState(state *rolloutState) error {
+	for _, device := range state.Devices {
+		if _, ok := plan.Firmware[device.Hardware]; !ok {
+			return errors.Errorf("the rollout plan has no firmware for hardware '%s' of device '%s' in '%s'", device.Hardware, device.Address, state.filename)
+		}
+	}
+	return nil
+}
+
+// run updates the devices that are not done yet, wave by wave. A wave is
+// cancelled as soon as the failure budget is exceeded.
+func (plan *rolloutPlan) run(ctx context.Context, state *rolloutState, runner *batchRunner) error {
+	state.Halted = ""
+
+	for wave := 1; wave <= state.lastWave(); wave++ {
+		devices := state.wave(wave)
+		pending := []string{}
+		for _, device := range devices {
+			if device.Status != rolloutDone {
+				pending = append(pending, device.Address)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		waveCtx, cancelWave := context.WithCancel(ctx)
+		runner.finished = func(result *batchResult) {
+			// Devices that were interrupted did not fail, they are updated
+			// again when the rollout is resumed.
+			if result.Err != nil && waveCtx.Err() != nil {
+				return
+			}
+			failed, err := state.record(result)
+			if err != nil {
+				jww.ERROR.Println(err)
+			}
+			if failed > plan.FailureBudget {
+				cancelWave()
+			}
+		}
+
+		jww.INFO.Printf("Starting wave %d with %d devices\n", wave, len(pending))
+		runner.run(waveCtx, pending)
+		cancelWave()
+
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "rollout interrupted")
+		}
+
+		succeeded := 0
+		for _, device := range devices {
+			if device.Status == rolloutDone {
+				succeeded++
+			}
+		}
+		failed := state.failed()
+
+		var reason string
+		if failed > plan.FailureBudget {
+			reason = fmt.Sprintf("%d devices failed, exceeding the failure budget of %d", failed, plan.FailureBudget)
+		} else if rate := float64(succeeded) / float64(len(devices)); rate < *plan.SuccessThreshold {
+			reason = fmt.Sprintf("%.0f%% of wave %d succeeded, below the success threshold of %.0f%%", rate*100, wave, *plan.SuccessThreshold*100)
+		}
+		if reason != "" {
+			state.halt(reason)
+			if err := state.save(); err != nil {
+				return err
+			}
+			return errors.Errorf("rollout halted: %s", reason)
+		}
+	}
+
+	if failed := state.failed(); failed > 0 {
+		return errors.Errorf("rollout completed, %d devices failed to upgrade", failed)
+	}
+	return nil
+}
+
+func loadRolloutState(filename string) (*rolloutState, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read rollout state")
+	}
+
+	state := &rolloutState{filename: filename}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse rollout state '%s'", filename)
+	}
+	return state, nil
+}
+
+func (state *rolloutState) save() error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.write()
+}
+
+// write writes the state to a temporary file first, so that an interruption
+// cannot leave a truncated state file behind. The caller must hold the mutex.
+func (state *rolloutState) write() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode rollout state")
+	}
+
+	tmp := state.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write rollout state")
+	}
+	if err = os.Rename(tmp, state.filename); err != nil {
+		return errors.Wrap(err, "failed to write rollout state")
+	}
+	return nil
+}
+
+// record stores the result of a device and returns the number of devices
+// that failed.
+func (state *rolloutState) record(result *batchResult) (int, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	device := state.device(result.Address)
+	now := time.Now()
+	device.Attempts += result.Attempts
+	device.Updated = &now
+	if result.Err != nil {
+		device.Status = rolloutFailed
+		device.Error = result.Err.Error()
+	} else {
+		device.Status = rolloutDone
+		device.Error = ""
+	}
+	return state.countFailed(), state.write()
+}
+
+func (state *rolloutState) halt(reason string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Halted = reason
+}
+
+func (state *rolloutState) device(address string) *rolloutDevice {
+	for _, device := range state.Devices {
+		if device.Address == address {
+			return device
+		}
+	}
+	return nil
+}
+
+func (state *rolloutState) wave(wave int) []*rolloutDevice {
+	var devices []*rolloutDevice
+	for _, device := range state.Devices {
+		if device.Wave == wave {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+func (state *rolloutState) lastWave() int {
+	last := 0
+	for _, device := range state.Devices {
+		if device.Wave > last {
+			last = device.Wave
+		}
+	}
+	return last
+}
+
+func (state *rolloutState) failed() int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.countFailed()
+}
+
+func (state *rolloutState) countFailed() int {
+	failed := 0
+	for _, device := range state.Devices {
+		if device.Status == rolloutFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+func printRolloutSummary(out io.Writer, state *rolloutState) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "\nADDRESS\tHARDWARE\tWAVE\tSTATUS\tATTEMPTS\tERROR\n")
+	for _, device := range state.Devices {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n", device.Address, device.Hardware, device.Wave, device.Status, device.Attempts, device.Error)
+	}
+	if state.Halted != "" {
+		fmt.Fprintf(w, "\nHalted:\t%s\n", state.Halted)
+	}
+}
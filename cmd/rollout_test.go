@@ -0,0 +1,129 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+)
+
+func newTestRolloutState(t *testing.T, addresses ...string) (*rolloutState, func()) {
+	dir, err := ioutil.TempDir("", "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &rolloutState{filename: filepath.Join(dir, "state.json")}
+	for _, address := range addresses {
+		state.Devices = append(state.Devices, &rolloutDevice{Address: address, Hardware: rolloutDefaultHardware, Wave: 1, Status: rolloutPending})
+	}
+	return state, func() { os.RemoveAll(dir) }
+}
+
+func TestRolloutFailureBudget(t *testing.T) {
+	state, cleanup := newTestRolloutState(t, "bad-0", "good-0", "bad-1", "good-1", "good-2", "bad-2")
+	defer cleanup()
+
+	threshold := 0.0
+	plan := &rolloutPlan{FailureBudget: 1, SuccessThreshold: &threshold}
+
+	update := func(ctx context.Context, address string, progress dfu.DfuProgress) error {
+		if strings.HasPrefix(address, "bad") {
+			return errors.New("update failed")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	start := time.Now()
+	err := plan.run(context.Background(), state, &batchRunner{concurrency: len(state.Devices), update: update})
+	if err == nil || !strings.Contains(err.Error(), "failure budget") {
+		t.Fatalf("expected the rollout to halt, got %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("the wave was not cancelled when the failure budget was exceeded")
+	}
+
+	failed := 0
+	for _, device := range state.Devices {
+		switch {
+		case strings.HasPrefix(device.Address, "good") && device.Status != rolloutPending:
+			t.Errorf("interrupted device %s is %s, expected pending", device.Address, device.Status)
+		case device.Status == rolloutFailed:
+			failed++
+		}
+	}
+	if failed < 2 {
+		t.Errorf("%d devices failed, expected at least 2", failed)
+	}
+}
+
+func TestRolloutStateRecord(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 50; i++ {
+		addresses = append(addresses, fmt.Sprintf("device-%d", i))
+	}
+	state, cleanup := newTestRolloutState(t, addresses...)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			result := &batchResult{Address: address, Attempts: 1}
+			if i%10 == 0 {
+				result.Err = errors.New("update failed")
+			}
+			if _, err := state.record(result); err != nil {
+				t.Error(err)
+			}
+		}(i, address)
+	}
+	wg.Wait()
+
+	loaded, err := loadRolloutState(state.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := loaded.failed(); failed != 5 {
+		t.Errorf("%d devices failed, expected 5", failed)
+	}
+	for _, device := range loaded.Devices {
+		if device.Status == rolloutPending || device.Attempts != 1 {
+			t.Errorf("device %s is %s after %d attempts", device.Address, device.Status, device.Attempts)
+		}
+	}
+}
@@ -21,9 +21,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/ble/bluez"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 )
@@ -34,10 +40,17 @@ type Command interface {
 }
 
 type globalOptions struct {
-	Quiet bool
-	Debug bool
+	Quiet    bool
+	Debug    bool
+	Backend  string
+	Adapters []string
 }
 
+const (
+	backendGoBle = "go-ble"
+	backendBluez = "bluez"
+)
+
 type baseCommand struct {
 	cmd *cobra.Command
 	cli *Cli
@@ -56,6 +69,74 @@ func (c *baseCommand) AddCommand(command Command) {
 	c.cmd.AddCommand(childCmd)
 }
 
+// newBleClient creates a client for the BLE backend and adapter selected
+// with --backend and --adapter.
+func (c *baseCommand) newBleClient() (ble.Client, error) {
+	switch len(c.cli.Adapters) {
+	case 0:
+		return c.newAdapterClient("")
+	case 1:
+		return c.newAdapterClient(c.cli.Adapters[0])
+	}
+	return nil, errors.New("Multiple adapters specified. Only the batch and rollout commands can use more than one --adapter.")
+}
+
+// newBleClients creates a client for each adapter selected with --adapter.
+func (c *baseCommand) newBleClients() ([]ble.Client, error) {
+	if len(c.cli.Adapters) == 0 {
+		client, err := c.newAdapterClient("")
+		if err != nil {
+			return nil, err
+		}
+		return []ble.Client{client}, nil
+	}
+
+	var clients []ble.Client
+	seen := make(map[string]bool)
+	for _, adapter := range c.cli.Adapters {
+		if seen[adapter] {
+			return nil, errors.Errorf("Adapter '%s' specified more than once.", adapter)
+		}
+		seen[adapter] = true
+
+		client, err := c.newAdapterClient(adapter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot use adapter '%s'", adapter)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (c *baseCommand) newAdapterClient(adapter string) (ble.Client, error) {
+	switch c.cli.Backend {
+	case backendGoBle:
+		return ble.NewAdapterClient(adapter)
+	case backendBluez:
+		client, err := bluez.NewSystemClient(adapter)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	return nil, unknownBackend(c.cli.Backend)
+}
+
+// listAdapters returns the adapters that can be used with the selected backend.
+func (c *baseCommand) listAdapters() ([]ble.Adapter, error) {
+	switch c.cli.Backend {
+	case backendGoBle:
+		return ble.Adapters()
+	case backendBluez:
+		return bluez.SystemAdapters()
+	}
+	return nil, unknownBackend(c.cli.Backend)
+}
+
+func unknownBackend(backend string) error {
+	return errors.Errorf("Unknown backend '%s'. Use '%s' or '%s'.", backend, backendGoBle, backendBluez)
+}
+
 func newBaseCommand(cmd *cobra.Command) *baseCommand {
 	return &baseCommand{cmd: cmd}
 }
@@ -84,10 +165,19 @@ func NewCli() *Cli {
 
 	c.cmd.PersistentFlags().BoolVarP(&c.Quiet, "quiet", "q", false, "suppress all output")
 	c.cmd.PersistentFlags().BoolVarP(&c.Debug, "debug", "D", false, "produce debug output")
+	c.cmd.PersistentFlags().StringVar(&c.Backend, "backend", backendGoBle, "BLE backend: 'go-ble' (raw HCI on Linux) or 'bluez' (BlueZ D-Bus API)")
+	c.cmd.PersistentFlags().StringSliceVar(&c.Adapters, "adapter", nil, "Bluetooth adapter to use, e.g. hci1 (batch and rollout accept several)")
 
 	c.AddCommand(newScanCommand())
+	c.AddCommand(newAdaptersCommand())
 	c.AddCommand(newBootCommand())
 	c.AddCommand(newDfuCommand())
+	c.AddCommand(newBatchCommand())
+	c.AddCommand(newRolloutCommand())
+	c.AddCommand(newInfoCommand())
+	c.AddCommand(newInspectCommand())
+	c.AddCommand(newPkgCommand())
+	c.AddCommand(newKeysCommand())
 
 	return c
 }
@@ -107,6 +197,26 @@ func (c *Cli) InitLogging() {
 	}
 }
 
+// newSignalContext returns a context that is cancelled when the user
+// interrupts or terminates the program.
+func newSignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			jww.WARN.Println("Interrupted, aborting.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 func (c *Cli) Execute() {
 	if err := c.cmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -22,28 +22,72 @@ package cmd
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/rcaelers/nrf-dfu/dfu"
 	"github.com/spf13/cobra"
 )
 
 type scanCommand struct {
 	*baseCommand
 
-	duration time.Duration
+	duration  time.Duration
+	dfuOnly   bool
+	nameRegex string
+	minRssi   int
+	json      bool
+	csv       bool
 }
 
+type scanFilter struct {
+	dfuOnly     bool
+	namePattern *regexp.Regexp
+	minRssi     *int
+}
+
+type scanReport struct {
+	Address          string            `json:"address"`
+	Name             string            `json:"name"`
+	RSSI             int               `json:"rssi"`
+	TxPower          int               `json:"tx_power"`
+	Connectable      bool              `json:"connectable"`
+	Dfu              bool              `json:"dfu"`
+	Services         []string          `json:"services"`
+	ManufacturerData string            `json:"manufacturer_data,omitempty"`
+	ServiceData      map[string]string `json:"service_data,omitempty"`
+	FirstSeen        time.Time         `json:"first_seen"`
+	LastSeen         time.Time         `json:"last_seen"`
+	Advertisements   int               `json:"advertisements"`
+}
+
+const scanRefreshInterval = time.Second
+
 func newScanCommand() *scanCommand {
 	c := &scanCommand{}
 
 	c.baseCommand = newBaseCommand(&cobra.Command{
 		Use:   "scan",
 		Short: "Scan for BLUE devices",
+		Long: `This command scans for BLE devices and shows each device once, with the
+signal strength of its last advertisement. On a terminal the table is updated
+while scanning. Use --json or --csv to print the results when the scan ends.`,
 		Example: `nrf-dfu scan
-nrf-dfu scan --duration=30s`,
+nrf-dfu scan --duration=30s
+nrf-dfu scan --dfu-only --min-rssi -70
+nrf-dfu scan --name-regex '^Sensor' --json`,
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return c.runScan()
@@ -51,37 +95,175 @@ nrf-dfu scan --duration=30s`,
 	})
 
 	c.cmd.Flags().DurationVarP(&c.duration, "duration", "d", 30*time.Second, "Duration of the BLE scan")
+	c.cmd.Flags().BoolVar(&c.dfuOnly, "dfu-only", false, "Only show devices that advertise a DFU service")
+	c.cmd.Flags().StringVar(&c.nameRegex, "name-regex", "", "Only show devices with a name that matches the regular expression")
+	c.cmd.Flags().IntVar(&c.minRssi, "min-rssi", 0, "Only show devices with an RSSI of at least this value in dBm")
+	c.cmd.Flags().BoolVar(&c.json, "json", false, "Output in JSON format")
+	c.cmd.Flags().BoolVar(&c.csv, "csv", false, "Output in CSV format")
 
 	return c
 }
 
 func (c *scanCommand) runScan() error {
-	fmt.Printf("Scanning for BLE devices...\n")
+	if c.json && c.csv {
+		return errors.New("Both --json and --csv specified. Use only one of them.")
+	}
 
-	bleClient, err := ble.NewClient()
+	filter := &scanFilter{dfuOnly: c.dfuOnly}
+	if c.nameRegex != "" {
+		pattern, err := regexp.Compile(c.nameRegex)
+		if err != nil {
+			return errors.Wrap(err, "invalid --name-regex")
+		}
+		filter.namePattern = pattern
+	}
+	if c.cmd.Flags().Changed("min-rssi") {
+		filter.minRssi = &c.minRssi
+	}
+
+	bleClient, err := c.newBleClient()
 	if err != nil {
 		return errors.Wrap(err, "failed to create new BLE client")
 	}
 
-	err = bleClient.Scan(c.duration, func(adv ble.Advertisement) {
-		info := ""
-		for _, v := range adv.Services {
-			if v == "fe59" {
-				info = "[DFU Supported]"
+	live := !c.json && !c.csv && isTerminal(os.Stdout)
+	if !live {
+		fmt.Fprintf(os.Stderr, "Scanning for BLE devices...\n")
+	}
+
+	results := ble.NewScanResults()
+	done := make(chan error, 1)
+	go func() {
+		done <- bleClient.Scan(c.duration, results.Add)
+	}()
+
+	ticker := time.NewTicker(scanRefreshInterval)
+	defer ticker.Stop()
+
+	for scanning := true; scanning; {
+		select {
+		case err = <-done:
+			scanning = false
+		case <-ticker.C:
+			if live {
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("Scanning for BLE devices...\n\n")
+				printScanTable(os.Stdout, filter.apply(results.Devices()))
 			}
 		}
-		fmt.Printf("%s : %s %s\n", adv.Addr, adv.Name, info)
-	})
+	}
 
 	switch errors.Cause(err) {
 	case context.DeadlineExceeded:
-		return nil
+		err = nil
 	case context.Canceled:
-		fmt.Printf("Canceled..\n")
-		return nil
+		fmt.Fprintf(os.Stderr, "Canceled..\n")
+		err = nil
 	}
 	if err != nil {
 		return errors.Wrap(err, "failed to perform BLE scan")
 	}
+
+	reports := filter.apply(results.Devices())
+	switch {
+	case c.json:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	case c.csv:
+		return printScanCsv(os.Stdout, reports)
+	}
+
+	if live {
+		fmt.Print("\033[H\033[2J")
+	}
+	printScanTable(os.Stdout, reports)
 	return nil
 }
+
+// apply returns the devices that pass the filter, strongest signal first.
+func (f *scanFilter) apply(devices []ble.ScannedDevice) []*scanReport {
+	reports := []*scanReport{}
+	for i := range devices {
+		device := &devices[i]
+		supportsDfu := dfu.SupportsDfu(&device.Advertisement)
+
+		if f.dfuOnly && !supportsDfu {
+			continue
+		}
+		if f.namePattern != nil && !f.namePattern.MatchString(device.Name) {
+			continue
+		}
+		if f.minRssi != nil && device.RSSI < *f.minRssi {
+			continue
+		}
+
+		report := &scanReport{
+			Address:          device.Addr,
+			Name:             device.Name,
+			RSSI:             device.RSSI,
+			TxPower:          device.TxPower,
+			Connectable:      device.Connectable,
+			Dfu:              supportsDfu,
+			Services:         device.Services,
+			ManufacturerData: hex.EncodeToString(device.ManufacturerData),
+			FirstSeen:        device.FirstSeen,
+			LastSeen:         device.LastSeen,
+			Advertisements:   device.Advertisements,
+		}
+		for uuid, data := range device.ServiceData {
+			if report.ServiceData == nil {
+				report.ServiceData = make(map[string]string)
+			}
+			report.ServiceData[uuid] = hex.EncodeToString(data)
+		}
+		reports = append(reports, report)
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].RSSI > reports[j].RSSI
+	})
+	return reports
+}
+
+func printScanTable(out io.Writer, reports []*scanReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "ADDRESS\tNAME\tRSSI\tCONNECTABLE\tDFU\tLAST SEEN\tMANUFACTURER DATA\n")
+	for _, report := range reports {
+		dfuSupported := ""
+		if report.Dfu {
+			dfuSupported = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%s\t%s\t%s\n", report.Address, report.Name, report.RSSI, report.Connectable,
+			dfuSupported, report.LastSeen.Format("15:04:05"), report.ManufacturerData)
+	}
+}
+
+func printScanCsv(out io.Writer, reports []*scanReport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"address", "name", "rssi", "tx_power", "connectable", "dfu", "services", "manufacturer_data", "first_seen", "last_seen", "advertisements"})
+	for _, report := range reports {
+		w.Write([]string{
+			report.Address,
+			report.Name,
+			strconv.Itoa(report.RSSI),
+			strconv.Itoa(report.TxPower),
+			strconv.FormatBool(report.Connectable),
+			strconv.FormatBool(report.Dfu),
+			strings.Join(report.Services, " "),
+			report.ManufacturerData,
+			report.FirstSeen.Format(time.RFC3339),
+			report.LastSeen.Format(time.RFC3339),
+			strconv.Itoa(report.Advertisements),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
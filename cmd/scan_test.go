@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+func scanAddresses(reports []*scanReport) []string {
+	addresses := []string{}
+	for _, report := range reports {
+		addresses = append(addresses, report.Address)
+	}
+	return addresses
+}
+
+func TestScanFilter(t *testing.T) {
+	results := ble.NewScanResults()
+	results.Add(ble.Advertisement{Addr: "01", Name: "Sensor-1", RSSI: -70, Services: []string{"FE59"}})
+	results.Add(ble.Advertisement{Addr: "02", Name: "Sensor-2", RSSI: -50})
+	results.Add(ble.Advertisement{Addr: "03", Name: "DfuTarg", RSSI: -60, Services: []string{"00001530-1212-EFDE-1523-785FEABCD123"}})
+	results.Add(ble.Advertisement{Addr: "04", RSSI: -90, Services: []string{"fe59"}})
+	// The strongest signal of device 05 was seen before a weaker one.
+	results.Add(ble.Advertisement{Addr: "05", Name: "Sensor-5", RSSI: -40})
+	results.Add(ble.Advertisement{Addr: "05", RSSI: -80})
+	devices := results.Devices()
+
+	rssi := func(value int) *int {
+		return &value
+	}
+
+	tests := []struct {
+		name     string
+		filter   scanFilter
+		expected []string
+	}{
+		{"none", scanFilter{}, []string{"02", "03", "01", "05", "04"}},
+		{"dfu only", scanFilter{dfuOnly: true}, []string{"03", "01", "04"}},
+		{"name", scanFilter{namePattern: regexp.MustCompile("^Sensor-[12]$")}, []string{"02", "01"}},
+		{"unnamed", scanFilter{namePattern: regexp.MustCompile("^$")}, []string{"04"}},
+		{"min rssi", scanFilter{minRssi: rssi(-60)}, []string{"02", "03"}},
+		{"combined", scanFilter{dfuOnly: true, namePattern: regexp.MustCompile("Sensor"), minRssi: rssi(-75)}, []string{"01"}},
+	}
+
+	for _, test := range tests {
+		reports := test.filter.apply(devices)
+		if addresses := scanAddresses(reports); !reflect.DeepEqual(addresses, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, addresses, test.expected)
+		}
+	}
+}
+
+func TestScanReport(t *testing.T) {
+	results := ble.NewScanResults()
+	results.Add(ble.Advertisement{Addr: "01", RSSI: -70, Connectable: true, Services: []string{"fe59"}, ManufacturerData: []byte{0x59, 0x00, 0x01}})
+	results.Add(ble.Advertisement{Addr: "01", Name: "Sensor", RSSI: -65, TxPower: 4, ServiceData: map[string][]byte{"fe59": {0xAB}}})
+
+	reports := (&scanFilter{}).apply(results.Devices())
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports", len(reports))
+	}
+	report := reports[0]
+	if report.Name != "Sensor" || report.RSSI != -65 || report.TxPower != 4 || !report.Connectable || !report.Dfu || report.Advertisements != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.ManufacturerData != "590001" || !reflect.DeepEqual(report.ServiceData, map[string]string{"fe59": "ab"}) {
+		t.Errorf("unexpected data in report %+v", report)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	selectStrongest = "rssi"
+	selectFirst     = "first"
+	selectUnique    = "unique"
+)
+
+// deviceSelector finds the address of a device by its advertised name.
+type deviceSelector struct {
+	name         string
+	nameMatch    string
+	policy       string
+	scanDuration time.Duration
+}
+
+func (s *deviceSelector) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&s.name, "name", "n", "", "Name of the device")
+	cmd.Flags().StringVar(&s.nameMatch, "name-match", "", "Glob pattern, or regular expression between slashes, matching the name of the device")
+	cmd.Flags().StringVar(&s.policy, "select", selectUnique, "Device to use if several match: 'rssi' (strongest signal), 'first' (first seen) or 'unique' (fail)")
+	cmd.Flags().DurationVar(&s.scanDuration, "scan-duration", 5*time.Second, "Duration of the BLE scan used to find a device by name")
+}
+
+func (s *deviceSelector) enabled() bool {
+	return s.name != "" || s.nameMatch != ""
+}
+
+func (s *deviceSelector) description() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.nameMatch
+}
+
+func (s *deviceSelector) validate() error {
+	if s.name != "" && s.nameMatch != "" {
+		return errors.New("Both --name and --name-match specified. Use only one of them.")
+	}
+	switch s.policy {
+	case selectStrongest, selectFirst, selectUnique:
+	default:
+		return errors.Errorf("Invalid --select '%s'. Use 'rssi', 'first' or 'unique'.", s.policy)
+	}
+	_, err := s.matcher()
+	return err
+}
+
+func (s *deviceSelector) matcher() (func(string) bool, error) {
+	if s.name != "" {
+		return func(name string) bool { return name == s.name }, nil
+	}
+
+	pattern := s.nameMatch
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		pattern = pattern[1 : len(pattern)-1]
+	} else {
+		pattern = globToRegexp(pattern)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --name-match")
+	}
+	return re.MatchString, nil
+}
+
+// resolve scans for devices and returns the address of the selected one.
+func (s *deviceSelector) resolve(client ble.Client) (string, error) {
+	match, err := s.matcher()
+	if err != nil {
+		return "", err
+	}
+
+	jww.INFO.Printf("Scanning for %s to find device '%s'\n", s.scanDuration, s.description())
+	devices, err := ble.ScanDevices(client, s.scanDuration)
+	if err != nil {
+		return "", err
+	}
+
+	device, err := selectDevice(devices, match, s.policy)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot select device '%s'", s.description())
+	}
+	jww.INFO.Printf("Selected device '%s' (%s, RSSI %d)\n", device.Name, device.Addr, device.RSSI)
+	return device.Addr, nil
+}
+
+func selectDevice(devices []ble.ScannedDevice, match func(string) bool, policy string) (*ble.ScannedDevice, error) {
+	var matches []*ble.ScannedDevice
+	for i := range devices {
+		if devices[i].Name != "" && match(devices[i].Name) {
+			matches = append(matches, &devices[i])
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.New("no matching device found")
+	}
+
+	// Devices are ordered by the time they were first seen, and ties are
+	// broken on address, so the choice does not depend on map ordering.
+	selected := matches[0]
+	switch policy {
+	case selectStrongest:
+		for _, device := range matches[1:] {
+			if device.RSSI > selected.RSSI {
+				selected = device
+			}
+		}
+	case selectUnique:
+		if len(matches) > 1 {
+			var found []string
+			for _, device := range matches {
+				found = append(found, device.Name+" ("+device.Addr+")")
+			}
+			return nil, errors.Errorf("%d devices match: %s", len(matches), strings.Join(found, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// globToRegexp converts a glob pattern with '*' and '?' wildcards into an
+// anchored regular expression.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
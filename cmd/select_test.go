@@ -0,0 +1,147 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+func TestSelectDevicePolicies(t *testing.T) {
+	// Devices in the order they were first seen.
+	devices := []ble.ScannedDevice{
+		{Advertisement: ble.Advertisement{Addr: "01", Name: "Sensor-1", RSSI: -70}},
+		{Advertisement: ble.Advertisement{Addr: "02", Name: "Sensor-2", RSSI: -50}},
+		{Advertisement: ble.Advertisement{Addr: "03", Name: "Sensor-3", RSSI: -50}},
+		{Advertisement: ble.Advertisement{Addr: "04", RSSI: -30}},
+		{Advertisement: ble.Advertisement{Addr: "05", Name: "Other", RSSI: -20}},
+	}
+
+	tests := []struct {
+		name     string
+		pattern  string
+		policy   string
+		expected string
+		err      string
+	}{
+		{"strongest", "Sensor-*", selectStrongest, "02", ""},
+		{"strongest of one", "Sensor-1", selectStrongest, "01", ""},
+		{"first", "Sensor-*", selectFirst, "01", ""},
+		{"brackets are literal", "Sensor-[23]", selectFirst, "", "no matching device"},
+		{"unique", "Sensor-3", selectUnique, "03", ""},
+		{"unique with several matches", "Sensor-?", selectUnique, "", "3 devices match: Sensor-1 (01), Sensor-2 (02), Sensor-3 (03)"},
+		{"unnamed devices never match", "*", selectStrongest, "05", ""},
+		{"no match", "Missing*", selectFirst, "", "no matching device"},
+	}
+
+	for _, test := range tests {
+		selector := &deviceSelector{nameMatch: test.pattern, policy: test.policy}
+		match, err := selector.matcher()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		device, err := selectDevice(devices, match, test.policy)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if device.Addr != test.expected {
+			t.Errorf("%s: selected %s, expected %s", test.name, device.Addr, test.expected)
+		}
+	}
+}
+
+func TestSelectDeviceTies(t *testing.T) {
+	devices := []ble.ScannedDevice{
+		{Advertisement: ble.Advertisement{Addr: "01", Name: "Sensor", RSSI: -60}},
+		{Advertisement: ble.Advertisement{Addr: "02", Name: "Sensor", RSSI: -40}},
+		{Advertisement: ble.Advertisement{Addr: "03", Name: "Sensor", RSSI: -40}},
+	}
+	match := func(name string) bool { return name == "Sensor" }
+
+	// The device seen first wins a tie, however often the choice is made.
+	for i := 0; i < 10; i++ {
+		device, err := selectDevice(devices, match, selectStrongest)
+		if err != nil || device.Addr != "02" {
+			t.Fatalf("selected %v, %v", device, err)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		regexp  string
+		matches []string
+		misses  []string
+	}{
+		{"Sensor*", `^Sensor.*$`, []string{"Sensor", "Sensor-12"}, []string{"sensor", "My Sensor"}},
+		{"Node-??", `^Node-..$`, []string{"Node-01"}, []string{"Node-1", "Node-123"}},
+		{"v1.2", `^v1\.2$`, []string{"v1.2"}, []string{"v1x2", "v1.23"}},
+		{"C++ Node*", `^C\+\+ Node.*$`, []string{"C++ Node", "C++ Node 7"}, []string{"CC Node", "C+ Node"}},
+		{"*.local", `^.*\.local$`, []string{"printer.local", ".local"}, []string{"printerxlocal"}},
+		{"[a]", `^\[a\]$`, []string{"[a]"}, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		if re := globToRegexp(test.glob); re != test.regexp {
+			t.Errorf("%s: got %s, expected %s", test.glob, re, test.regexp)
+		}
+
+		match, err := (&deviceSelector{nameMatch: test.glob}).matcher()
+		if err != nil {
+			t.Fatalf("%s: %v", test.glob, err)
+		}
+		for _, name := range test.matches {
+			if !match(name) {
+				t.Errorf("%s does not match %q", test.glob, name)
+			}
+		}
+		for _, name := range test.misses {
+			if match(name) {
+				t.Errorf("%s matches %q", test.glob, name)
+			}
+		}
+	}
+}
+
+func TestNameMatchRegexp(t *testing.T) {
+	match, err := (&deviceSelector{nameMatch: "/^Sensor-[12]$/"}).matcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match("Sensor-1") || match("Sensor-3") || match("My Sensor-1") {
+		t.Error("regular expression between slashes is not used as is")
+	}
+
+	if _, err := (&deviceSelector{nameMatch: "/Sensor-[/"}).matcher(); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu"
+	"github.com/spf13/cobra"
+)
+
+// verifyOptions configures the check that a device runs the new firmware
+// after an update.
+type verifyOptions struct {
+	verify           bool
+	delay            time.Duration
+	firmwareRevision string
+}
+
+func (o *verifyOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&o.verify, "verify", false, "Reconnect after the update and check that the device left the bootloader")
+	cmd.Flags().DurationVar(&o.delay, "verify-delay", dfu.DefaultVerifyDelay, "Time the device is given to start the new firmware before reconnecting")
+	cmd.Flags().StringVar(&o.firmwareRevision, "expect-revision", "", "Firmware revision the Device Information Service must report after the update (implies --verify)")
+}
+
+func (o *verifyOptions) enabled() bool {
+	return o.verify || o.firmwareRevision != ""
+}
+
+// verification validates the options and returns the verification they
+// describe, or nil if verification is disabled.
+func (o *verifyOptions) verification() (*dfu.Verification, error) {
+	if o.delay < 0 {
+		return nil, errors.New("--verify-delay cannot be negative.")
+	}
+	if !o.enabled() {
+		return nil, nil
+	}
+	return &dfu.Verification{Delay: o.delay, FirmwareRevision: o.firmwareRevision}, nil
+}
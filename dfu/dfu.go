@@ -21,13 +21,13 @@
 package dfu
 
 import (
-	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"encoding/binary"
 	"hash/crc32"
-	"io/ioutil"
 	"math/rand"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -40,27 +40,42 @@ type DfuProgress func(value int64, maxValue int64, info string)
 type FirmwareUpdater interface {
 	SetDeviceAddress(address string)
 	SetDeviceName(name string)
-	Update(filename string, progress DfuProgress) error
-	EnterBootloader() error
+	SetPacketReceiptNotification(prn uint16)
+	SetMTU(mtu int)
+	SetResponseTimeout(timeout time.Duration)
+	SetPublicKey(key *ecdsa.PublicKey)
+	SetRetryPolicy(policy RetryPolicy)
+	SetVerification(verification *Verification)
+	Update(ctx context.Context, filename string, progress DfuProgress) error
+	UpdatePackage(ctx context.Context, pkg *Package, progress DfuProgress) error
+	EnterBootloader(ctx context.Context) error
+	Info(ctx context.Context, enterBootloader bool) (*DeviceInfo, error)
 }
 
 type Dfu struct {
 	client     ble.Client
 	peripheral ble.Peripheral
 
-	packet  ble.Characteristic
-	control ble.Characteristic
-	boot    ble.Characteristic
+	transport dfuTransport
+	boot      ble.Characteristic
 
 	name            string
 	address         string
 	addressChange   bool
-	responseChannel chan []byte
+	bootloaderName  string
+	responses       responseQueue
 	timeout         time.Duration
+	responseTimeout time.Duration
+	prn             uint16
+	mtu             int
+	retryPolicy     RetryPolicy
+	verification    *Verification
 
-	firmwareZipFile *zip.ReadCloser
-	initDataFile    *zip.File
-	firmwareFile    *zip.File
+	port     string
+	baudRate int
+
+	pkg       *Package
+	publicKey *ecdsa.PublicKey
 
 	progress         DfuProgress
 	maxProgressValue int64
@@ -98,6 +113,12 @@ const (
 	DFU_RESULT_UNSUPPORTED_TYPE           dfuResult = 0x07
 	DFU_RESULT_DFUOPERATION_NOT_PERMITTED dfuResult = 0x08
 	DFU_RESULT_DFUOPERATION_FAILED        dfuResult = 0x0A
+	DFU_RESULT_EXT_ERROR                  dfuResult = 0x0B
+)
+
+const (
+	dfuObjectCommand byte = 0x01
+	dfuObjectData    byte = 0x02
 )
 
 const (
@@ -119,65 +140,149 @@ type ChecksumResponse struct {
 	Crc32  uint32
 }
 
+const DefaultPacketReceiptNotification = 10
+
+// Largest ATT MTU supported by the Secure DFU bootloader.
+const DefaultMTU = 247
+
+const DefaultResponseTimeout = 10 * time.Second
+
+const responseChannelSize = 16
+
+// SupportsDfu reports whether a device advertises the Secure DFU or legacy
+// DFU service.
+func SupportsDfu(adv *ble.Advertisement) bool {
+	return adv.HasService(dfuServiceUUID) || adv.HasService(legacyDfuServiceUUID)
+}
+
 func NewDfu(bleClient ble.Client, timeout time.Duration) FirmwareUpdater {
 	dfu := new(Dfu)
-	dfu.responseChannel = make(chan []byte)
+	dfu.responses = newResponseQueue()
 	dfu.client = bleClient
 	dfu.timeout = timeout
+	dfu.responseTimeout = DefaultResponseTimeout
+	dfu.prn = DefaultPacketReceiptNotification
+	dfu.mtu = DefaultMTU
+	dfu.retryPolicy = DefaultRetryPolicy
 	return dfu
 }
 
-func (dfu *Dfu) sendControl(opcode dfuOperation, request []byte) (response []byte, err error) {
+type responseQueue chan []byte
+
+func newResponseQueue() responseQueue {
+	return make(responseQueue, responseChannelSize)
+}
+
+func (q responseQueue) push(data []byte) {
+	select {
+	case q <- data:
+	default:
+		jww.WARN.Printf("Dropping unexpected response % x\n", data)
+	}
+}
+
+// drain discards responses that arrived too late for the request they
+// belong to, so they cannot be mistaken for the response to the next one.
+func (q responseQueue) drain() {
+	for {
+		select {
+		case data := <-q:
+			jww.DEBUG.Printf("Discarding stale response % x\n", data)
+		default:
+			return
+		}
+	}
+}
+
+func (q responseQueue) wait(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-q:
+		return response, nil
+	case <-timer.C:
+		return nil, ErrResponseTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (dfu *Dfu) sendControl(ctx context.Context, opcode dfuOperation, request []byte) (response []byte, err error) {
+	dfu.responses.drain()
+
 	data := append([]byte{byte(opcode)}, request...)
-	err = dfu.control.WriteCharacteristic(data, ble.WithResponse)
+	err = dfu.transport.WriteControl(data)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to write to control characteristic")
+		return nil, err
 	}
 
-	response = <-dfu.responseChannel
+	return dfu.receiveResponse(ctx, opcode)
+}
+
+func (dfu *Dfu) receiveResponse(ctx context.Context, opcode dfuOperation) (response []byte, err error) {
+	response, err = dfu.responses.wait(ctx, dfu.responseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 3 {
+		return nil, errors.New("Received truncated response")
+	}
 
 	responseCode := dfuOperation(response[0])
 	responseOpCode := dfuOperation(response[1])
 	resultCode := dfuResult(response[2])
 
 	if responseCode != DFU_OP_RESPONSE {
-		return nil, errors.Wrap(err, "Received incorrect response code")
+		return nil, errors.Errorf("Received incorrect response code 0x%02X", byte(responseCode))
 	}
 	if responseOpCode != opcode {
-		return nil, errors.Wrap(err, "Received response for incorrect operation")
+		return nil, errors.Errorf("Received response for %s instead of %s", responseOpCode, opcode)
 	}
 	if resultCode != DFU_RESULT_SUCCESS {
-		return nil, errors.Wrap(err, "DFU control operation failed")
+		protocolError := &ProtocolError{Opcode: opcode, Result: resultCode}
+		if resultCode == DFU_RESULT_EXT_ERROR && len(response) > 3 {
+			protocolError.ExtendedError = dfuExtError(response[3])
+		}
+		return nil, protocolError
 	}
 
-	return response[3:], err
+	return response[3:], nil
 }
 
-func (dfu *Dfu) sendBoot(request []byte) (err error) {
+func (dfu *Dfu) sendBoot(ctx context.Context, request []byte) (err error) {
+	dfu.responses.drain()
+
 	err = dfu.boot.WriteCharacteristic(request, ble.WithResponse)
 	if err != nil {
-		return errors.Wrap(err, "failed to set advertisment name")
+		return errors.Wrap(err, "failed to write to buttonless characteristic")
 	}
 
-	response := <-dfu.responseChannel
+	response, err := dfu.responses.wait(ctx, dfu.responseTimeout)
+	if err != nil {
+		return err
+	}
+	if len(response) < 3 {
+		return errors.New("Received truncated response")
+	}
 	responseCode := response[0]
 	responseOpCode := response[1]
-	resultCode := dfuResult(response[2])
+	resultCode := buttonlessResult(response[2])
 
 	if responseCode != 0x20 {
-		return errors.Wrap(err, "Received incorrect response code")
+		return errors.Errorf("Received incorrect response code 0x%02X", responseCode)
 	}
 	if responseOpCode != request[0] {
-		return errors.Wrap(err, "Received response for incorrect operation")
+		return errors.Errorf("Received response for operation 0x%02X instead of 0x%02X", responseOpCode, request[0])
 	}
-	if resultCode != DFU_RESULT_SUCCESS {
-		return errors.Wrap(err, "DFU control operation failed")
+	if resultCode != BUTTONLESS_RESULT_SUCCESS {
+		return &ButtonlessError{Opcode: request[0], Result: resultCode}
 	}
 
 	return nil
 }
 
-func (dfu *Dfu) sendBootloaderAdvName(name string) error {
+func (dfu *Dfu) sendBootloaderAdvName(ctx context.Context, name string) error {
 	buf := bytes.NewBuffer([]byte{})
 	err := binary.Write(buf, binary.LittleEndian, byte(0x02))
 	if err != nil {
@@ -192,7 +297,7 @@ func (dfu *Dfu) sendBootloaderAdvName(name string) error {
 		return errors.Wrap(err, "failed to write buffer")
 	}
 
-	err = dfu.sendBoot(buf.Bytes())
+	err = dfu.sendBoot(ctx, buf.Bytes())
 	if err != nil {
 		return errors.Wrap(err, "failed to send bootloader advertisment name command")
 	}
@@ -200,42 +305,76 @@ func (dfu *Dfu) sendBootloaderAdvName(name string) error {
 
 }
 
-func (dfu *Dfu) sendEnterBootloader() error {
-	err := dfu.sendBoot([]byte{0x01})
+func (dfu *Dfu) sendEnterBootloader(ctx context.Context) error {
+	err := dfu.sendBoot(ctx, []byte{0x01})
 	if err != nil {
 		return errors.Wrap(err, "failed to send enter bootloader command")
 	}
 	return nil
 }
 
-func (dfu *Dfu) sendData(data []byte) error {
-	var err error = nil
-	chunkSize := 20
+// sendData writes an object in packet sized chunks. Offset and crc describe
+// the data the device received before this object. If packet receipt
+// notifications are enabled, the running CRC is verified every prn packets.
+func (dfu *Dfu) sendData(ctx context.Context, data []byte, offset int, crc uint32) (uint32, error) {
+	chunkSize := dfu.transport.DataChunkSize()
+	packets := 0
 
 	for i := 0; i < len(data); i += chunkSize {
+		if err := ctx.Err(); err != nil {
+			return crc, err
+		}
+
 		end := i + chunkSize
 
 		if end > len(data) {
 			end = len(data)
 		}
 
-		err = dfu.packet.WriteCharacteristic(data[i:end], ble.NoResponse)
+		err := dfu.transport.WriteData(data[i:end])
 		if err != nil {
-			return errors.Wrap(err, "failed to write to packet characteristic")
+			return crc, err
 		}
+		crc = crc32.Update(crc, crc32.IEEETable, data[i:end])
 
 		dfu.updateProgress(int64(end - i))
 
-		// TODO: Fix BLE library to wait for ack on macOS
-		time.Sleep(10 * time.Millisecond)
+		packets++
+		if dfu.prn != 0 && packets%int(dfu.prn) == 0 {
+			err = dfu.receiveReceipt(ctx, offset+end, crc)
+			if err != nil {
+				return crc, errors.Wrap(err, "packet receipt verification failed")
+			}
+		}
 	}
-	return err
+	return crc, nil
+}
+
+func (dfu *Dfu) receiveReceipt(ctx context.Context, offset int, crc uint32) error {
+	response, err := dfu.receiveResponse(ctx, DFU_OP_CRC_GET)
+	if err != nil {
+		return errors.Wrap(err, "failed to receive packet receipt notification")
+	}
+
+	var checksumResponse ChecksumResponse
+	buf := bytes.NewReader(response)
+	if err := binary.Read(buf, binary.LittleEndian, &checksumResponse); err != nil {
+		return errors.Wrap(err, "failed to unpack packet receipt notification")
+	}
+
+	if checksumResponse.Offset != uint32(offset) {
+		return withClass(ErrorClassChecksum, errors.Errorf("Size mismatch %d != %d", checksumResponse.Offset, offset))
+	}
+	if checksumResponse.Crc32 != crc {
+		return withClass(ErrorClassChecksum, errors.Errorf("CRC mismatch %d != %d", checksumResponse.Crc32, crc))
+	}
+	return nil
 }
 
-func (dfu *Dfu) sendSelect(selectCode byte) (SelectResponse, error) {
+func (dfu *Dfu) sendSelect(ctx context.Context, selectCode byte) (SelectResponse, error) {
 	var selectResponse SelectResponse
 
-	response, err := dfu.sendControl(DFU_OP_OBJECT_SELECT, []byte{selectCode})
+	response, err := dfu.sendControl(ctx, DFU_OP_OBJECT_SELECT, []byte{selectCode})
 	if err != nil {
 		return selectResponse, errors.Wrap(err, "failed to send select command")
 	}
@@ -248,23 +387,23 @@ func (dfu *Dfu) sendSelect(selectCode byte) (SelectResponse, error) {
 	return selectResponse, err
 }
 
-func (dfu *Dfu) sendCreateObject(controlType byte, length uint32) error {
+func (dfu *Dfu) sendCreateObject(ctx context.Context, controlType byte, length uint32) error {
 	header := []byte{controlType}
 	len_data := make([]byte, 4)
 	binary.LittleEndian.PutUint32(len_data, length)
 	data := append(header, len_data...)
 
-	_, err := dfu.sendControl(DFU_OP_OBJECT_CREATE, data)
+	_, err := dfu.sendControl(ctx, DFU_OP_OBJECT_CREATE, data)
 	if err != nil {
 		return errors.Wrap(err, "failed to send create object command")
 	}
 	return err
 }
 
-func (dfu *Dfu) sendCrcGet() (ChecksumResponse, error) {
+func (dfu *Dfu) sendCrcGet(ctx context.Context) (ChecksumResponse, error) {
 	var checksumResponse ChecksumResponse
 
-	response, err := dfu.sendControl(DFU_OP_CRC_GET, []byte{})
+	response, err := dfu.sendControl(ctx, DFU_OP_CRC_GET, []byte{})
 	if err != nil {
 		return checksumResponse, errors.Wrap(err, "failed to send crc get command")
 	}
@@ -277,18 +416,18 @@ func (dfu *Dfu) sendCrcGet() (ChecksumResponse, error) {
 	return checksumResponse, err
 }
 
-func (dfu *Dfu) sendNotify(num uint16) error {
+func (dfu *Dfu) sendNotify(ctx context.Context, num uint16) error {
 	notify_data := make([]byte, 2)
 	binary.LittleEndian.PutUint16(notify_data, num)
-	_, err := dfu.sendControl(DFU_OP_RECEIPT_NOTIF_SET, notify_data)
+	_, err := dfu.sendControl(ctx, DFU_OP_RECEIPT_NOTIF_SET, notify_data)
 	if err != nil {
 		return errors.Wrap(err, "failed to send notify command")
 	}
 	return err
 }
 
-func (dfu *Dfu) sendExecute() error {
-	_, err := dfu.sendControl(DFU_OP_OBJECT_EXECUTE, []byte{})
+func (dfu *Dfu) sendExecute(ctx context.Context) error {
+	_, err := dfu.sendControl(ctx, DFU_OP_OBJECT_EXECUTE, []byte{})
 	if err != nil {
 		return errors.Wrap(err, "failed to send execute command")
 	}
@@ -302,30 +441,20 @@ func (dfu *Dfu) updateProgress(increment int64) {
 	}
 }
 
-func (dfu *Dfu) readFirmwareArchive(filename string) error {
-	firmwareZipFile, err := zip.OpenReader(filename)
+func (dfu *Dfu) preparePackage(pkg *Package) error {
+	err := pkg.Verify(dfu.publicKey)
 	if err != nil {
-		return errors.Wrap(err, "Cannot open zip")
+		return errors.Wrap(err, "firmware verification failed")
 	}
 
-	dfu.firmwareZipFile = firmwareZipFile
-
-	for _, f := range firmwareZipFile.File {
-		if strings.HasSuffix(f.Name, ".dat") {
-			dfu.initDataFile = f
-			dfu.maxProgressValue += int64(f.UncompressedSize64)
-		}
-
-		if strings.HasSuffix(f.Name, ".bin") {
-			dfu.firmwareFile = f
-			dfu.maxProgressValue += int64(f.UncompressedSize64)
-		}
-	}
-	return err
+	dfu.pkg = pkg
+	dfu.progressValue = 0
+	dfu.maxProgressValue = pkg.Size()
+	return nil
 }
 
-func (dfu *Dfu) verifyCrc(data []byte, end int) error {
-	checksumResponse, err := dfu.sendCrcGet()
+func (dfu *Dfu) verifyCrc(ctx context.Context, data []byte, end int) error {
+	checksumResponse, err := dfu.sendCrcGet(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to compute checksum")
 	}
@@ -333,91 +462,212 @@ func (dfu *Dfu) verifyCrc(data []byte, end int) error {
 	checksum := crc32.ChecksumIEEE(data[0:end])
 
 	if checksumResponse.Offset != uint32(end) {
-		return errors.Wrapf(err, "Size mismatch %d != %d\n", checksumResponse.Offset, end)
+		return withClass(ErrorClassChecksum, errors.Errorf("Size mismatch %d != %d", checksumResponse.Offset, end))
 	}
 	if checksumResponse.Crc32 != checksum {
-		return errors.Wrapf(err, "CRC mismatch %d != %d\n", checksumResponse.Crc32, checksum)
+		return withClass(ErrorClassChecksum, errors.Errorf("CRC mismatch %d != %d", checksumResponse.Crc32, checksum))
 	}
-	return err
+	return nil
 }
 
-func (dfu *Dfu) transfer(objectType byte, file *zip.File) (err error) {
-	rc, err := file.Open()
-	if err != nil {
-		return errors.Wrap(err, "failed to open firmware archive")
+// resume determines the offset from which an interrupted transfer can
+// continue, using the offset and CRC of the data the device already holds.
+// Only whole objects are resumed: a partially received object is created
+// again, and all preceding objects are executed.
+func (dfu *Dfu) resume(ctx context.Context, objectType byte, data []byte, selectResponse SelectResponse) (int, error) {
+	offset := int(selectResponse.Offset)
+	maxSize := int(selectResponse.MaxSize)
+
+	if offset == 0 || offset > len(data) {
+		return 0, nil
+	}
+
+	remainder := offset % maxSize
+	if crc32.ChecksumIEEE(data[:offset]) != selectResponse.Crc32 {
+		if objectType == dfuObjectCommand {
+			return 0, nil
+		}
+
+		// Executed objects were verified, so only the last object can be corrupt.
+		if remainder == 0 {
+			remainder = maxSize
+		}
+		jww.INFO.Printf("Discarding invalid data at offset %d.\n", offset-remainder)
+		return offset - remainder, nil
+	}
+
+	if objectType == dfuObjectCommand && offset != len(data) {
+		return 0, nil
 	}
-	defer rc.Close()
 
-	// TODO: read on demand
-	data, err := ioutil.ReadAll(rc)
+	if remainder != 0 && offset != len(data) {
+		return offset - remainder, nil
+	}
+
+	// The last object was received completely, but may not have been executed yet.
+	err := dfu.sendExecute(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to read firmware archive")
+		return 0, errors.Wrap(err, "failed to execute received object")
 	}
+	return offset, nil
+}
 
+func (dfu *Dfu) transfer(ctx context.Context, objectType byte, data []byte) (err error) {
 	size := len(data)
-	checksum := crc32.ChecksumIEEE(data)
 
-	selectReponse, err := dfu.sendSelect(objectType)
+	selectReponse, err := dfu.sendSelect(ctx, objectType)
+	if err != nil {
+		return errors.Wrap(err, "failed to select object")
+	}
 	maxChunkSize := int(selectReponse.MaxSize)
+	if maxChunkSize == 0 {
+		return errors.New("device reported invalid maximum object size")
+	}
 
-	if selectReponse.Offset == uint32(size) && selectReponse.Crc32 == checksum {
-		// Already uploaded
-		return
+	offset, err := dfu.resume(ctx, objectType, data, selectReponse)
+	if err != nil {
+		return errors.Wrap(err, "failed to resume transfer")
+	}
+	if offset > 0 {
+		jww.INFO.Printf("Resuming transfer at offset %d of %d.\n", offset, size)
+		dfu.updateProgress(int64(offset))
 	}
 
-	for i := 0; i < size; i += maxChunkSize {
+	crc := crc32.ChecksumIEEE(data[:offset])
+	for i := offset; i < size; i += maxChunkSize {
 		end := i + maxChunkSize
 
 		if end > len(data) {
 			end = len(data)
 		}
-		chunkSize := end - i
 
-		err = dfu.sendCreateObject(objectType, uint32(chunkSize))
+		progress := dfu.progressValue
+		var failure error
+		err = dfu.retryPolicy.do(ctx, "send object", func(attempt int) error {
+			if attempt > 1 {
+				failure = dfu.prepareResend(ctx, failure)
+				if failure != nil {
+					return failure
+				}
+				dfu.progressValue = progress
+				received, err := dfu.objectReceived(ctx, objectType, data[:end])
+				if err != nil {
+					failure = err
+					return err
+				}
+				if received {
+					dfu.updateProgress(int64(end - i))
+					return nil
+				}
+			}
+			failure = dfu.sendObject(ctx, objectType, data, i, end, crc)
+			return failure
+		})
 		if err != nil {
-			return errors.Wrap(err, "failed to create object")
+			return err
 		}
+		crc = crc32.Update(crc, crc32.IEEETable, data[i:end])
+	}
+	return
+}
 
-		err = dfu.sendData(data[i:end])
-		if err != nil {
-			return errors.Wrap(err, "failed to write object")
-		}
+// sendObject creates, sends and executes the object with the data from start
+// to end. Crc is the CRC of the data before start.
+func (dfu *Dfu) sendObject(ctx context.Context, objectType byte, data []byte, start int, end int, crc uint32) error {
+	err := dfu.sendCreateObject(ctx, objectType, uint32(end-start))
+	if err != nil {
+		return errors.Wrap(err, "failed to create object")
+	}
 
-		err = dfu.verifyCrc(data, end)
-		if err != nil {
-			return errors.Wrap(err, "verification failed")
-		}
+	_, err = dfu.sendData(ctx, data[start:end], start, crc)
+	if err != nil {
+		return errors.Wrap(err, "failed to write object")
+	}
 
-		err = dfu.sendExecute()
-		if err != nil {
-			return errors.Wrap(err, "failed to execute")
-		}
+	err = dfu.verifyCrc(ctx, data, end)
+	if err != nil {
+		return errors.Wrap(err, "verification failed")
 	}
-	return
+
+	err = dfu.sendExecute(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute")
+	}
+	return nil
 }
 
-func (dfu *Dfu) connect() (err error) {
-	if dfu.address != "" {
-		jww.INFO.Printf("Connecting to '%s'\n", dfu.address)
-		dfu.peripheral, err = dfu.client.ConnectAddress(dfu.address, dfu.timeout)
-	} else {
-		jww.INFO.Printf("Connecting to '%s'\n", dfu.name)
-		dfu.peripheral, err = dfu.client.ConnectName(dfu.name, dfu.timeout)
+// prepareResend restores the connection to the bootloader if the previous
+// attempt to send an object failed because the connection was lost.
+func (dfu *Dfu) prepareResend(ctx context.Context, failure error) error {
+	switch ClassOf(failure) {
+	case ErrorClassTransport, ErrorClassConnect, ErrorClassDiscovery:
+	default:
+		return nil
+	}
+
+	err := dfu.waitForBootloader(ctx)
+	if err != nil {
+		return err
+	}
+	err = dfu.transport.Subscribe(dfu.responses.push)
+	if err != nil {
+		return err
+	}
+	err = dfu.transport.handshake(ctx, dfu)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize transport")
+	}
+	err = dfu.sendNotify(ctx, dfu.prn)
+	if err != nil {
+		return errors.Wrap(err, "failed to set packet receipt notification")
+	}
+	return nil
+}
+
+// objectReceived reports whether the last object of data was received and
+// executed by the device after all, so that it does not have to be sent
+// again after a failure.
+func (dfu *Dfu) objectReceived(ctx context.Context, objectType byte, data []byte) (bool, error) {
+	selectResponse, err := dfu.sendSelect(ctx, objectType)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to select object")
 	}
 
+	offset, err := dfu.resume(ctx, objectType, data, selectResponse)
 	if err != nil {
-		return errors.Wrap(err, "failed to connect to device")
+		return false, errors.Wrap(err, "failed to resume transfer")
+	}
+	return offset == len(data), nil
+}
+
+func (dfu *Dfu) connect(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if dfu.port != "" {
+		return dfu.connectSerial(ctx)
+	}
+
+	err = dfu.connectPeripheral()
+	if err != nil {
+		return err
 	}
 
 	service := dfu.peripheral.FindService(dfuServiceUUID)
 	if service == nil {
-		return errors.Wrap(err, "DFU Service not found")
+		if dfu.peripheral.FindService(legacyDfuServiceUUID) != nil {
+			return errLegacyDfu
+		}
+		return withClass(ErrorClassDiscovery, errors.New("DFU Service not found"))
 	}
 
-	dfu.control = service.FindCharacteristic(dfuControlPointUUID)
-	dfu.packet = service.FindCharacteristic(dfuPacketUUID)
+	control := service.FindCharacteristic(dfuControlPointUUID)
+	packet := service.FindCharacteristic(dfuPacketUUID)
 
-	if dfu.control == nil || dfu.packet == nil {
+	if control != nil && packet != nil {
+		dfu.transport = newBleTransport(control, packet, dfu.exchangeMTU())
+	} else {
 		dfu.addressChange = false
 		dfu.boot = service.FindCharacteristic(dfuButtonlessBondedUUID)
 		if dfu.boot != nil {
@@ -430,45 +680,126 @@ func (dfu *Dfu) connect() (err error) {
 			}
 		}
 		if dfu.boot == nil {
-			return errors.Wrap(err, "No DFU characteristics found")
+			return withClass(ErrorClassDiscovery, errors.New("No DFU characteristics found"))
 		}
 	}
 
 	return nil
 }
 
+func (dfu *Dfu) connectPeripheral() (err error) {
+	if dfu.address != "" {
+		jww.INFO.Printf("Connecting to '%s'\n", dfu.address)
+		dfu.peripheral, err = dfu.client.ConnectAddress(dfu.address, dfu.timeout)
+	} else {
+		jww.INFO.Printf("Connecting to '%s'\n", dfu.name)
+		dfu.peripheral, err = dfu.client.ConnectName(dfu.name, dfu.timeout)
+	}
+
+	if err != nil {
+		return withClass(ErrorClassConnect, errors.Wrap(err, "failed to connect to device"))
+	}
+	return nil
+}
+
+// connectRetrying connects to the device, retrying failures as allowed by
+// the retry policy.
+func (dfu *Dfu) connectRetrying(ctx context.Context) error {
+	return dfu.retryPolicy.do(ctx, "connect", func(attempt int) error {
+		err := dfu.connect(ctx)
+		if err != nil && err != errLegacyDfu {
+			dfu.disconnect()
+		}
+		return err
+	})
+}
+
+func (dfu *Dfu) exchangeMTU() int {
+	mtu, err := dfu.peripheral.ExchangeMTU(dfu.mtu)
+	if err != nil {
+		jww.WARN.Printf("MTU exchange failed, using MTU of %d: %v\n", dfu.peripheral.MTU(), err)
+		mtu = dfu.peripheral.MTU()
+	}
+	if mtu > dfu.mtu {
+		mtu = dfu.mtu
+	}
+	if mtu < ble.DefaultMTU {
+		mtu = ble.DefaultMTU
+	}
+	jww.DEBUG.Printf("Using MTU of %d\n", mtu)
+	return mtu
+}
+
 func (dfu *Dfu) disconnect() {
+	if dfu.transport != nil {
+		dfu.transport.Close()
+		dfu.transport = nil
+	}
+
 	if dfu.peripheral != nil {
 		peripheral := dfu.peripheral
 
 		dfu.peripheral = nil
-		dfu.control = nil
-		dfu.packet = nil
 		dfu.boot = nil
 
 		peripheral.Disconnect()
 	}
 }
 
+func (dfu *Dfu) connectedTo() string {
+	switch {
+	case dfu.peripheral != nil:
+		return dfu.peripheral.Addr()
+	case dfu.port != "":
+		return dfu.port
+	case dfu.address != "":
+		return dfu.address
+	}
+	return dfu.name
+}
+
+var (
+	nameMutex  sync.Mutex
+	nameRandom = rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
+)
+
 func (dfu *Dfu) generateDeviceName() {
 	const letterBytes = "abcdefghijklmnopqrstuvwxyz"
 
-	rand.Seed(time.Now().UTC().UnixNano())
+	if dfu.bootloaderName != "" {
+		dfu.name = dfu.bootloaderName
+		dfu.address = ""
+		return
+	}
 
+	nameMutex.Lock()
 	b := make([]byte, 10)
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		b[i] = letterBytes[nameRandom.Intn(len(letterBytes))]
 	}
+	nameMutex.Unlock()
 
 	dfu.name = "Dfu" + string(b)
 	dfu.address = ""
 }
 
-func (dfu *Dfu) enterBootloader() error {
+// abort asks the bootloader to discard the transfer in progress. The
+// response is not awaited, as the context of the transfer has ended.
+func (dfu *Dfu) abort() {
+	if dfu.transport == nil {
+		return
+	}
+
+	jww.INFO.Println("Aborting transfer.")
+	err := dfu.transport.WriteControl([]byte{byte(DFU_OP_ABORT)})
+	if err != nil {
+		jww.WARN.Printf("Failed to abort transfer: %v\n", err)
+	}
+}
+
+func (dfu *Dfu) enterBootloader(ctx context.Context) error {
 	rebooted := false
-	err := dfu.boot.Subscribe(ble.SubscriptionTypeIndication, func(data []byte) {
-		dfu.responseChannel <- data
-	})
+	err := dfu.boot.Subscribe(ble.SubscriptionTypeIndication, dfu.responses.push)
 	defer func() {
 		if !rebooted {
 			dfu.boot.Unsubscribe(ble.SubscriptionTypeIndication)
@@ -478,9 +809,7 @@ func (dfu *Dfu) enterBootloader() error {
 	if err != nil {
 		return errors.Wrap(err, "failed to subscribe to control characteristic")
 	}
-	err = dfu.boot.Subscribe(ble.SubscriptionTypeNotification, func(data []byte) {
-		dfu.responseChannel <- data
-	})
+	err = dfu.boot.Subscribe(ble.SubscriptionTypeNotification, dfu.responses.push)
 	if err != nil {
 		return errors.Wrap(err, "failed to subscribe to control characteristic")
 	}
@@ -493,13 +822,13 @@ func (dfu *Dfu) enterBootloader() error {
 	if dfu.addressChange {
 		dfu.generateDeviceName()
 		jww.INFO.Printf("Changing bootloader advertisment name to '%s'\n", dfu.name)
-		err = dfu.sendBootloaderAdvName(dfu.name)
+		err = dfu.sendBootloaderAdvName(ctx, dfu.name)
 		if err != nil {
 			return errors.Wrap(err, "failed to set bootloaer advertisment name")
 		}
 	}
 
-	err = dfu.sendEnterBootloader()
+	err = dfu.sendEnterBootloader(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to enter bootloader")
 	}
@@ -513,69 +842,117 @@ func (dfu *Dfu) SetDeviceAddress(address string) {
 	dfu.name = ""
 }
 
+// SetBootloaderName sets the name the unbonded buttonless bootloader is asked
+// to advertise, instead of a random name. Replaying a trace needs the name
+// that was recorded.
+func (dfu *Dfu) SetBootloaderName(name string) {
+	dfu.bootloaderName = name
+}
+
+func (dfu *Dfu) SetPacketReceiptNotification(prn uint16) {
+	dfu.prn = prn
+}
+
+func (dfu *Dfu) SetMTU(mtu int) {
+	dfu.mtu = mtu
+}
+
+func (dfu *Dfu) SetResponseTimeout(timeout time.Duration) {
+	dfu.responseTimeout = timeout
+}
+
+// SetPublicKey sets the key used to verify the signatures of packages before
+// they are transferred.
+func (dfu *Dfu) SetPublicKey(key *ecdsa.PublicKey) {
+	dfu.publicKey = key
+}
+
+// SetRetryPolicy sets how failures to connect, to discover the DFU service
+// and to send an object are retried.
+func (dfu *Dfu) SetRetryPolicy(policy RetryPolicy) {
+	dfu.retryPolicy = policy
+}
+
+// SetVerification enables the check that the device runs the new firmware
+// after an update. Nil disables the check.
+func (dfu *Dfu) SetVerification(verification *Verification) {
+	dfu.verification = verification
+}
+
 func (dfu *Dfu) SetDeviceName(name string) {
 	dfu.address = ""
 	dfu.name = name
 }
 
-func (dfu *Dfu) Update(filename string, progress DfuProgress) error {
-	err := dfu.connect()
+func (dfu *Dfu) waitForBootloader(ctx context.Context) error {
+	jww.INFO.Println("Reconnecting to peripheral")
+	err := dfu.retryPolicy.do(ctx, "reconnect to bootloader", func(attempt int) error {
+		dfu.disconnect()
+		err := dfu.connect(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to reconnect")
+		}
+		if dfu.transport == nil {
+			return withClass(ErrorClassDiscovery, errors.New("bootloader did not become active"))
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "failed to connect to peripheral")
+		jww.ERROR.Printf("Failed to connect to %s\n", dfu.connectedTo())
+		return err
 	}
-	defer dfu.disconnect()
+	jww.INFO.Printf("Connected to %s\n", dfu.connectedTo())
+	return nil
+}
 
-	if dfu.control == nil || dfu.packet == nil {
+// connectBootloader reboots the connected device into the bootloader if it
+// is not already running it.
+func (dfu *Dfu) connectBootloader(ctx context.Context) error {
+	if dfu.transport == nil {
 		jww.INFO.Println("DFU Characteristic not found. Attempting to reboot device.")
-		err = dfu.enterBootloader()
+		err := dfu.enterBootloader(ctx)
 		if err != nil {
 			return errors.Wrap(err, "failed to enter bootloader")
 		}
 
-		tries := 5
-		jww.INFO.Println("Reconnecting to peripheral")
-		for {
-			err = dfu.connect()
-			if err != nil {
-				return errors.Wrap(err, "failed to reconnect")
-			}
-			if (dfu.control != nil && dfu.packet != nil) {
-				jww.INFO.Printf("Connected to %s\n", dfu.peripheral.Addr())
-				break
-			}
-			tries--
-			if tries == 0 {
-				jww.ERROR.Printf("Failed to connect to %s\n", dfu.peripheral.Addr())
-				break
-			}
-			time.Sleep(1000 * time.Millisecond)
+		err = dfu.waitForBootloader(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to reconnect to bootloader")
 		}
 	}
+	return nil
+}
 
-	err = dfu.control.Subscribe(ble.SubscriptionTypeNotification, func(data []byte) {
-		dfu.responseChannel <- data
-	})
+func (dfu *Dfu) updateImage(ctx context.Context, image *Image) error {
+	err := dfu.transport.Subscribe(dfu.responses.push)
 	if err != nil {
-		return errors.Wrap(err, "failed to subscribe to control characteristic")
+		return err
 	}
-	defer dfu.control.Unsubscribe(ble.SubscriptionTypeNotification)
+	// The transport is replaced if the connection is restored during the transfer.
+	defer func() {
+		if dfu.transport != nil {
+			dfu.transport.Unsubscribe()
+		}
+	}()
 
-	dfu.progress = progress
+	err = dfu.transport.handshake(ctx, dfu)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize transport")
+	}
 
-	err = dfu.readFirmwareArchive(filename)
+	err = dfu.sendNotify(ctx, dfu.prn)
 	if err != nil {
-		return errors.Wrap(err, "failed to open firmware file")
+		return errors.Wrap(err, "failed to set packet receipt notification")
 	}
-	defer dfu.firmwareZipFile.Close()
 
-	jww.INFO.Println("Transferring firmware.")
+	jww.INFO.Printf("Transferring %s.\n", image.Type)
 
-	err = dfu.transfer(0x01, dfu.initDataFile)
+	err = dfu.transfer(ctx, dfuObjectCommand, image.InitData)
 	if err != nil {
 		return errors.Wrap(err, "failed to transfer init data")
 	}
 
-	err = dfu.transfer(0x02, dfu.firmwareFile)
+	err = dfu.transfer(ctx, dfuObjectData, image.Firmware)
 	if err != nil {
 		return errors.Wrap(err, "failed to transfer firmware data")
 	}
@@ -583,24 +960,149 @@ func (dfu *Dfu) Update(filename string, progress DfuProgress) error {
 	return nil
 }
 
-func (dfu *Dfu) EnterBootloader() error {
-	err := dfu.connect()
+func (dfu *Dfu) Update(ctx context.Context, filename string, progress DfuProgress) error {
+	pkg, err := OpenPackage(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read firmware archive")
+	}
+	return dfu.UpdatePackage(ctx, pkg, progress)
+}
+
+func (dfu *Dfu) UpdatePackage(ctx context.Context, pkg *Package, progress DfuProgress) error {
+	defer dfu.disconnect()
+
+	// Legacy packages are verified by the legacy updater.
+	if !pkg.IsLegacy() {
+		err := dfu.preparePackage(pkg)
+		if err != nil {
+			return err
+		}
+	}
+	if dfu.verification != nil && dfu.port != "" {
+		return errors.New("verification is not supported over a serial port")
+	}
+
+	// The unbonded buttonless bootloader is found by a new name, but the
+	// updated application uses the original address or name.
+	address, name := dfu.address, dfu.name
+
+	err := dfu.connectRetrying(ctx)
+	if err == errLegacyDfu {
+		jww.INFO.Println("Using legacy DFU protocol.")
+		return dfu.legacy().UpdatePackage(ctx, pkg, progress)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to peripheral")
+	}
+	if pkg.IsLegacy() {
+		return errors.New("the Secure DFU bootloader does not support legacy packages")
+	}
+
+	dfu.progress = progress
+
+	err = dfu.connectBootloader(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, image := range dfu.pkg.Images {
+		if i > 0 {
+			// The bootloader resets after activating a SoftDevice or bootloader image.
+			jww.INFO.Println("Waiting for bootloader to restart.")
+			err = sleep(ctx, 1000*time.Millisecond)
+			if err != nil {
+				return err
+			}
+
+			err = dfu.waitForBootloader(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to reconnect before transferring %s", image.Type)
+			}
+		}
+
+		err = dfu.updateImage(ctx, image)
+		if err != nil {
+			if ctx.Err() != nil {
+				dfu.abort()
+			}
+			return errors.Wrapf(err, "failed to update %s", image.Type)
+		}
+	}
+
+	if dfu.verification != nil {
+		dfu.disconnect()
+		dfu.address, dfu.name = address, name
+		return dfu.verifyUpdate(ctx)
+	}
+	return nil
+}
+
+// verifyUpdate reconnects to the device after an update, and checks that it
+// left the bootloader and runs the expected firmware.
+func (dfu *Dfu) verifyUpdate(ctx context.Context) error {
+	jww.INFO.Println("Waiting for device to start the new firmware.")
+	err := sleep(ctx, dfu.verification.Delay)
+	if err != nil {
+		return err
+	}
+
+	err = dfu.retryPolicy.do(ctx, "verify update", func(attempt int) error {
+		dfu.disconnect()
+		err := dfu.connectPeripheral()
+		if err != nil {
+			return err
+		}
+
+		service := dfu.peripheral.FindService(dfuServiceUUID)
+		if service != nil && service.FindCharacteristic(dfuControlPointUUID) != nil && service.FindCharacteristic(dfuPacketUUID) != nil {
+			return errStillInBootloader
+		}
+		return checkFirmwareRevision(dfu.peripheral, dfu.verification.FirmwareRevision)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to verify update")
+	}
+
+	jww.INFO.Printf("Device %s runs the new firmware.\n", dfu.connectedTo())
+	return nil
+}
+
+func (dfu *Dfu) EnterBootloader(ctx context.Context) error {
+	err := dfu.connectRetrying(ctx)
+	if err == errLegacyDfu {
+		jww.INFO.Println("Using legacy DFU protocol.")
+		return dfu.legacy().EnterBootloader(ctx)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed to connect to peripheral")
 	}
 	defer dfu.disconnect()
 
-	if dfu.control != nil && dfu.packet != nil {
+	if dfu.transport != nil {
 		jww.INFO.Println("Bootloader already active.")
 	} else {
 		jww.INFO.Println("Switching to DFU mode.")
-		err = dfu.enterBootloader()
+		err = dfu.enterBootloader(ctx)
 		if err != nil {
 			return errors.Wrap(err, "failed to enter bootloader")
 		}
 
-		// TODO: Hack to wait for reponse...
-		time.Sleep(500 * time.Millisecond)
+		err = dfu.waitForBootloader(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to reconnect to bootloader")
+		}
 	}
 	return nil
 }
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
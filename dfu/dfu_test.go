@@ -0,0 +1,87 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+)
+
+// testFirmware returns size bytes of firmware. Different seeds give
+// different firmware.
+func testFirmware(size int, seed byte) []byte {
+	firmware := make([]byte, size)
+	for i := range firmware {
+		firmware[i] = byte(i*7) ^ seed
+	}
+	return firmware
+}
+
+// testImage returns an image with an unsigned init packet for firmware.
+func testImage(t *testing.T, imageType ImageType, firmware []byte) *Image {
+	options := &PackageOptions{HwVersion: 52, SdReq: []uint32{0xB6}}
+	initData, err := newInitPacket(imageType, firmware, options, func(init *initpacket.InitCommand) {
+		size := uint32Ptr(uint32(len(firmware)))
+		switch imageType {
+		case ImageTypeApplication:
+			init.FwVersion = uint32Ptr(1)
+			init.AppSize = size
+		case ImageTypeBootloader:
+			init.FwVersion = uint32Ptr(1)
+			init.BlSize = size
+		case ImageTypeSoftDevice:
+			init.FwVersion = uint32Ptr(softDeviceFwVersion)
+			init.SdSize = size
+		case ImageTypeSoftDeviceBootloader:
+			init.FwVersion = uint32Ptr(1)
+			init.SdSize = uint32Ptr(uint32(len(firmware) / 2))
+			init.BlSize = uint32Ptr(uint32(len(firmware) - len(firmware)/2))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Image{
+		Type:         imageType,
+		InitDataFile: string(imageType) + ".dat",
+		FirmwareFile: string(imageType) + ".bin",
+		InitData:     initData,
+		Firmware:     firmware,
+	}
+}
+
+func testPackage(images ...*Image) *Package {
+	pkg := &Package{}
+	for _, image := range images {
+		pkg.Images = append(pkg.Images, image)
+		firmware := &ManifestFirmware{BinFile: image.FirmwareFile, DatFile: image.InitDataFile}
+		if image.Type == ImageTypeSoftDeviceBootloader {
+			firmware.InfoReadOnlyMetadata = &InfoReadOnlyMetadata{
+				SoftDeviceSize: uint32(len(image.Firmware) / 2),
+				BootloaderSize: uint32(len(image.Firmware) - len(image.Firmware)/2),
+			}
+		}
+		pkg.Manifest.setFirmware(image.Type, firmware)
+	}
+	return pkg
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResponseTimeout is returned when the device does not answer a request
+// within the response timeout.
+var ErrResponseTimeout = errors.New("timed out waiting for response")
+
+type dfuExtError byte
+
+const (
+	DFU_EXT_ERROR_NO_ERROR             dfuExtError = 0x00
+	DFU_EXT_ERROR_INVALID_ERROR_CODE   dfuExtError = 0x01
+	DFU_EXT_ERROR_WRONG_COMMAND_FORMAT dfuExtError = 0x02
+	DFU_EXT_ERROR_UNKNOWN_COMMAND      dfuExtError = 0x03
+	DFU_EXT_ERROR_INIT_COMMAND_INVALID dfuExtError = 0x04
+	DFU_EXT_ERROR_FW_VERSION_FAILURE   dfuExtError = 0x05
+	DFU_EXT_ERROR_HW_VERSION_FAILURE   dfuExtError = 0x06
+	DFU_EXT_ERROR_SD_VERSION_FAILURE   dfuExtError = 0x07
+	DFU_EXT_ERROR_SIGNATURE_MISSING    dfuExtError = 0x08
+	DFU_EXT_ERROR_WRONG_HASH_TYPE      dfuExtError = 0x09
+	DFU_EXT_ERROR_HASH_FAILED          dfuExtError = 0x0A
+	DFU_EXT_ERROR_WRONG_SIGNATURE_TYPE dfuExtError = 0x0B
+	DFU_EXT_ERROR_VERIFICATION_FAILED  dfuExtError = 0x0C
+	DFU_EXT_ERROR_INSUFFICIENT_SPACE   dfuExtError = 0x0D
+)
+
+var operationNames = map[dfuOperation]string{
+	DFU_OP_PROTOCOL_VERSION:  "protocol version",
+	DFU_OP_OBJECT_CREATE:     "create object",
+	DFU_OP_RECEIPT_NOTIF_SET: "set receipt notification",
+	DFU_OP_CRC_GET:           "get CRC",
+	DFU_OP_OBJECT_EXECUTE:    "execute object",
+	DFU_OP_OBJECT_SELECT:     "select object",
+	DFU_OP_MTU_GET:           "get MTU",
+	DFU_OP_OBJECT_WRITE:      "write object",
+	DFU_OP_PING:              "ping",
+	DFU_OP_HARDWARE_VERSION:  "hardware version",
+	DFU_OP_FIRMWARE_VERSION:  "firmware version",
+	DFU_OP_ABORT:             "abort",
+	DFU_OP_RESPONSE:          "response",
+}
+
+var resultDescriptions = map[dfuResult]string{
+	DFU_RESULT_INVALID_CODE:               "invalid result code",
+	DFU_RESULT_SUCCESS:                    "success",
+	DFU_RESULT_OPCODE_NOT_SUPPORTED:       "operation not supported",
+	DFU_RESULT_INVALID_PARAMETER:          "invalid parameter",
+	DFU_RESULT_INSUFFICIENT_RESOURCES:     "insufficient resources",
+	DFU_RESULT_INVALID_OBJECT:             "invalid object",
+	DFU_RESULT_UNSUPPORTED_TYPE:           "unsupported object type",
+	DFU_RESULT_DFUOPERATION_NOT_PERMITTED: "operation not permitted",
+	DFU_RESULT_DFUOPERATION_FAILED:        "operation failed",
+	DFU_RESULT_EXT_ERROR:                  "extended error",
+}
+
+var extErrorDescriptions = map[dfuExtError]string{
+	DFU_EXT_ERROR_NO_ERROR:             "no extended error code has been set",
+	DFU_EXT_ERROR_INVALID_ERROR_CODE:   "invalid extended error code",
+	DFU_EXT_ERROR_WRONG_COMMAND_FORMAT: "the format of the command was incorrect",
+	DFU_EXT_ERROR_UNKNOWN_COMMAND:      "the command was parsed, but it is not supported or unknown",
+	DFU_EXT_ERROR_INIT_COMMAND_INVALID: "the init command is invalid; it has an invalid update type or is missing required fields",
+	DFU_EXT_ERROR_FW_VERSION_FAILURE:   "the firmware version is too low",
+	DFU_EXT_ERROR_HW_VERSION_FAILURE:   "the hardware version of the device does not match the required hardware version",
+	DFU_EXT_ERROR_SD_VERSION_FAILURE:   "the SoftDevice of the device is not in the list of supported SoftDevices",
+	DFU_EXT_ERROR_SIGNATURE_MISSING:    "the init packet is not signed, but the bootloader requires a signature",
+	DFU_EXT_ERROR_WRONG_HASH_TYPE:      "the hash type of the init packet is not supported by the bootloader",
+	DFU_EXT_ERROR_HASH_FAILED:          "the hash of the firmware image cannot be calculated",
+	DFU_EXT_ERROR_WRONG_SIGNATURE_TYPE: "the signature type of the init packet is unknown or not supported by the bootloader",
+	DFU_EXT_ERROR_VERIFICATION_FAILED:  "signature verification failed, or the hash of the firmware image does not match the init packet",
+	DFU_EXT_ERROR_INSUFFICIENT_SPACE:   "the available space on the device is insufficient to hold the firmware",
+}
+
+func (op dfuOperation) String() string {
+	if name, ok := operationNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("operation 0x%02X", byte(op))
+}
+
+func (result dfuResult) String() string {
+	if description, ok := resultDescriptions[result]; ok {
+		return description
+	}
+	return fmt.Sprintf("result 0x%02X", byte(result))
+}
+
+func (extError dfuExtError) String() string {
+	if description, ok := extErrorDescriptions[extError]; ok {
+		return description
+	}
+	return fmt.Sprintf("extended error 0x%02X", byte(extError))
+}
+
+// ProtocolError is returned when the device rejects a control point request.
+// ExtendedError is only valid if Result is DFU_RESULT_EXT_ERROR.
+type ProtocolError struct {
+	Opcode        dfuOperation
+	Result        dfuResult
+	ExtendedError dfuExtError
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Result == DFU_RESULT_EXT_ERROR {
+		return fmt.Sprintf("DFU %s operation failed: %s", e.Opcode, e.ExtendedError)
+	}
+	return fmt.Sprintf("DFU %s operation failed: %s", e.Opcode, e.Result)
+}
+
+type buttonlessResult byte
+
+const (
+	BUTTONLESS_RESULT_SUCCESS              buttonlessResult = 0x01
+	BUTTONLESS_RESULT_OPCODE_NOT_SUPPORTED buttonlessResult = 0x02
+	BUTTONLESS_RESULT_OPERATION_FAILED     buttonlessResult = 0x04
+	BUTTONLESS_RESULT_ADV_NAME_INVALID     buttonlessResult = 0x05
+	BUTTONLESS_RESULT_BUSY                 buttonlessResult = 0x06
+	BUTTONLESS_RESULT_NOT_BONDED           buttonlessResult = 0x07
+)
+
+var buttonlessResultDescriptions = map[buttonlessResult]string{
+	BUTTONLESS_RESULT_SUCCESS:              "success",
+	BUTTONLESS_RESULT_OPCODE_NOT_SUPPORTED: "operation not supported",
+	BUTTONLESS_RESULT_OPERATION_FAILED:     "operation failed",
+	BUTTONLESS_RESULT_ADV_NAME_INVALID:     "invalid advertisement name",
+	BUTTONLESS_RESULT_BUSY:                 "busy",
+	BUTTONLESS_RESULT_NOT_BONDED:           "device is not bonded",
+}
+
+func (result buttonlessResult) String() string {
+	if description, ok := buttonlessResultDescriptions[result]; ok {
+		return description
+	}
+	return fmt.Sprintf("result 0x%02X", byte(result))
+}
+
+// ButtonlessError is returned when the buttonless DFU service rejects a request.
+type ButtonlessError struct {
+	Opcode byte
+	Result buttonlessResult
+}
+
+func (e *ButtonlessError) Error() string {
+	return fmt.Sprintf("buttonless DFU operation 0x%02X failed: %s", e.Opcode, e.Result)
+}
+
+type legacyResult byte
+
+const (
+	LEGACY_RESULT_SUCCESS                 legacyResult = 0x01
+	LEGACY_RESULT_INVALID_STATE           legacyResult = 0x02
+	LEGACY_RESULT_NOT_SUPPORTED           legacyResult = 0x03
+	LEGACY_RESULT_DATA_SIZE_EXCEEDS_LIMIT legacyResult = 0x04
+	LEGACY_RESULT_CRC_ERROR               legacyResult = 0x05
+	LEGACY_RESULT_OPERATION_FAILED        legacyResult = 0x06
+)
+
+var legacyOperationNames = map[legacyOperation]string{
+	LEGACY_OP_START_DFU:                   "start DFU",
+	LEGACY_OP_INIT_DFU_PARAMS:             "init DFU parameters",
+	LEGACY_OP_RECEIVE_FIRMWARE_IMAGE:      "receive firmware image",
+	LEGACY_OP_VALIDATE_FIRMWARE:           "validate firmware",
+	LEGACY_OP_ACTIVATE_AND_RESET:          "activate and reset",
+	LEGACY_OP_RESET:                       "reset",
+	LEGACY_OP_PACKET_RECEIPT_NOTIF_REQ:    "packet receipt notification request",
+	LEGACY_OP_RESPONSE:                    "response",
+	LEGACY_OP_PACKET_RECEIPT_NOTIFICATION: "packet receipt notification",
+}
+
+var legacyResultDescriptions = map[legacyResult]string{
+	LEGACY_RESULT_SUCCESS:                 "success",
+	LEGACY_RESULT_INVALID_STATE:           "invalid state",
+	LEGACY_RESULT_NOT_SUPPORTED:           "operation not supported",
+	LEGACY_RESULT_DATA_SIZE_EXCEEDS_LIMIT: "data size exceeds limit",
+	LEGACY_RESULT_CRC_ERROR:               "CRC error",
+	LEGACY_RESULT_OPERATION_FAILED:        "operation failed",
+}
+
+func (op legacyOperation) String() string {
+	if name, ok := legacyOperationNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("operation 0x%02X", byte(op))
+}
+
+func (result legacyResult) String() string {
+	if description, ok := legacyResultDescriptions[result]; ok {
+		return description
+	}
+	return fmt.Sprintf("result 0x%02X", byte(result))
+}
+
+// LegacyProtocolError is returned when a device running the legacy DFU
+// bootloader rejects a control point request.
+type LegacyProtocolError struct {
+	Opcode legacyOperation
+	Result legacyResult
+}
+
+func (e *LegacyProtocolError) Error() string {
+	return fmt.Sprintf("legacy DFU %s operation failed: %s", e.Opcode, e.Result)
+}
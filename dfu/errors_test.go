@@ -0,0 +1,103 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProtocolError(t *testing.T) {
+	type errorTest struct {
+		err      *ProtocolError
+		expected string
+	}
+	tests := []errorTest{
+		{&ProtocolError{DFU_OP_OBJECT_CREATE, DFU_RESULT_INSUFFICIENT_RESOURCES, 0}, "DFU create object operation failed: insufficient resources"},
+		{&ProtocolError{DFU_OP_OBJECT_SELECT, dfuResult(0x42), 0}, "DFU select object operation failed: result 0x42"},
+		{&ProtocolError{dfuOperation(0x33), DFU_RESULT_INVALID_PARAMETER, 0}, "DFU operation 0x33 operation failed: invalid parameter"},
+		// The extended error is ignored for other results.
+		{&ProtocolError{DFU_OP_OBJECT_EXECUTE, DFU_RESULT_DFUOPERATION_FAILED, DFU_EXT_ERROR_HASH_FAILED}, "DFU execute object operation failed: operation failed"},
+		{&ProtocolError{DFU_OP_OBJECT_EXECUTE, DFU_RESULT_EXT_ERROR, dfuExtError(0x20)}, "DFU execute object operation failed: extended error 0x20"},
+	}
+	for code, description := range extErrorDescriptions {
+		tests = append(tests, errorTest{&ProtocolError{DFU_OP_OBJECT_EXECUTE, DFU_RESULT_EXT_ERROR, code}, "DFU execute object operation failed: " + description})
+	}
+
+	for _, test := range tests {
+		if message := test.err.Error(); message != test.expected {
+			t.Errorf("%+v: got %q, expected %q", *test.err, message, test.expected)
+		}
+	}
+}
+
+func TestReceiveResponseExtError(t *testing.T) {
+	tests := []struct {
+		response []byte
+		result   dfuResult
+		extError dfuExtError
+	}{
+		{[]byte{0x60, 0x04, 0x0B, 0x07}, DFU_RESULT_EXT_ERROR, DFU_EXT_ERROR_SD_VERSION_FAILURE},
+		{[]byte{0x60, 0x04, 0x0B, 0x0C}, DFU_RESULT_EXT_ERROR, DFU_EXT_ERROR_VERIFICATION_FAILED},
+		// A missing extended error byte leaves the extended error unset.
+		{[]byte{0x60, 0x04, 0x0B}, DFU_RESULT_EXT_ERROR, DFU_EXT_ERROR_NO_ERROR},
+		{[]byte{0x60, 0x04, 0x04}, DFU_RESULT_INSUFFICIENT_RESOURCES, DFU_EXT_ERROR_NO_ERROR},
+	}
+
+	for _, test := range tests {
+		dfu := &Dfu{responses: newResponseQueue(), responseTimeout: time.Second}
+		dfu.responses.push(test.response)
+
+		_, err := dfu.receiveResponse(context.Background(), DFU_OP_OBJECT_EXECUTE)
+		err = errors.Wrap(err, "failed to execute object")
+
+		var protocolError *ProtocolError
+		if !errors.As(err, &protocolError) {
+			t.Errorf("% x: expected a ProtocolError, got %v", test.response, err)
+			continue
+		}
+		if protocolError.Opcode != DFU_OP_OBJECT_EXECUTE || protocolError.Result != test.result || protocolError.ExtendedError != test.extError {
+			t.Errorf("% x: unexpected error %+v", test.response, *protocolError)
+		}
+	}
+}
+
+func TestReceiveResponseErrors(t *testing.T) {
+	tests := [][]byte{
+		{0x60, 0x04},
+		{0x61, 0x04, 0x01},
+		{0x60, 0x03, 0x01},
+	}
+
+	for _, response := range tests {
+		dfu := &Dfu{responses: newResponseQueue(), responseTimeout: time.Second}
+		dfu.responses.push(response)
+
+		_, err := dfu.receiveResponse(context.Background(), DFU_OP_OBJECT_EXECUTE)
+		var protocolError *ProtocolError
+		if err == nil || errors.As(err, &protocolError) {
+			t.Errorf("% x: expected an invalid response error, got %v", response, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"crypto/ecdsa"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+)
+
+// Firmware version used for SoftDevice images, which are not versioned.
+const softDeviceFwVersion = 0xFFFFFFFF
+
+type PackageOptions struct {
+	Application        string
+	ApplicationVersion uint32
+	Bootloader         string
+	BootloaderVersion  uint32
+	SoftDevice         string
+	HwVersion          uint32
+	// SoftDevices the images require to be present on the device.
+	SdReq []uint32
+	// SoftDevices the application requires, if a SoftDevice is included.
+	SdId []uint32
+	Key  *ecdsa.PrivateKey
+}
+
+// GeneratePackage builds a Secure DFU package from raw binary or Intel HEX
+// firmware files.
+func GeneratePackage(options *PackageOptions) (*Package, error) {
+	if options.Application == "" && options.Bootloader == "" && options.SoftDevice == "" {
+		return nil, errors.New("no firmware specified")
+	}
+	if len(options.SdReq) == 0 {
+		return nil, errors.New("no SoftDevice requirements specified")
+	}
+
+	pkg := &Package{}
+
+	var softDevice, bootloader []byte
+	var err error
+	if options.SoftDevice != "" {
+		softDevice, err = ReadFirmware(options.SoftDevice, ImageTypeSoftDevice, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.Bootloader != "" {
+		bootloader, err = ReadFirmware(options.Bootloader, ImageTypeBootloader, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case softDevice != nil && bootloader != nil:
+		err = pkg.addImage(ImageTypeSoftDeviceBootloader, "sd_bl", append(softDevice, bootloader...), options, func(init *initpacket.InitCommand) {
+			init.FwVersion = uint32Ptr(options.BootloaderVersion)
+			init.SdSize = uint32Ptr(uint32(len(softDevice)))
+			init.BlSize = uint32Ptr(uint32(len(bootloader)))
+		})
+		if err == nil {
+			pkg.Manifest.SoftDeviceBootloader.InfoReadOnlyMetadata = &InfoReadOnlyMetadata{
+				BootloaderSize: uint32(len(bootloader)),
+				SoftDeviceSize: uint32(len(softDevice)),
+			}
+		}
+	case softDevice != nil:
+		err = pkg.addImage(ImageTypeSoftDevice, baseName(options.SoftDevice), softDevice, options, func(init *initpacket.InitCommand) {
+			init.FwVersion = uint32Ptr(softDeviceFwVersion)
+			init.SdSize = uint32Ptr(uint32(len(softDevice)))
+		})
+	case bootloader != nil:
+		err = pkg.addImage(ImageTypeBootloader, baseName(options.Bootloader), bootloader, options, func(init *initpacket.InitCommand) {
+			init.FwVersion = uint32Ptr(options.BootloaderVersion)
+			init.BlSize = uint32Ptr(uint32(len(bootloader)))
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Application != "" {
+		application, err := ReadFirmware(options.Application, ImageTypeApplication, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		sdReq := options.SdReq
+		if softDevice != nil {
+			if len(options.SdId) == 0 {
+				return nil, errors.New("the SoftDevice required by the application must be specified when a SoftDevice is included")
+			}
+			sdReq = options.SdId
+		}
+
+		err = pkg.addImage(ImageTypeApplication, baseName(options.Application), application, options, func(init *initpacket.InitCommand) {
+			init.FwVersion = uint32Ptr(options.ApplicationVersion)
+			init.SdReq = sdReq
+			init.AppSize = uint32Ptr(uint32(len(application)))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg, nil
+}
+
+func (pkg *Package) addImage(imageType ImageType, name string, firmware []byte, options *PackageOptions, setup func(init *initpacket.InitCommand)) error {
+	initData, err := newInitPacket(imageType, firmware, options, setup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create init packet for %s", imageType)
+	}
+
+	image := &Image{
+		Type:         imageType,
+		InitDataFile: name + ".dat",
+		FirmwareFile: name + ".bin",
+		InitData:     initData,
+		Firmware:     firmware,
+	}
+	pkg.Images = append(pkg.Images, image)
+
+	pkg.Manifest.setFirmware(imageType, &ManifestFirmware{BinFile: image.FirmwareFile, DatFile: image.InitDataFile})
+	return nil
+}
+
+func newInitPacket(imageType ImageType, firmware []byte, options *PackageOptions, setup func(init *initpacket.InitCommand)) ([]byte, error) {
+	var fwType initpacket.FwType
+	for t, i := range imageTypes {
+		if i == imageType {
+			fwType = t
+		}
+	}
+
+	isDebug := false
+	init := &initpacket.InitCommand{
+		HwVersion: uint32Ptr(options.HwVersion),
+		SdReq:     options.SdReq,
+		Type:      &fwType,
+		SdSize:    uint32Ptr(0),
+		BlSize:    uint32Ptr(0),
+		AppSize:   uint32Ptr(0),
+		Hash:      &initpacket.Hash{HashType: initpacket.HashTypeSha256, Hash: firmwareHash(firmware)},
+		IsDebug:   &isDebug,
+	}
+	setup(init)
+
+	opCode := initpacket.OpCodeInit
+	command := &initpacket.Command{OpCode: &opCode, Init: init}
+
+	if options.Key == nil {
+		return (&initpacket.Packet{Command: command}).Encode(), nil
+	}
+
+	signature, err := signing.Sign(options.Key, command.Encode())
+	if err != nil {
+		return nil, err
+	}
+	packet := &initpacket.Packet{
+		SignedCommand: &initpacket.SignedCommand{
+			Command:       command,
+			SignatureType: initpacket.SignatureTypeEcdsaP256Sha256,
+			Signature:     signature,
+		},
+	}
+	return packet.Encode(), nil
+}
+
+func baseName(filename string) string {
+	name := filepath.Base(filename)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func uint32Ptr(value uint32) *uint32 {
+	return &value
+}
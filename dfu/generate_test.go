@@ -0,0 +1,171 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+)
+
+func TestGeneratePackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := signing.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mbr := hexSegment{0x0000, testFirmware(mbrSize, 1)}
+	softDevice := hexSegment{mbrSize, testFirmware(0x3000, 2)}
+	bootloader := hexSegment{0x78000, testFirmware(0x1800, 3)}
+	application := hexSegment{0x26000, testFirmware(0x2400, 4)}
+	uicr := hexSegment{0x10001014, []byte{0x00, 0x00, 0x07, 0x00}}
+
+	softDeviceFile := writeHexFile(t, dir, "s132.hex", mbr, softDevice)
+	bootloaderFile := writeHexFile(t, dir, "bootloader.hex", bootloader, uicr)
+	applicationFile := writeHexFile(t, dir, "app.hex", application)
+
+	tests := []struct {
+		name     string
+		options  PackageOptions
+		images   []ImageType
+		firmware [][]byte
+		sdReq    [][]uint32
+	}{
+		{
+			name:     "application",
+			options:  PackageOptions{Application: applicationFile, ApplicationVersion: 3},
+			images:   []ImageType{ImageTypeApplication},
+			firmware: [][]byte{application.data},
+			sdReq:    [][]uint32{{0xB6}},
+		},
+		{
+			name:     "softdevice and bootloader",
+			options:  PackageOptions{SoftDevice: softDeviceFile, Bootloader: bootloaderFile, BootloaderVersion: 2},
+			images:   []ImageType{ImageTypeSoftDeviceBootloader},
+			firmware: [][]byte{append(append([]byte{}, softDevice.data...), bootloader.data...)},
+			sdReq:    [][]uint32{{0xB6}},
+		},
+		{
+			name:     "softdevice, bootloader and application",
+			options:  PackageOptions{SoftDevice: softDeviceFile, Bootloader: bootloaderFile, Application: applicationFile, SdId: []uint32{0xB7}},
+			images:   []ImageType{ImageTypeSoftDeviceBootloader, ImageTypeApplication},
+			firmware: [][]byte{append(append([]byte{}, softDevice.data...), bootloader.data...), application.data},
+			sdReq:    [][]uint32{{0xB6}, {0xB7}},
+		},
+		{
+			name:     "bootloader",
+			options:  PackageOptions{Bootloader: bootloaderFile, BootloaderVersion: 2},
+			images:   []ImageType{ImageTypeBootloader},
+			firmware: [][]byte{bootloader.data},
+			sdReq:    [][]uint32{{0xB6}},
+		},
+	}
+
+	for i, test := range tests {
+		options := test.options
+		options.HwVersion = 52
+		options.SdReq = []uint32{0xB6}
+		options.Key = key
+
+		generated, err := GeneratePackage(&options)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		filename := filepath.Join(dir, fmt.Sprintf("package%d.zip", i))
+		if err := generated.Write(filename); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		pkg, err := OpenPackage(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := pkg.Verify(&key.PublicKey); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if len(pkg.Images) != len(test.images) {
+			t.Errorf("%s: package has %d images, expected %d", test.name, len(pkg.Images), len(test.images))
+			continue
+		}
+		for j, image := range pkg.Images {
+			if image.Type != test.images[j] || !bytes.Equal(image.Firmware, test.firmware[j]) {
+				t.Errorf("%s: unexpected %s image %d", test.name, image.Type, j)
+			}
+			packet, err := initpacket.Decode(image.InitData)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if sdReq := packet.GetInitCommand().SdReq; !reflect.DeepEqual(sdReq, test.sdReq[j]) {
+				t.Errorf("%s: %s image requires SoftDevices %v, expected %v", test.name, image.Type, sdReq, test.sdReq[j])
+			}
+		}
+
+		if options.SoftDevice != "" {
+			firmware := pkg.Manifest.SoftDeviceBootloader
+			if firmware == nil || firmware.BinFile != "sd_bl.bin" || firmware.DatFile != "sd_bl.dat" {
+				t.Fatalf("%s: unexpected sd_bl manifest entry %+v", test.name, firmware)
+			}
+			expected := &InfoReadOnlyMetadata{SoftDeviceSize: uint32(len(softDevice.data)), BootloaderSize: uint32(len(bootloader.data))}
+			if !reflect.DeepEqual(firmware.InfoReadOnlyMetadata, expected) {
+				t.Errorf("%s: sd_bl metadata is %+v, expected %+v", test.name, firmware.InfoReadOnlyMetadata, expected)
+			}
+		}
+
+		device := newSimDevice(sim.ButtonlessBonded)
+		if err := newSimDfu(device, noRetries).UpdatePackage(context.Background(), pkg, nil); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.images[len(test.images)-1] == ImageTypeApplication {
+			checkImages(t, device, test.firmware...)
+			continue
+		}
+		// Without an application the device stays in the new bootloader.
+		images := device.Images()
+		if len(images) != len(test.firmware) || !bytes.Equal(images[0].Firmware, test.firmware[0]) {
+			t.Errorf("%s: device did not receive the firmware", test.name)
+		}
+		if device.Mode() != sim.ModeBootloader {
+			t.Errorf("%s: device is not in bootloader mode", test.name)
+		}
+	}
+
+	options := PackageOptions{SoftDevice: softDeviceFile, Bootloader: bootloaderFile, Application: applicationFile, HwVersion: 52, SdReq: []uint32{0xB6}}
+	if _, err := GeneratePackage(&options); err == nil {
+		t.Error("expected an error for an application with a SoftDevice but without SdId")
+	}
+}
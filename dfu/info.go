@@ -0,0 +1,205 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+type FirmwareType byte
+
+const (
+	FirmwareTypeSoftDevice  FirmwareType = 0x00
+	FirmwareTypeApplication FirmwareType = 0x01
+	FirmwareTypeBootloader  FirmwareType = 0x02
+	FirmwareTypeUnknown     FirmwareType = 0xFF
+)
+
+var firmwareTypeNames = map[FirmwareType]string{
+	FirmwareTypeSoftDevice:  "softdevice",
+	FirmwareTypeApplication: "application",
+	FirmwareTypeBootloader:  "bootloader",
+	FirmwareTypeUnknown:     "unknown",
+}
+
+func (t FirmwareType) String() string {
+	if name, ok := firmwareTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type 0x%02X", byte(t))
+}
+
+type HardwareVersion struct {
+	Part        uint32
+	Variant     uint32
+	RomSize     uint32
+	RomPageSize uint32
+	RamSize     uint32
+}
+
+type FirmwareVersion struct {
+	Type    FirmwareType
+	Version uint32
+	Address uint32
+	Length  uint32
+}
+
+// DeviceInfo describes the bootloader of a device and the firmware images
+// it holds. Hardware is nil if the bootloader does not report it.
+type DeviceInfo struct {
+	ProtocolVersion byte
+	Hardware        *HardwareVersion
+	Firmware        []FirmwareVersion
+}
+
+var errLegacyInfo = errors.New("the legacy DFU protocol does not report device information")
+
+// Bootloaders number their images from 0. Stop asking after this many in
+// case a device never rejects an image number.
+const maxFirmwareImages = 16
+
+func (dfu *Dfu) sendProtocolVersion(ctx context.Context) (byte, error) {
+	response, err := dfu.sendControl(ctx, DFU_OP_PROTOCOL_VERSION, []byte{})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to send protocol version command")
+	}
+	if len(response) < 1 {
+		return 0, errors.New("Received truncated protocol version response")
+	}
+	return response[0], nil
+}
+
+func (dfu *Dfu) sendHardwareVersion(ctx context.Context) (*HardwareVersion, error) {
+	var hardwareVersion HardwareVersion
+
+	response, err := dfu.sendControl(ctx, DFU_OP_HARDWARE_VERSION, []byte{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send hardware version command")
+	}
+
+	buf := bytes.NewReader(response)
+	if err := binary.Read(buf, binary.LittleEndian, &hardwareVersion); err != nil {
+		return nil, errors.Wrap(err, "failed to unpack hardware version response data")
+	}
+	return &hardwareVersion, nil
+}
+
+func (dfu *Dfu) sendFirmwareVersion(ctx context.Context, image byte) (FirmwareVersion, error) {
+	var firmwareVersion FirmwareVersion
+
+	response, err := dfu.sendControl(ctx, DFU_OP_FIRMWARE_VERSION, []byte{image})
+	if err != nil {
+		return firmwareVersion, errors.Wrap(err, "failed to send firmware version command")
+	}
+
+	buf := bytes.NewReader(response)
+	if err := binary.Read(buf, binary.LittleEndian, &firmwareVersion); err != nil {
+		return firmwareVersion, errors.Wrap(err, "failed to unpack firmware version response data")
+	}
+	return firmwareVersion, nil
+}
+
+func (dfu *Dfu) readInfo(ctx context.Context) (*DeviceInfo, error) {
+	transport := dfu.transport
+	err := transport.Subscribe(dfu.responses.push)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.Unsubscribe()
+
+	err = transport.handshake(ctx, dfu)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize transport")
+	}
+
+	info := &DeviceInfo{}
+	info.ProtocolVersion, err = dfu.sendProtocolVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Hardware, err = dfu.sendHardwareVersion(ctx)
+	if isProtocolResult(err, DFU_RESULT_OPCODE_NOT_SUPPORTED) {
+		jww.INFO.Println("Bootloader does not report its hardware version.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The bootloader rejects the first image number it does not have.
+	for image := 0; image < maxFirmwareImages; image++ {
+		firmwareVersion, err := dfu.sendFirmwareVersion(ctx, byte(image))
+		if isProtocolResult(err, DFU_RESULT_INVALID_PARAMETER) || isProtocolResult(err, DFU_RESULT_OPCODE_NOT_SUPPORTED) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if firmwareVersion.Type != FirmwareTypeUnknown {
+			info.Firmware = append(info.Firmware, firmwareVersion)
+		}
+	}
+
+	return info, nil
+}
+
+func isProtocolResult(err error, result dfuResult) bool {
+	var protocolError *ProtocolError
+	return errors.As(err, &protocolError) && protocolError.Result == result
+}
+
+// ErrApplicationMode is returned by Info for a device that runs its
+// application, unless it may enter the bootloader.
+var ErrApplicationMode = errors.New("device is in application mode")
+
+// Info returns the versions reported by the bootloader. A device in
+// application mode is rebooted into the bootloader only if enterBootloader
+// is set.
+func (dfu *Dfu) Info(ctx context.Context, enterBootloader bool) (*DeviceInfo, error) {
+	defer dfu.disconnect()
+
+	err := dfu.connectRetrying(ctx)
+	if err == errLegacyDfu {
+		return nil, errLegacyInfo
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to peripheral")
+	}
+
+	if dfu.transport == nil && !enterBootloader {
+		return nil, ErrApplicationMode
+	}
+	err = dfu.connectBootloader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return dfu.readInfo(ctx)
+}
+
+func (dfu *LegacyDfu) Info(ctx context.Context, enterBootloader bool) (*DeviceInfo, error) {
+	return nil, errLegacyInfo
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+)
+
+var (
+	simBootloaderVersion = FirmwareVersion{Type: FirmwareTypeBootloader, Version: 0x01, Address: 0x78000, Length: 0x6000}
+	simSoftDeviceVersion = FirmwareVersion{Type: FirmwareTypeSoftDevice, Version: 0xB6, Address: 0x1000, Length: 0x25000}
+)
+
+func TestSimInfoApplicationMode(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessBonded)
+
+	_, err := newSimDfu(device, noRetries).Info(context.Background(), false)
+	if err != ErrApplicationMode {
+		t.Fatalf("expected ErrApplicationMode, got %v", err)
+	}
+	if device.Mode() != sim.ModeApplication {
+		t.Error("device entered the bootloader")
+	}
+
+	info, err := newSimDfu(device, noRetries).Info(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Mode() != sim.ModeBootloader {
+		t.Error("device did not enter the bootloader")
+	}
+	if info.ProtocolVersion != 1 {
+		t.Errorf("protocol version is %d", info.ProtocolVersion)
+	}
+}
+
+func TestSimReadInfo(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessBonded)
+	dfu := newSimDfu(device, noRetries)
+
+	info, err := dfu.Info(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &DeviceInfo{
+		ProtocolVersion: 1,
+		Hardware:        &HardwareVersion{Part: 0x52832, Variant: 0x41414530, RomSize: 0x80000, RomPageSize: 0x1000, RamSize: 0x10000},
+		// The bootloader rejects image 2, as it has no application.
+		Firmware: []FirmwareVersion{simBootloaderVersion, simSoftDeviceVersion},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("info is %+v, expected %+v", info, expected)
+	}
+
+	application := testFirmware(3000, 1)
+	if err := dfu.UpdatePackage(context.Background(), testPackage(testImage(t, ImageTypeApplication, application)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = dfu.Info(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.Firmware = append(expected.Firmware, FirmwareVersion{Type: FirmwareTypeApplication, Version: 1, Address: 0x26000, Length: 3000})
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("info is %+v, expected %+v", info, expected)
+	}
+}
+
+func TestSimReadInfoErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode dfuOperation
+		after  int
+	}{
+		{"protocol version", DFU_OP_PROTOCOL_VERSION, 0},
+		{"hardware version", DFU_OP_HARDWARE_VERSION, 0},
+		{"second firmware version", DFU_OP_FIRMWARE_VERSION, 1},
+	}
+
+	for _, test := range tests {
+		device := newSimDevice(sim.ButtonlessNone)
+		device.InjectFault(sim.Fault{Type: sim.FaultInsufficientResources, Opcode: int(test.opcode), After: test.after})
+
+		_, err := newSimDfu(device, noRetries).Info(context.Background(), false)
+		if !isProtocolResult(err, DFU_RESULT_INSUFFICIENT_RESOURCES) {
+			t.Errorf("%s: expected insufficient resources, got %v", test.name, err)
+		}
+	}
+}
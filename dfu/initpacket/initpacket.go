@@ -0,0 +1,555 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package initpacket implements the init packet messages of Nordic's Secure
+// DFU bootloader, as defined in dfu-cc.proto.
+package initpacket
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+type OpCode uint32
+
+const (
+	OpCodeInit  OpCode = 1
+	OpCodeReset OpCode = 2
+)
+
+type FwType uint32
+
+const (
+	FwTypeApplication          FwType = 0
+	FwTypeSoftDevice           FwType = 1
+	FwTypeBootloader           FwType = 2
+	FwTypeSoftDeviceBootloader FwType = 3
+	FwTypeExternalApplication  FwType = 4
+)
+
+type HashType uint32
+
+const (
+	HashTypeNone   HashType = 0
+	HashTypeCrc    HashType = 1
+	HashTypeSha128 HashType = 2
+	HashTypeSha256 HashType = 3
+	HashTypeSha512 HashType = 4
+)
+
+type ValidationType uint32
+
+const (
+	ValidationTypeNone            ValidationType = 0
+	ValidationTypeGeneratedCrc    ValidationType = 1
+	ValidationTypeSha256          ValidationType = 2
+	ValidationTypeEcdsaP256Sha256 ValidationType = 3
+)
+
+type SignatureType uint32
+
+const (
+	SignatureTypeEcdsaP256Sha256 SignatureType = 0
+	SignatureTypeEd25519         SignatureType = 1
+)
+
+type Hash struct {
+	HashType HashType
+	Hash     []byte
+
+	unknownFields []byte
+}
+
+type BootValidation struct {
+	Type  ValidationType
+	Bytes []byte
+
+	unknownFields []byte
+}
+
+// InitCommand describes the firmware that follows the init packet. Optional
+// fields are pointers, so that absent and zero values can be told apart.
+type InitCommand struct {
+	FwVersion      *uint32
+	HwVersion      *uint32
+	SdReq          []uint32
+	Type           *FwType
+	SdSize         *uint32
+	BlSize         *uint32
+	AppSize        *uint32
+	Hash           *Hash
+	IsDebug        *bool
+	BootValidation []*BootValidation
+
+	unknownFields []byte
+}
+
+type ResetCommand struct {
+	Timeout uint32
+
+	unknownFields []byte
+}
+
+type Command struct {
+	OpCode *OpCode
+	Init   *InitCommand
+	Reset  *ResetCommand
+
+	unknownFields []byte
+}
+
+type SignedCommand struct {
+	Command       *Command
+	SignatureType SignatureType
+	Signature     []byte
+
+	rawCommand    []byte
+	unknownFields []byte
+}
+
+// Packet is the init packet. Fields that are not part of dfu-cc.proto are
+// kept when decoding, and written again when encoding, so that a decoded
+// packet encodes to the original bytes.
+type Packet struct {
+	Command       *Command
+	SignedCommand *SignedCommand
+
+	unknownFields []byte
+}
+
+var fwTypeNames = map[FwType]string{
+	FwTypeApplication:          "application",
+	FwTypeSoftDevice:           "softdevice",
+	FwTypeBootloader:           "bootloader",
+	FwTypeSoftDeviceBootloader: "softdevice_bootloader",
+	FwTypeExternalApplication:  "external_application",
+}
+
+var hashTypeNames = map[HashType]string{
+	HashTypeNone:   "none",
+	HashTypeCrc:    "crc",
+	HashTypeSha128: "sha128",
+	HashTypeSha256: "sha256",
+	HashTypeSha512: "sha512",
+}
+
+var validationTypeNames = map[ValidationType]string{
+	ValidationTypeNone:            "none",
+	ValidationTypeGeneratedCrc:    "generated_crc",
+	ValidationTypeSha256:          "sha256",
+	ValidationTypeEcdsaP256Sha256: "ecdsa_p256_sha256",
+}
+
+var signatureTypeNames = map[SignatureType]string{
+	SignatureTypeEcdsaP256Sha256: "ecdsa_p256_sha256",
+	SignatureTypeEd25519:         "ed25519",
+}
+
+func (t FwType) String() string {
+	if name, ok := fwTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint32(t))
+}
+
+func (t HashType) String() string {
+	if name, ok := hashTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint32(t))
+}
+
+func (t ValidationType) String() string {
+	if name, ok := validationTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint32(t))
+}
+
+func (t SignatureType) String() string {
+	if name, ok := signatureTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint32(t))
+}
+
+// GetCommand returns the command of the packet, whether it is signed or not.
+func (p *Packet) GetCommand() *Command {
+	if p.SignedCommand != nil {
+		return p.SignedCommand.Command
+	}
+	return p.Command
+}
+
+// GetInitCommand returns the init command of the packet, or nil if the packet
+// does not contain one.
+func (p *Packet) GetInitCommand() *InitCommand {
+	command := p.GetCommand()
+	if command == nil {
+		return nil
+	}
+	return command.Init
+}
+
+func (p *Packet) IsSigned() bool {
+	return p.SignedCommand != nil
+}
+
+func (c *InitCommand) GetFwVersion() uint32 {
+	if c.FwVersion == nil {
+		return 0
+	}
+	return *c.FwVersion
+}
+
+func (c *InitCommand) GetHwVersion() uint32 {
+	if c.HwVersion == nil {
+		return 0
+	}
+	return *c.HwVersion
+}
+
+func (c *InitCommand) GetType() FwType {
+	if c.Type == nil {
+		return FwTypeApplication
+	}
+	return *c.Type
+}
+
+func (c *InitCommand) GetSdSize() uint32 {
+	if c.SdSize == nil {
+		return 0
+	}
+	return *c.SdSize
+}
+
+func (c *InitCommand) GetBlSize() uint32 {
+	if c.BlSize == nil {
+		return 0
+	}
+	return *c.BlSize
+}
+
+func (c *InitCommand) GetAppSize() uint32 {
+	if c.AppSize == nil {
+		return 0
+	}
+	return *c.AppSize
+}
+
+func (c *InitCommand) GetIsDebug() bool {
+	if c.IsDebug == nil {
+		return false
+	}
+	return *c.IsDebug
+}
+
+// FirmwareSize returns the total size of the firmware described by the command.
+func (c *InitCommand) FirmwareSize() uint32 {
+	return c.GetSdSize() + c.GetBlSize() + c.GetAppSize()
+}
+
+func Decode(data []byte) (*Packet, error) {
+	packet := new(Packet)
+	err := decodeMessage(data, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			packet.Command, err = decodeCommand(f)
+		case 2:
+			packet.SignedCommand, err = decodeSignedCommand(f)
+		default:
+			packet.unknownFields = append(packet.unknownFields, f.raw...)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode init packet")
+	}
+	return packet, nil
+}
+
+// Encode serializes the packet. Fields are written in field number order,
+// like nrfutil does, so that decoding and encoding a packet generated by
+// nrfutil yields identical bytes.
+func (p *Packet) Encode() []byte {
+	var e encoder
+	if p.Command != nil {
+		e.message(1, p.Command.encode)
+	}
+	if p.SignedCommand != nil {
+		e.message(2, p.SignedCommand.encode)
+	}
+	e.unknownFields(p.unknownFields)
+	return e.buf
+}
+
+// Encode serializes the command. These are the bytes covered by the
+// signature of a signed command.
+func (c *Command) Encode() []byte {
+	var e encoder
+	c.encode(&e)
+	return e.buf
+}
+
+func (c *Command) encode(e *encoder) {
+	if c.OpCode != nil {
+		e.uint32(1, uint32(*c.OpCode))
+	}
+	if c.Init != nil {
+		e.message(2, c.Init.encode)
+	}
+	if c.Reset != nil {
+		e.message(3, c.Reset.encode)
+	}
+	e.unknownFields(c.unknownFields)
+}
+
+// SignedData returns the bytes covered by the signature. For a decoded
+// command these are the bytes as received, not as encoded again.
+func (s *SignedCommand) SignedData() []byte {
+	if s.rawCommand != nil {
+		return s.rawCommand
+	}
+	if s.Command == nil {
+		return nil
+	}
+	return s.Command.Encode()
+}
+
+func (s *SignedCommand) encode(e *encoder) {
+	if s.Command != nil {
+		e.message(1, s.Command.encode)
+	}
+	e.uint32(2, uint32(s.SignatureType))
+	e.bytes(3, s.Signature)
+	e.unknownFields(s.unknownFields)
+}
+
+func (r *ResetCommand) encode(e *encoder) {
+	e.uint32(1, r.Timeout)
+	e.unknownFields(r.unknownFields)
+}
+
+func (c *InitCommand) encode(e *encoder) {
+	e.optionalUint32(1, c.FwVersion)
+	e.optionalUint32(2, c.HwVersion)
+	if len(c.SdReq) > 0 {
+		e.packedUint32s(3, c.SdReq)
+	}
+	if c.Type != nil {
+		e.uint32(4, uint32(*c.Type))
+	}
+	e.optionalUint32(5, c.SdSize)
+	e.optionalUint32(6, c.BlSize)
+	e.optionalUint32(7, c.AppSize)
+	if c.Hash != nil {
+		e.message(8, c.Hash.encode)
+	}
+	if c.IsDebug != nil {
+		e.bool(9, *c.IsDebug)
+	}
+	for _, validation := range c.BootValidation {
+		e.message(10, validation.encode)
+	}
+	e.unknownFields(c.unknownFields)
+}
+
+func (h *Hash) encode(e *encoder) {
+	e.uint32(1, uint32(h.HashType))
+	e.bytes(2, h.Hash)
+	e.unknownFields(h.unknownFields)
+}
+
+func (v *BootValidation) encode(e *encoder) {
+	e.uint32(1, uint32(v.Type))
+	e.bytes(2, v.Bytes)
+	e.unknownFields(v.unknownFields)
+}
+
+func decodeSignedCommand(f field) (*SignedCommand, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	signed := new(SignedCommand)
+	err := decodeMessage(f.bytes, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			signed.Command, err = decodeCommand(f)
+			signed.rawCommand = f.bytes
+		case 2:
+			var value uint32
+			value, err = f.uint32()
+			signed.SignatureType = SignatureType(value)
+		case 3:
+			if err = f.expect(wireBytes); err == nil {
+				signed.Signature = f.bytes
+			}
+		default:
+			signed.unknownFields = append(signed.unknownFields, f.raw...)
+		}
+		return err
+	})
+	return signed, err
+}
+
+func decodeCommand(f field) (*Command, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	command := new(Command)
+	err := decodeMessage(f.bytes, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			var value uint32
+			value, err = f.uint32()
+			opCode := OpCode(value)
+			command.OpCode = &opCode
+		case 2:
+			command.Init, err = decodeInitCommand(f)
+		case 3:
+			command.Reset, err = decodeResetCommand(f)
+		default:
+			command.unknownFields = append(command.unknownFields, f.raw...)
+		}
+		return err
+	})
+	return command, err
+}
+
+func decodeResetCommand(f field) (*ResetCommand, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	reset := new(ResetCommand)
+	err := decodeMessage(f.bytes, func(f field) (err error) {
+		if f.number == 1 {
+			reset.Timeout, err = f.uint32()
+		} else {
+			reset.unknownFields = append(reset.unknownFields, f.raw...)
+		}
+		return err
+	})
+	return reset, err
+}
+
+func decodeInitCommand(f field) (*InitCommand, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	init := new(InitCommand)
+	err := decodeMessage(f.bytes, func(f field) error {
+		switch f.number {
+		case 1:
+			return decodeUint32(f, &init.FwVersion)
+		case 2:
+			return decodeUint32(f, &init.HwVersion)
+		case 3:
+			values, err := f.uint32s()
+			init.SdReq = append(init.SdReq, values...)
+			return err
+		case 4:
+			value, err := f.uint32()
+			fwType := FwType(value)
+			init.Type = &fwType
+			return err
+		case 5:
+			return decodeUint32(f, &init.SdSize)
+		case 6:
+			return decodeUint32(f, &init.BlSize)
+		case 7:
+			return decodeUint32(f, &init.AppSize)
+		case 8:
+			hash, err := decodeHash(f)
+			init.Hash = hash
+			return err
+		case 9:
+			value, err := f.uint32()
+			isDebug := value != 0
+			init.IsDebug = &isDebug
+			return err
+		case 10:
+			validation, err := decodeBootValidation(f)
+			init.BootValidation = append(init.BootValidation, validation)
+			return err
+		}
+		init.unknownFields = append(init.unknownFields, f.raw...)
+		return nil
+	})
+	return init, err
+}
+
+func decodeUint32(f field, target **uint32) error {
+	value, err := f.uint32()
+	*target = &value
+	return err
+}
+
+func decodeHash(f field) (*Hash, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	hash := new(Hash)
+	err := decodeMessage(f.bytes, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			var value uint32
+			value, err = f.uint32()
+			hash.HashType = HashType(value)
+		case 2:
+			if err = f.expect(wireBytes); err == nil {
+				hash.Hash = f.bytes
+			}
+		default:
+			hash.unknownFields = append(hash.unknownFields, f.raw...)
+		}
+		return err
+	})
+	return hash, err
+}
+
+func decodeBootValidation(f field) (*BootValidation, error) {
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	validation := new(BootValidation)
+	err := decodeMessage(f.bytes, func(f field) (err error) {
+		switch f.number {
+		case 1:
+			var value uint32
+			value, err = f.uint32()
+			validation.Type = ValidationType(value)
+		case 2:
+			if err = f.expect(wireBytes); err == nil {
+				validation.Bytes = f.bytes
+			}
+		default:
+			validation.unknownFields = append(validation.unknownFields, f.raw...)
+		}
+		return err
+	})
+	return validation, err
+}
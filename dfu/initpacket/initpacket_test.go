@@ -0,0 +1,195 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package initpacket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeSignedApplication(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/app_signed.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Encode(), data) {
+		t.Fatalf("encoding differs from the original packet:\n%x\n%x", packet.Encode(), data)
+	}
+
+	if !packet.IsSigned() || packet.SignedCommand.SignatureType != SignatureTypeEcdsaP256Sha256 || len(packet.SignedCommand.Signature) != 64 {
+		t.Fatalf("unexpected signature: %+v", packet.SignedCommand)
+	}
+	if !bytes.Equal(packet.SignedCommand.SignedData(), packet.SignedCommand.Command.Encode()) {
+		t.Fatal("signed data differs from the encoded command")
+	}
+
+	init := packet.GetInitCommand()
+	if init == nil {
+		t.Fatal("no init command")
+	}
+	if init.GetFwVersion() != 7 || init.GetHwVersion() != 52 || init.GetType() != FwTypeApplication || init.GetIsDebug() {
+		t.Errorf("unexpected init command: %+v", init)
+	}
+	if !reflect.DeepEqual(init.SdReq, []uint32{0xB6, 0x0101}) {
+		t.Errorf("sd_req is %v", init.SdReq)
+	}
+	if init.GetSdSize() != 0 || init.GetBlSize() != 0 || init.GetAppSize() != 24576 || init.FirmwareSize() != 24576 {
+		t.Errorf("unexpected sizes: %+v", init)
+	}
+	if init.Hash == nil || init.Hash.HashType != HashTypeSha256 || hex.EncodeToString(init.Hash.Hash) != "f2fb88dc1f51909583ef302ac3076dafb615f6456fbdac135bc5bbee625e5985" {
+		t.Errorf("unexpected hash: %+v", init.Hash)
+	}
+}
+
+func TestDecodeBootloaderWithBootValidation(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/bootloader_debug.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Encode(), data) {
+		t.Fatalf("encoding differs from the original packet:\n%x\n%x", packet.Encode(), data)
+	}
+
+	init := packet.GetInitCommand()
+	if packet.IsSigned() || init == nil {
+		t.Fatal("expected an unsigned init command")
+	}
+	if init.GetType() != FwTypeBootloader || init.GetBlSize() != 23000 || !init.GetIsDebug() {
+		t.Errorf("unexpected init command: %+v", init)
+	}
+	if len(init.BootValidation) != 1 || init.BootValidation[0].Type != ValidationTypeSha256 || !bytes.Equal(init.BootValidation[0].Bytes, init.Hash.Hash) {
+		t.Errorf("unexpected boot validation: %+v", init.BootValidation)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	unknown := func(e *encoder, number uint64) {
+		e.uint32(number, 42)
+		e.bytes(number+1, []byte("unknown"))
+		e.key(number+2, wireFixed32)
+		e.buf = append(e.buf, 1, 2, 3, 4)
+		e.key(number+3, wireFixed64)
+		e.buf = append(e.buf, 1, 2, 3, 4, 5, 6, 7, 8)
+	}
+
+	var packet encoder
+	packet.message(2, func(signed *encoder) {
+		signed.message(1, func(command *encoder) {
+			command.uint32(1, uint32(OpCodeInit))
+			command.message(2, func(init *encoder) {
+				init.uint32(1, 3)
+				init.uint32(4, uint32(FwTypeApplication))
+				init.uint32(7, 1024)
+				init.message(8, func(hash *encoder) {
+					hash.uint32(1, uint32(HashTypeSha256))
+					hash.bytes(2, make([]byte, 32))
+					unknown(hash, 20)
+				})
+				init.message(10, func(validation *encoder) {
+					validation.uint32(1, uint32(ValidationTypeGeneratedCrc))
+					validation.bytes(2, []byte{1, 2, 3, 4})
+					unknown(validation, 30)
+				})
+				unknown(init, 40)
+			})
+			unknown(command, 50)
+		})
+		signed.uint32(2, uint32(SignatureTypeEd25519))
+		signed.bytes(3, make([]byte, 64))
+		unknown(signed, 60)
+	})
+	unknown(&packet, 70)
+
+	decoded, err := Decode(packet.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), packet.buf) {
+		t.Fatalf("unknown fields were not preserved:\n%x\n%x", decoded.Encode(), packet.buf)
+	}
+
+	init := decoded.GetInitCommand()
+	if init.GetFwVersion() != 3 || init.GetAppSize() != 1024 || init.Hash.HashType != HashTypeSha256 || len(init.BootValidation) != 1 {
+		t.Errorf("known fields decoded incorrectly: %+v", init)
+	}
+	if decoded.SignedCommand.SignatureType != SignatureTypeEd25519 {
+		t.Errorf("signature type is %s", decoded.SignedCommand.SignatureType)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	fwVersion := uint32(5)
+	fwType := FwTypeSoftDeviceBootloader
+	sdSize := uint32(100000)
+	blSize := uint32(20000)
+	isDebug := false
+	opCode := OpCodeInit
+
+	packet := &Packet{
+		Command: &Command{
+			OpCode: &opCode,
+			Init: &InitCommand{
+				FwVersion: &fwVersion,
+				SdReq:     []uint32{0xB6},
+				Type:      &fwType,
+				SdSize:    &sdSize,
+				BlSize:    &blSize,
+				Hash:      &Hash{HashType: HashTypeSha256, Hash: []byte{1, 2, 3}},
+				IsDebug:   &isDebug,
+			},
+		},
+	}
+
+	decoded, err := Decode(packet.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, packet) {
+		t.Fatalf("decoded packet differs:\n%+v\n%+v", decoded.GetInitCommand(), packet.GetInitCommand())
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x0A},
+		{0x0A, 0x05, 0x01},
+		{0x0A, 0x02, 0x08},
+		{0x0B},
+		{0x0D, 0x01, 0x02},
+	} {
+		if _, err := Decode(data); err == nil {
+			t.Errorf("decoding %x succeeded", data)
+		}
+	}
+}
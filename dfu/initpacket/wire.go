@@ -0,0 +1,209 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package initpacket
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type field struct {
+	number   uint64
+	wireType uint64
+	value    uint64
+	bytes    []byte
+	// Encoded field, including the key.
+	raw []byte
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) varint() (uint64, error) {
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, errors.New("invalid varint")
+	}
+	d.data = d.data[n:]
+	return value, nil
+}
+
+func (d *decoder) next() (f field, err error) {
+	start := d.data
+	defer func() {
+		f.raw = start[:len(start)-len(d.data)]
+	}()
+
+	key, err := d.varint()
+	if err != nil {
+		return f, errors.Wrap(err, "invalid field key")
+	}
+	f.number = key >> 3
+	f.wireType = key & 7
+
+	switch f.wireType {
+	case wireVarint:
+		f.value, err = d.varint()
+	case wireBytes:
+		var length uint64
+		length, err = d.varint()
+		if err == nil && length > uint64(len(d.data)) {
+			err = errors.New("truncated length delimited field")
+		}
+		if err == nil {
+			f.bytes = d.data[:length]
+			d.data = d.data[length:]
+		}
+	case wireFixed32, wireFixed64:
+		size := 4
+		if f.wireType == wireFixed64 {
+			size = 8
+		}
+		if len(d.data) < size {
+			return f, errors.New("truncated fixed size field")
+		}
+		f.bytes = d.data[:size]
+		d.data = d.data[size:]
+	default:
+		err = errors.Errorf("unsupported wire type %d", f.wireType)
+	}
+	if err != nil {
+		return f, errors.Wrapf(err, "failed to decode field %d", f.number)
+	}
+	return f, nil
+}
+
+func decodeMessage(data []byte, handle func(f field) error) error {
+	d := decoder{data: data}
+	for len(d.data) > 0 {
+		f, err := d.next()
+		if err != nil {
+			return err
+		}
+		if err = handle(f); err != nil {
+			return errors.Wrapf(err, "invalid field %d", f.number)
+		}
+	}
+	return nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) varint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	e.buf = append(e.buf, buf[:n]...)
+}
+
+func (e *encoder) key(number uint64, wireType uint64) {
+	e.varint(number<<3 | wireType)
+}
+
+func (e *encoder) uint32(number uint64, value uint32) {
+	e.key(number, wireVarint)
+	e.varint(uint64(value))
+}
+
+func (e *encoder) optionalUint32(number uint64, value *uint32) {
+	if value != nil {
+		e.uint32(number, *value)
+	}
+}
+
+func (e *encoder) bool(number uint64, value bool) {
+	e.key(number, wireVarint)
+	if value {
+		e.varint(1)
+	} else {
+		e.varint(0)
+	}
+}
+
+func (e *encoder) bytes(number uint64, data []byte) {
+	e.key(number, wireBytes)
+	e.varint(uint64(len(data)))
+	e.buf = append(e.buf, data...)
+}
+
+func (e *encoder) packedUint32s(number uint64, values []uint32) {
+	var packed encoder
+	for _, value := range values {
+		packed.varint(uint64(value))
+	}
+	e.bytes(number, packed.buf)
+}
+
+// unknownFields writes fields that were not recognized when decoding. They
+// follow the known fields, as in messages written by nrfutil.
+func (e *encoder) unknownFields(raw []byte) {
+	e.buf = append(e.buf, raw...)
+}
+
+func (e *encoder) message(number uint64, encode func(e *encoder)) {
+	var message encoder
+	encode(&message)
+	e.bytes(number, message.buf)
+}
+
+func (f field) expect(wireType uint64) error {
+	if f.wireType != wireType {
+		return errors.Errorf("unexpected wire type %d", f.wireType)
+	}
+	return nil
+}
+
+func (f field) uint32() (uint32, error) {
+	if err := f.expect(wireVarint); err != nil {
+		return 0, err
+	}
+	return uint32(f.value), nil
+}
+
+func (f field) uint32s() ([]uint32, error) {
+	if f.wireType == wireVarint {
+		return []uint32{uint32(f.value)}, nil
+	}
+	if err := f.expect(wireBytes); err != nil {
+		return nil, err
+	}
+
+	var values []uint32
+	d := decoder{data: f.bytes}
+	for len(d.data) > 0 {
+		value, err := d.varint()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid packed value")
+		}
+		values = append(values, uint32(value))
+	}
+	return values, nil
+}
@@ -0,0 +1,753 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// LegacyDfu updates devices running the legacy DFU bootloader of nRF5 SDK 11
+// and earlier.
+type LegacyDfu struct {
+	client     ble.Client
+	peripheral ble.Peripheral
+
+	control ble.Characteristic
+	packet  ble.Characteristic
+	version ble.Characteristic
+
+	name            string
+	address         string
+	responses       responseQueue
+	timeout         time.Duration
+	responseTimeout time.Duration
+	prn             uint16
+	retryPolicy     RetryPolicy
+	verification    *Verification
+
+	pkg       *Package
+	publicKey *ecdsa.PublicKey
+
+	progress         DfuProgress
+	maxProgressValue int64
+	progressValue    int64
+}
+
+type legacyOperation byte
+
+const (
+	LEGACY_OP_START_DFU                   legacyOperation = 0x01
+	LEGACY_OP_INIT_DFU_PARAMS             legacyOperation = 0x02
+	LEGACY_OP_RECEIVE_FIRMWARE_IMAGE      legacyOperation = 0x03
+	LEGACY_OP_VALIDATE_FIRMWARE           legacyOperation = 0x04
+	LEGACY_OP_ACTIVATE_AND_RESET          legacyOperation = 0x05
+	LEGACY_OP_RESET                       legacyOperation = 0x06
+	LEGACY_OP_PACKET_RECEIPT_NOTIF_REQ    legacyOperation = 0x08
+	LEGACY_OP_RESPONSE                    legacyOperation = 0x10
+	LEGACY_OP_PACKET_RECEIPT_NOTIFICATION legacyOperation = 0x11
+)
+
+const (
+	legacyInitStart    byte = 0x00
+	legacyInitComplete byte = 0x01
+)
+
+const (
+	legacyDfuServiceUUID      = "00001530-1212-efde-1523-785feabcd123"
+	legacyDfuControlPointUUID = "00001531-1212-efde-1523-785feabcd123"
+	legacyDfuPacketUUID       = "00001532-1212-efde-1523-785feabcd123"
+	legacyDfuVersionUUID      = "00001534-1212-efde-1523-785feabcd123"
+)
+
+var legacyImageTypes = map[ImageType]byte{
+	ImageTypeSoftDevice:           0x01,
+	ImageTypeBootloader:           0x02,
+	ImageTypeSoftDeviceBootloader: 0x03,
+	ImageTypeApplication:          0x04,
+}
+
+// The legacy bootloader does not support MTU exchange.
+const legacyPacketSize = ble.DefaultMTU - attOverhead
+
+// Value of the DFU version characteristic of an application that implements
+// the legacy DFU service. Bootloaders report a higher version.
+const legacyApplicationVersion = 0x0001
+
+var errLegacyDfu = errors.New("device uses the legacy DFU protocol")
+
+func NewLegacyDfu(bleClient ble.Client, timeout time.Duration) FirmwareUpdater {
+	return newLegacyDfu(bleClient, timeout)
+}
+
+func newLegacyDfu(bleClient ble.Client, timeout time.Duration) *LegacyDfu {
+	dfu := new(LegacyDfu)
+	dfu.responses = newResponseQueue()
+	dfu.client = bleClient
+	dfu.timeout = timeout
+	dfu.responseTimeout = DefaultResponseTimeout
+	dfu.prn = DefaultPacketReceiptNotification
+	dfu.retryPolicy = DefaultRetryPolicy
+	return dfu
+}
+
+// legacy hands the connection of a device that turned out to run the legacy
+// bootloader over to a legacy updater with the same settings.
+func (dfu *Dfu) legacy() *LegacyDfu {
+	legacy := newLegacyDfu(dfu.client, dfu.timeout)
+	legacy.address = dfu.address
+	legacy.name = dfu.name
+	legacy.responseTimeout = dfu.responseTimeout
+	legacy.prn = dfu.prn
+	legacy.publicKey = dfu.publicKey
+	legacy.retryPolicy = dfu.retryPolicy
+	legacy.verification = dfu.verification
+	legacy.peripheral = dfu.peripheral
+	dfu.peripheral = nil
+	return legacy
+}
+
+func (dfu *LegacyDfu) writeControl(data []byte) error {
+	err := dfu.control.WriteCharacteristic(data, ble.WithResponse)
+	if err != nil {
+		return withClass(ErrorClassTransport, errors.Wrap(err, "failed to write to control characteristic"))
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) writePacket(data []byte) error {
+	err := dfu.packet.WriteCharacteristic(data, ble.NoResponse)
+	if err != nil {
+		return withClass(ErrorClassTransport, errors.Wrap(err, "failed to write to packet characteristic"))
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) sendControl(ctx context.Context, opcode legacyOperation, request ...byte) error {
+	dfu.responses.drain()
+
+	err := dfu.writeControl(append([]byte{byte(opcode)}, request...))
+	if err != nil {
+		return err
+	}
+	return dfu.receiveResponse(ctx, opcode)
+}
+
+func (dfu *LegacyDfu) receiveResponse(ctx context.Context, opcode legacyOperation) error {
+	for {
+		response, err := dfu.responses.wait(ctx, dfu.responseTimeout)
+		if err != nil {
+			return err
+		}
+		if len(response) > 0 && legacyOperation(response[0]) == LEGACY_OP_PACKET_RECEIPT_NOTIFICATION {
+			jww.DEBUG.Printf("Ignoring packet receipt notification % x\n", response)
+			continue
+		}
+		return checkLegacyResponse(response, opcode)
+	}
+}
+
+func checkLegacyResponse(response []byte, opcode legacyOperation) error {
+	if len(response) < 3 {
+		return errors.New("Received truncated response")
+	}
+
+	responseCode := legacyOperation(response[0])
+	responseOpCode := legacyOperation(response[1])
+	resultCode := legacyResult(response[2])
+
+	if responseCode != LEGACY_OP_RESPONSE {
+		return errors.Errorf("Received incorrect response code 0x%02X", byte(responseCode))
+	}
+	if responseOpCode != opcode {
+		return errors.Errorf("Received response for %s instead of %s", responseOpCode, opcode)
+	}
+	if resultCode != LEGACY_RESULT_SUCCESS {
+		return &LegacyProtocolError{Opcode: opcode, Result: resultCode}
+	}
+	return nil
+}
+
+// receiveReceipt waits for a packet receipt notification. It returns true if
+// the device sent the response to the receive firmware request instead.
+func (dfu *LegacyDfu) receiveReceipt(ctx context.Context, offset int) (bool, error) {
+	response, err := dfu.responses.wait(ctx, dfu.responseTimeout)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to receive packet receipt notification")
+	}
+	if len(response) > 0 && legacyOperation(response[0]) == LEGACY_OP_RESPONSE {
+		return true, checkLegacyResponse(response, LEGACY_OP_RECEIVE_FIRMWARE_IMAGE)
+	}
+	if len(response) != 5 || legacyOperation(response[0]) != LEGACY_OP_PACKET_RECEIPT_NOTIFICATION {
+		return false, errors.Errorf("Received invalid packet receipt notification % x", response)
+	}
+
+	received := binary.LittleEndian.Uint32(response[1:])
+	if received != uint32(offset) {
+		return false, withClass(ErrorClassChecksum, errors.Errorf("Size mismatch %d != %d", received, offset))
+	}
+	return false, nil
+}
+
+// sendPackets writes data in packet sized chunks. If receipts is true and
+// packet receipt notifications are enabled, the number of bytes received by
+// the device is verified every prn packets. It returns true if the response
+// to the receive firmware request was received while waiting for a receipt.
+func (dfu *LegacyDfu) sendPackets(ctx context.Context, data []byte, receipts bool) (bool, error) {
+	packets := 0
+
+	for i := 0; i < len(data); i += legacyPacketSize {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		end := i + legacyPacketSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		err := dfu.writePacket(data[i:end])
+		if err != nil {
+			return false, err
+		}
+
+		dfu.updateProgress(int64(end - i))
+
+		packets++
+		if receipts && dfu.prn != 0 && packets%int(dfu.prn) == 0 {
+			complete, err := dfu.receiveReceipt(ctx, end)
+			if err != nil {
+				return false, errors.Wrap(err, "packet receipt verification failed")
+			}
+			if complete {
+				if end != len(data) {
+					return false, errors.Errorf("Received response after %d of %d bytes", end, len(data))
+				}
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (dfu *LegacyDfu) updateProgress(increment int64) {
+	dfu.progressValue += increment
+	if dfu.progress != nil {
+		dfu.progress(dfu.progressValue, dfu.maxProgressValue, "")
+	}
+}
+
+func (dfu *LegacyDfu) preparePackage(pkg *Package) error {
+	if !pkg.IsLegacy() {
+		return errors.New("the legacy DFU bootloader does not support Secure DFU packages")
+	}
+	if dfu.publicKey != nil {
+		return errors.New("the legacy DFU protocol does not support signed firmware")
+	}
+
+	for _, image := range pkg.Images {
+		if _, ok := legacyImageTypes[image.Type]; !ok {
+			return errors.Errorf("unsupported image type %s", image.Type)
+		}
+		err := verifyLegacyImage(image)
+		if err != nil {
+			return errors.Wrap(err, "firmware verification failed")
+		}
+	}
+
+	dfu.pkg = pkg
+	dfu.progressValue = 0
+	dfu.maxProgressValue = pkg.Size()
+	return nil
+}
+
+// verifyLegacyImage checks the firmware against the CRC-16 at the end of a
+// legacy init packet: device type, device revision, application version,
+// the list of supported SoftDevices and the CRC. Init packets with an
+// extended format cannot be checked and are accepted.
+func verifyLegacyImage(image *Image) error {
+	data := image.InitData
+	if len(data) < 10 {
+		return errors.Errorf("init packet of %s is too short", image.Type)
+	}
+
+	crcOffset := 10 + 2*int(binary.LittleEndian.Uint16(data[8:]))
+	if len(data) != crcOffset+2 {
+		jww.WARN.Printf("Init packet of %s has no CRC, cannot verify firmware.\n", image.Type)
+		return nil
+	}
+
+	if crc16(image.Firmware) != binary.LittleEndian.Uint16(data[crcOffset:]) {
+		return errors.Errorf("firmware CRC of %s does not match CRC in init packet", image.Type)
+	}
+	return nil
+}
+
+// crc16 computes the CRC-16-CCITT used by the legacy bootloader.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc = crc>>8 | crc<<8
+		crc ^= uint16(b)
+		crc ^= (crc & 0xFF) >> 4
+		crc ^= crc << 12
+		crc ^= (crc & 0xFF) << 5
+	}
+	return crc
+}
+
+// imageSizes returns the size packet of the start DFU request: the sizes of
+// the SoftDevice, bootloader and application in the image.
+func (dfu *LegacyDfu) imageSizes(image *Image) ([]byte, error) {
+	var sizes [3]uint32
+	size := uint32(len(image.Firmware))
+
+	switch image.Type {
+	case ImageTypeSoftDevice:
+		sizes[0] = size
+	case ImageTypeBootloader:
+		sizes[1] = size
+	case ImageTypeApplication:
+		sizes[2] = size
+	case ImageTypeSoftDeviceBootloader:
+		firmware := dfu.pkg.Manifest.Firmware(image.Type)
+		if firmware != nil {
+			sizes[0], sizes[1] = firmware.SoftDeviceSize, firmware.BootloaderSize
+			if metadata := firmware.InfoReadOnlyMetadata; metadata != nil && sizes[0] == 0 && sizes[1] == 0 {
+				sizes[0], sizes[1] = metadata.SoftDeviceSize, metadata.BootloaderSize
+			}
+		}
+		if sizes[0]+sizes[1] != size {
+			return nil, errors.Errorf("SoftDevice and bootloader sizes in %s do not match image size %d", manifestFilename, size)
+		}
+	}
+
+	data := make([]byte, 12)
+	for i, size := range sizes {
+		binary.LittleEndian.PutUint32(data[4*i:], size)
+	}
+	return data, nil
+}
+
+func (dfu *LegacyDfu) connect(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if dfu.peripheral == nil {
+		err = dfu.connectPeripheral()
+		if err != nil {
+			return err
+		}
+	}
+
+	service := dfu.peripheral.FindService(legacyDfuServiceUUID)
+	if service == nil {
+		return withClass(ErrorClassDiscovery, errors.New("Legacy DFU Service not found"))
+	}
+
+	dfu.control = service.FindCharacteristic(legacyDfuControlPointUUID)
+	dfu.packet = service.FindCharacteristic(legacyDfuPacketUUID)
+	dfu.version = service.FindCharacteristic(legacyDfuVersionUUID)
+	if dfu.control == nil {
+		return withClass(ErrorClassDiscovery, errors.New("No legacy DFU characteristics found"))
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) connectPeripheral() (err error) {
+	if dfu.address != "" {
+		jww.INFO.Printf("Connecting to '%s'\n", dfu.address)
+		dfu.peripheral, err = dfu.client.ConnectAddress(dfu.address, dfu.timeout)
+	} else {
+		jww.INFO.Printf("Connecting to '%s'\n", dfu.name)
+		dfu.peripheral, err = dfu.client.ConnectName(dfu.name, dfu.timeout)
+	}
+
+	if err != nil {
+		return withClass(ErrorClassConnect, errors.Wrap(err, "failed to connect to device"))
+	}
+	return nil
+}
+
+// connectRetrying connects to the device, retrying failures as allowed by
+// the retry policy.
+func (dfu *LegacyDfu) connectRetrying(ctx context.Context) error {
+	return dfu.retryPolicy.do(ctx, "connect", func(attempt int) error {
+		err := dfu.connect(ctx)
+		if err != nil {
+			dfu.disconnect()
+		}
+		return err
+	})
+}
+
+func (dfu *LegacyDfu) disconnect() {
+	if dfu.peripheral != nil {
+		peripheral := dfu.peripheral
+
+		dfu.peripheral = nil
+		dfu.control = nil
+		dfu.packet = nil
+		dfu.version = nil
+
+		peripheral.Disconnect()
+	}
+}
+
+// inBootloader reports whether the connected device runs the bootloader
+// rather than an application that implements the legacy DFU service.
+// Bootloaders that predate the DFU version characteristic cannot be
+// distinguished from an application and are assumed to be a bootloader.
+func (dfu *LegacyDfu) inBootloader() (bool, error) {
+	if dfu.version == nil {
+		return dfu.packet != nil, nil
+	}
+
+	data, err := dfu.version.ReadCharacteristic()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read DFU version")
+	}
+	if len(data) < 2 {
+		return false, errors.New("Received truncated DFU version")
+	}
+
+	version := binary.LittleEndian.Uint16(data)
+	jww.DEBUG.Printf("Legacy DFU version %d.%d\n", version>>8, version&0xFF)
+	return version != legacyApplicationVersion && dfu.packet != nil, nil
+}
+
+// enterBootloader asks the application to reset into the bootloader. The
+// application does not respond to the request.
+func (dfu *LegacyDfu) enterBootloader() error {
+	err := dfu.control.Subscribe(ble.SubscriptionTypeNotification, dfu.responses.push)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to control characteristic")
+	}
+
+	err = dfu.writeControl([]byte{byte(LEGACY_OP_START_DFU), legacyImageTypes[ImageTypeApplication]})
+	if err != nil {
+		return errors.Wrap(err, "failed to send enter bootloader command")
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) waitForBootloader(ctx context.Context) error {
+	jww.INFO.Println("Reconnecting to peripheral")
+	err := dfu.retryPolicy.do(ctx, "reconnect to bootloader", func(attempt int) error {
+		dfu.disconnect()
+		err := dfu.connect(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to reconnect")
+		}
+		bootloader, err := dfu.inBootloader()
+		if err != nil {
+			return err
+		}
+		if !bootloader {
+			return withClass(ErrorClassDiscovery, errors.New("bootloader did not become active"))
+		}
+		return nil
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to connect to %s\n", dfu.connectedTo())
+		return err
+	}
+	jww.INFO.Printf("Connected to %s\n", dfu.connectedTo())
+	return nil
+}
+
+func (dfu *LegacyDfu) connectedTo() string {
+	switch {
+	case dfu.peripheral != nil:
+		return dfu.peripheral.Addr()
+	case dfu.address != "":
+		return dfu.address
+	}
+	return dfu.name
+}
+
+func (dfu *LegacyDfu) connectBootloader(ctx context.Context) error {
+	err := dfu.connectRetrying(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to peripheral")
+	}
+
+	bootloader, err := dfu.inBootloader()
+	if err != nil {
+		return err
+	}
+	if !bootloader {
+		jww.INFO.Println("Bootloader not active. Attempting to reboot device.")
+		err = dfu.enterBootloader()
+		if err != nil {
+			return errors.Wrap(err, "failed to enter bootloader")
+		}
+
+		err = dfu.waitForBootloader(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to reconnect to bootloader")
+		}
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) updateImage(ctx context.Context, image *Image) error {
+	sizes, err := dfu.imageSizes(image)
+	if err != nil {
+		return err
+	}
+
+	err = dfu.control.Subscribe(ble.SubscriptionTypeNotification, dfu.responses.push)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to control characteristic")
+	}
+	defer dfu.control.Unsubscribe(ble.SubscriptionTypeNotification)
+
+	jww.INFO.Printf("Transferring %s.\n", image.Type)
+
+	// The device responds to the start request after receiving the image sizes.
+	dfu.responses.drain()
+	err = dfu.writeControl([]byte{byte(LEGACY_OP_START_DFU), legacyImageTypes[image.Type]})
+	if err != nil {
+		return errors.Wrap(err, "failed to send start DFU command")
+	}
+	err = dfu.writePacket(sizes)
+	if err != nil {
+		return errors.Wrap(err, "failed to send image sizes")
+	}
+	err = dfu.receiveResponse(ctx, LEGACY_OP_START_DFU)
+	if err != nil {
+		return errors.Wrap(err, "failed to start DFU")
+	}
+
+	err = dfu.writeControl([]byte{byte(LEGACY_OP_INIT_DFU_PARAMS), legacyInitStart})
+	if err != nil {
+		return errors.Wrap(err, "failed to send init command")
+	}
+	_, err = dfu.sendPackets(ctx, image.InitData, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to transfer init data")
+	}
+	err = dfu.sendControl(ctx, LEGACY_OP_INIT_DFU_PARAMS, legacyInitComplete)
+	if err != nil {
+		return errors.Wrap(err, "failed to transfer init data")
+	}
+
+	if dfu.prn != 0 {
+		notify := make([]byte, 2)
+		binary.LittleEndian.PutUint16(notify, dfu.prn)
+		err = dfu.writeControl(append([]byte{byte(LEGACY_OP_PACKET_RECEIPT_NOTIF_REQ)}, notify...))
+		if err != nil {
+			return errors.Wrap(err, "failed to set packet receipt notification")
+		}
+	}
+
+	err = dfu.writeControl([]byte{byte(LEGACY_OP_RECEIVE_FIRMWARE_IMAGE)})
+	if err != nil {
+		return errors.Wrap(err, "failed to send receive firmware command")
+	}
+	complete, err := dfu.sendPackets(ctx, image.Firmware, true)
+	if err != nil {
+		return errors.Wrap(err, "failed to transfer firmware data")
+	}
+	if !complete {
+		err = dfu.receiveResponse(ctx, LEGACY_OP_RECEIVE_FIRMWARE_IMAGE)
+		if err != nil {
+			return errors.Wrap(err, "failed to transfer firmware data")
+		}
+	}
+
+	err = dfu.sendControl(ctx, LEGACY_OP_VALIDATE_FIRMWARE)
+	if err != nil {
+		return errors.Wrap(err, "failed to validate firmware")
+	}
+
+	// The device resets immediately, so the write may not be acknowledged.
+	err = dfu.writeControl([]byte{byte(LEGACY_OP_ACTIVATE_AND_RESET)})
+	if err != nil {
+		jww.DEBUG.Printf("Activate and reset not acknowledged: %v\n", err)
+	}
+	return nil
+}
+
+func (dfu *LegacyDfu) SetDeviceAddress(address string) {
+	dfu.address = address
+	dfu.name = ""
+}
+
+func (dfu *LegacyDfu) SetDeviceName(name string) {
+	dfu.address = ""
+	dfu.name = name
+}
+
+func (dfu *LegacyDfu) SetPacketReceiptNotification(prn uint16) {
+	dfu.prn = prn
+}
+
+// SetMTU has no effect, the legacy bootloader always uses the default MTU.
+func (dfu *LegacyDfu) SetMTU(mtu int) {
+}
+
+func (dfu *LegacyDfu) SetResponseTimeout(timeout time.Duration) {
+	dfu.responseTimeout = timeout
+}
+
+// SetPublicKey sets a key to verify packages with. The legacy protocol does
+// not support signed packages, so updates fail if a key is set.
+func (dfu *LegacyDfu) SetPublicKey(key *ecdsa.PublicKey) {
+	dfu.publicKey = key
+}
+
+// SetRetryPolicy sets how failures to connect and to discover the DFU
+// service are retried. The legacy protocol cannot resend part of an image.
+func (dfu *LegacyDfu) SetRetryPolicy(policy RetryPolicy) {
+	dfu.retryPolicy = policy
+}
+
+// SetVerification enables the check that the device runs the new firmware
+// after an update. Nil disables the check.
+func (dfu *LegacyDfu) SetVerification(verification *Verification) {
+	dfu.verification = verification
+}
+
+func (dfu *LegacyDfu) Update(ctx context.Context, filename string, progress DfuProgress) error {
+	pkg, err := OpenPackage(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read firmware archive")
+	}
+	return dfu.UpdatePackage(ctx, pkg, progress)
+}
+
+func (dfu *LegacyDfu) UpdatePackage(ctx context.Context, pkg *Package, progress DfuProgress) error {
+	defer dfu.disconnect()
+
+	err := dfu.preparePackage(pkg)
+	if err != nil {
+		return err
+	}
+
+	dfu.progress = progress
+
+	err = dfu.connectBootloader(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, image := range dfu.pkg.Images {
+		if i > 0 {
+			jww.INFO.Println("Waiting for bootloader to restart.")
+			err = sleep(ctx, 1000*time.Millisecond)
+			if err != nil {
+				return err
+			}
+
+			err = dfu.waitForBootloader(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to reconnect before transferring %s", image.Type)
+			}
+		}
+
+		err = dfu.updateImage(ctx, image)
+		if err != nil {
+			return errors.Wrapf(err, "failed to update %s", image.Type)
+		}
+	}
+
+	if dfu.verification != nil {
+		return dfu.verifyUpdate(ctx)
+	}
+	return nil
+}
+
+// verifyUpdate reconnects to the device after an update, and checks that it
+// left the bootloader and runs the expected firmware.
+func (dfu *LegacyDfu) verifyUpdate(ctx context.Context) error {
+	jww.INFO.Println("Waiting for device to start the new firmware.")
+	err := sleep(ctx, dfu.verification.Delay)
+	if err != nil {
+		return err
+	}
+
+	err = dfu.retryPolicy.do(ctx, "verify update", func(attempt int) error {
+		dfu.disconnect()
+		err := dfu.connectPeripheral()
+		if err != nil {
+			return err
+		}
+
+		// Applications may implement the legacy DFU service as well.
+		if service := dfu.peripheral.FindService(legacyDfuServiceUUID); service != nil {
+			dfu.packet = service.FindCharacteristic(legacyDfuPacketUUID)
+			dfu.version = service.FindCharacteristic(legacyDfuVersionUUID)
+			bootloader, err := dfu.inBootloader()
+			if err != nil {
+				return err
+			}
+			if bootloader {
+				return errStillInBootloader
+			}
+		}
+		return checkFirmwareRevision(dfu.peripheral, dfu.verification.FirmwareRevision)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to verify update")
+	}
+
+	jww.INFO.Printf("Device %s runs the new firmware.\n", dfu.connectedTo())
+	return nil
+}
+
+func (dfu *LegacyDfu) EnterBootloader(ctx context.Context) error {
+	defer dfu.disconnect()
+
+	err := dfu.connectRetrying(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to peripheral")
+	}
+
+	bootloader, err := dfu.inBootloader()
+	if err != nil {
+		return err
+	}
+	if bootloader {
+		jww.INFO.Println("Bootloader already active.")
+		return nil
+	}
+
+	jww.INFO.Println("Switching to DFU mode.")
+	err = dfu.enterBootloader()
+	if err != nil {
+		return errors.Wrap(err, "failed to enter bootloader")
+	}
+
+	err = dfu.waitForBootloader(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to reconnect to bootloader")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+)
+
+// legacyTestImage returns an application image with a legacy init packet
+// that accepts any device and SoftDevice.
+func legacyTestImage(firmware []byte) *Image {
+	initData := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 0x00, 0xFE, 0xFF, 0x00, 0x00}
+	binary.LittleEndian.PutUint16(initData[12:], crc16(firmware))
+
+	return &Image{
+		Type:         ImageTypeApplication,
+		InitDataFile: "application.dat",
+		FirmwareFile: "application.bin",
+		InitData:     initData,
+		Firmware:     firmware,
+	}
+}
+
+func legacyTestPackage(images ...*Image) *Package {
+	pkg := testPackage(images...)
+	pkg.Manifest.DfuVersion = 0.5
+	return pkg
+}
+
+func TestSimLegacyPrn(t *testing.T) {
+	tests := []struct {
+		name    string
+		prn     uint16
+		packets int
+	}{
+		{"disabled", 0, 100},
+		{"partial last receipt", 10, 95},
+		{"last packet on receipt", 10, 100},
+		{"receipt every packet", 1, 20},
+	}
+
+	for _, test := range tests {
+		device := sim.NewDevice(simAddress, "Sensor", sim.ModeApplication, sim.ButtonlessNone)
+		device.Legacy = true
+		firmware := testFirmware(test.packets*legacyPacketSize, 5)
+
+		dfu := NewLegacyDfu(sim.NewClient(device), time.Second)
+		dfu.SetDeviceAddress(simAddress)
+		dfu.SetResponseTimeout(200 * time.Millisecond)
+		dfu.SetPacketReceiptNotification(test.prn)
+		dfu.SetRetryPolicy(noRetries)
+
+		err := dfu.UpdatePackage(context.Background(), legacyTestPackage(legacyTestImage(firmware)), nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkImages(t, device, firmware)
+	}
+}
+
+func TestSimLegacyEnterBootloaderReconnects(t *testing.T) {
+	device := sim.NewDevice(simAddress, "Sensor", sim.ModeApplication, sim.ButtonlessNone)
+	device.Legacy = true
+
+	dfu := NewLegacyDfu(sim.NewClient(device), time.Second)
+	dfu.SetDeviceAddress(simAddress)
+	dfu.SetRetryPolicy(testRetryPolicy())
+	if err := dfu.EnterBootloader(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if device.Mode() != sim.ModeBootloader || device.Connections() != 2 {
+		t.Errorf("device did not reconnect in the bootloader after %d connections", device.Connections())
+	}
+}
+
+func TestSimLegacyRejectsSecurePackage(t *testing.T) {
+	device := sim.NewDevice(simAddress, "Sensor", sim.ModeApplication, sim.ButtonlessNone)
+	device.Legacy = true
+
+	dfu := NewLegacyDfu(sim.NewClient(device), time.Second)
+	dfu.SetDeviceAddress(simAddress)
+	dfu.SetRetryPolicy(noRetries)
+
+	pkg := testPackage(testImage(t, ImageTypeApplication, testFirmware(1000, 6)))
+	if err := dfu.UpdatePackage(context.Background(), pkg, nil); err == nil {
+		t.Fatal("legacy updater accepted a Secure DFU package")
+	}
+	if device.Connections() != 0 || len(device.Images()) != 0 {
+		t.Error("legacy updater connected to the device")
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+	"github.com/rcaelers/nrf-dfu/ihex"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const manifestFilename = "manifest.json"
+
+// Flash regions that are not part of a firmware image.
+const (
+	mbrSize     = 0x1000
+	uicrAddress = 0x10000000
+)
+
+type ImageType string
+
+const (
+	ImageTypeSoftDeviceBootloader ImageType = "softdevice_bootloader"
+	ImageTypeSoftDevice           ImageType = "softdevice"
+	ImageTypeBootloader           ImageType = "bootloader"
+	ImageTypeApplication          ImageType = "application"
+)
+
+// Order in which Nordic requires the images of a package to be transferred.
+var imageTransferOrder = []ImageType{
+	ImageTypeSoftDeviceBootloader,
+	ImageTypeSoftDevice,
+	ImageTypeBootloader,
+	ImageTypeApplication,
+}
+
+var imageTypes = map[initpacket.FwType]ImageType{
+	initpacket.FwTypeApplication:          ImageTypeApplication,
+	initpacket.FwTypeSoftDevice:           ImageTypeSoftDevice,
+	initpacket.FwTypeBootloader:           ImageTypeBootloader,
+	initpacket.FwTypeSoftDeviceBootloader: ImageTypeSoftDeviceBootloader,
+}
+
+type Manifest struct {
+	Application          *ManifestFirmware `json:"application,omitempty"`
+	Bootloader           *ManifestFirmware `json:"bootloader,omitempty"`
+	SoftDevice           *ManifestFirmware `json:"softdevice,omitempty"`
+	SoftDeviceBootloader *ManifestFirmware `json:"softdevice_bootloader,omitempty"`
+
+	// Version of the legacy DFU protocol the package was created for.
+	DfuVersion float64 `json:"dfu_version,omitempty"`
+}
+
+type ManifestFirmware struct {
+	BinFile              string                `json:"bin_file"`
+	DatFile              string                `json:"dat_file"`
+	InfoReadOnlyMetadata *InfoReadOnlyMetadata `json:"info_read_only_metadata,omitempty"`
+
+	// Sizes of a combined SoftDevice and bootloader image in legacy packages.
+	SoftDeviceSize uint32 `json:"sd_size,omitempty"`
+	BootloaderSize uint32 `json:"bl_size,omitempty"`
+}
+
+type InfoReadOnlyMetadata struct {
+	BootloaderSize uint32 `json:"bl_size"`
+	SoftDeviceSize uint32 `json:"sd_size"`
+}
+
+type manifestFile struct {
+	Manifest Manifest `json:"manifest"`
+}
+
+type Image struct {
+	Type         ImageType
+	InitDataFile string
+	FirmwareFile string
+	InitData     []byte
+	Firmware     []byte
+}
+
+type Package struct {
+	Manifest Manifest
+	Images   []*Image
+}
+
+func (m *Manifest) Firmware(imageType ImageType) *ManifestFirmware {
+	switch imageType {
+	case ImageTypeSoftDeviceBootloader:
+		return m.SoftDeviceBootloader
+	case ImageTypeSoftDevice:
+		return m.SoftDevice
+	case ImageTypeBootloader:
+		return m.Bootloader
+	case ImageTypeApplication:
+		return m.Application
+	}
+	return nil
+}
+
+func (m *Manifest) setFirmware(imageType ImageType, firmware *ManifestFirmware) {
+	switch imageType {
+	case ImageTypeSoftDeviceBootloader:
+		m.SoftDeviceBootloader = firmware
+	case ImageTypeSoftDevice:
+		m.SoftDevice = firmware
+	case ImageTypeBootloader:
+		m.Bootloader = firmware
+	case ImageTypeApplication:
+		m.Application = firmware
+	}
+}
+
+// IsLegacy reports whether the package was created for the legacy DFU
+// bootloader of SDK 11 and earlier.
+func (pkg *Package) IsLegacy() bool {
+	return pkg.Manifest.DfuVersion > 0
+}
+
+func (pkg *Package) Size() (size int64) {
+	for _, image := range pkg.Images {
+		size += int64(len(image.InitData) + len(image.Firmware))
+	}
+	return
+}
+
+func OpenPackage(filename string) (*Package, error) {
+	zipFile, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open zip")
+	}
+	defer zipFile.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range zipFile.File {
+		files[f.Name] = f
+	}
+
+	manifestData, err := readZipFile(files, manifestFilename)
+	if err != nil {
+		jww.WARN.Printf("No usable %s in firmware archive, guessing contents.\n", manifestFilename)
+		return guessPackage(files)
+	}
+
+	var manifest manifestFile
+	if err = json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", manifestFilename)
+	}
+
+	pkg := &Package{Manifest: manifest.Manifest}
+	for _, imageType := range imageTransferOrder {
+		firmware := pkg.Manifest.Firmware(imageType)
+		if firmware == nil {
+			continue
+		}
+
+		image, err := readImage(files, imageType, firmware.DatFile, firmware.BinFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s image", imageType)
+		}
+		pkg.Images = append(pkg.Images, image)
+	}
+
+	if len(pkg.Images) == 0 {
+		return nil, errors.Errorf("%s does not contain any firmware image", manifestFilename)
+	}
+	return pkg, nil
+}
+
+// NewImagePackage creates a package with a single image. The type of the
+// image is taken from the init packet. See ReadFirmware for startAddress.
+func NewImagePackage(initDataFile string, firmwareFile string, startAddress *uint32) (*Package, error) {
+	initData, err := ioutil.ReadFile(initDataFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read init packet")
+	}
+
+	packet, err := initpacket.Decode(initData)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid init packet")
+	}
+	init := packet.GetInitCommand()
+	if init == nil {
+		return nil, errors.New("init packet does not contain an init command")
+	}
+
+	imageType, ok := imageTypes[init.GetType()]
+	if !ok {
+		return nil, errors.Errorf("unsupported firmware type %s", init.GetType())
+	}
+
+	firmware, err := ReadFirmware(firmwareFile, imageType, startAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	image := &Image{
+		Type:         imageType,
+		InitDataFile: filepath.Base(initDataFile),
+		FirmwareFile: filepath.Base(firmwareFile),
+		InitData:     initData,
+		Firmware:     firmware,
+	}
+
+	pkg := &Package{Images: []*Image{image}}
+	manifestFirmware := &ManifestFirmware{BinFile: image.FirmwareFile, DatFile: image.InitDataFile}
+	if imageType == ImageTypeSoftDeviceBootloader {
+		manifestFirmware.InfoReadOnlyMetadata = &InfoReadOnlyMetadata{
+			BootloaderSize: init.GetBlSize(),
+			SoftDeviceSize: init.GetSdSize(),
+		}
+	}
+	pkg.Manifest.setFirmware(imageType, manifestFirmware)
+	return pkg, nil
+}
+
+// ReadFirmware reads a raw binary or Intel HEX firmware file. A HEX file is
+// turned into a contiguous image that starts at startAddress, or at the
+// lowest address in the file if startAddress is nil. Gaps are filled with
+// 0xFF, the value of erased flash. UICR contents, and the MBR that precedes
+// a SoftDevice, are not part of the image and are dropped.
+func ReadFirmware(filename string, imageType ImageType, startAddress *uint32) ([]byte, error) {
+	if !isHexFile(filename) {
+		if startAddress != nil {
+			return nil, errors.New("a start address can only be used with Intel HEX files")
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s firmware", imageType)
+		}
+		return data, nil
+	}
+
+	if imageType == ImageTypeSoftDeviceBootloader {
+		return nil, errors.New("a combined SoftDevice and bootloader image cannot be read from an Intel HEX file")
+	}
+
+	file, err := ihex.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s firmware", imageType)
+	}
+
+	if file.EndAddress() > uicrAddress {
+		jww.INFO.Printf("Ignoring data at 0x%08X and above in '%s'.\n", uicrAddress, filename)
+	}
+	start := uint32(0)
+	if imageType == ImageTypeSoftDevice {
+		start = mbrSize
+	}
+	file = file.Slice(start, uicrAddress)
+	if len(file.Segments) == 0 {
+		return nil, errors.Errorf("%s firmware '%s' is empty", imageType, filename)
+	}
+
+	if startAddress == nil {
+		return file.Binary(0xFF), nil
+	}
+	firmware, err := file.BinaryFrom(*startAddress, 0xFF)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s firmware in '%s'", imageType, filename)
+	}
+	return firmware, nil
+}
+
+func isHexFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".hex" || ext == ".ihex"
+}
+
+func (pkg *Package) Write(filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrap(err, "cannot create zip")
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = errors.Wrap(closeErr, "failed to write zip")
+		}
+	}()
+
+	zipFile := zip.NewWriter(f)
+	for _, image := range pkg.Images {
+		if err = writeZipFile(zipFile, image.FirmwareFile, image.Firmware); err != nil {
+			return err
+		}
+		if err = writeZipFile(zipFile, image.InitDataFile, image.InitData); err != nil {
+			return err
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifestFile{Manifest: pkg.Manifest}, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", manifestFilename)
+	}
+	if err = writeZipFile(zipFile, manifestFilename, manifestData); err != nil {
+		return err
+	}
+
+	if err = zipFile.Close(); err != nil {
+		return errors.Wrap(err, "failed to write zip")
+	}
+	return nil
+}
+
+func guessPackage(files map[string]*zip.File) (*Package, error) {
+	datFile := ""
+	binFile := ""
+	for name := range files {
+		if strings.HasSuffix(name, ".dat") {
+			if datFile != "" {
+				return nil, errors.New("firmware archive without manifest contains multiple init packets")
+			}
+			datFile = name
+		}
+		if strings.HasSuffix(name, ".bin") {
+			if binFile != "" {
+				return nil, errors.New("firmware archive without manifest contains multiple firmware images")
+			}
+			binFile = name
+		}
+	}
+
+	image, err := readImage(files, ImageTypeApplication, datFile, binFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Package{
+		Manifest: Manifest{Application: &ManifestFirmware{BinFile: binFile, DatFile: datFile}},
+		Images:   []*Image{image},
+	}, nil
+}
+
+func readImage(files map[string]*zip.File, imageType ImageType, datFile string, binFile string) (*Image, error) {
+	initData, err := readZipFile(files, datFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read init packet")
+	}
+
+	firmware, err := readZipFile(files, binFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read firmware")
+	}
+
+	return &Image{
+		Type:         imageType,
+		InitDataFile: datFile,
+		FirmwareFile: binFile,
+		InitData:     initData,
+		Firmware:     firmware,
+	}, nil
+}
+
+func readZipFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, errors.Errorf("'%s' not found in firmware archive", name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open '%s'", name)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read '%s'", name)
+	}
+	return data, nil
+}
+
+func writeZipFile(zipFile *zip.Writer, name string, data []byte) error {
+	w, err := zipFile.Create(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create '%s'", name)
+	}
+	if _, err = w.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write '%s'", name)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type hexSegment struct {
+	address uint32
+	data    []byte
+}
+
+// writeHexFile writes the segments as an Intel HEX file with 16 byte data
+// records and returns its filename.
+func writeHexFile(t *testing.T, dir string, name string, segments ...hexSegment) string {
+	record := func(recordType byte, address uint16, data ...byte) string {
+		bytes := append([]byte{byte(len(data)), byte(address >> 8), byte(address), recordType}, data...)
+		var sum byte
+		for _, b := range bytes {
+			sum += b
+		}
+		return fmt.Sprintf(":%X%02X\n", bytes, byte(-int(sum)))
+	}
+
+	var text strings.Builder
+	for _, segment := range segments {
+		for offset := 0; offset < len(segment.data); offset += 16 {
+			address := segment.address + uint32(offset)
+			end := offset + 16
+			if end > len(segment.data) {
+				end = len(segment.data)
+			}
+			text.WriteString(record(0x04, 0, byte(address>>24), byte(address>>16)))
+			text.WriteString(record(0x00, uint16(address), segment.data[offset:end]...))
+		}
+	}
+	text.WriteString(record(0x01, 0))
+
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(text.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadFirmware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firmware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mbr := hexSegment{0x0000, testFirmware(mbrSize, 1)}
+	softDevice := hexSegment{mbrSize, testFirmware(0x2000, 2)}
+	application := hexSegment{0x26000, testFirmware(100, 3)}
+	applicationTail := hexSegment{0x26080, testFirmware(20, 4)}
+	uicr := hexSegment{0x10001014, []byte{0x00, 0x00, 0x07, 0x00}}
+
+	fill := func(size int) []byte {
+		return bytes.Repeat([]byte{0xFF}, size)
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	address := func(value uint32) *uint32 {
+		return &value
+	}
+
+	tests := []struct {
+		name         string
+		imageType    ImageType
+		segments     []hexSegment
+		startAddress *uint32
+		expected     []byte
+	}{
+		{"softdevice without mbr", ImageTypeSoftDevice, []hexSegment{mbr, softDevice, uicr}, nil, softDevice.data},
+		{"softdevice", ImageTypeSoftDevice, []hexSegment{softDevice}, nil, softDevice.data},
+		{"application", ImageTypeApplication, []hexSegment{application, uicr}, nil, application.data},
+		{"application with gap", ImageTypeApplication, []hexSegment{application, applicationTail}, nil,
+			concat(application.data, fill(0x80-100), applicationTail.data)},
+		{"start address of data", ImageTypeApplication, []hexSegment{application}, address(0x26000), application.data},
+		{"start address below data", ImageTypeApplication, []hexSegment{application, applicationTail}, address(0x25F00),
+			concat(fill(0x100), application.data, fill(0x80-100), applicationTail.data)},
+		{"softdevice start address", ImageTypeSoftDevice, []hexSegment{mbr, softDevice}, address(mbrSize), softDevice.data},
+		{"bootloader keeps mbr", ImageTypeBootloader, []hexSegment{mbr}, nil, mbr.data},
+	}
+
+	for i, test := range tests {
+		filename := writeHexFile(t, dir, fmt.Sprintf("test%d.hex", i), test.segments...)
+		data, err := ReadFirmware(filename, test.imageType, test.startAddress)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(data, test.expected) {
+			t.Errorf("%s: got %d bytes, expected %d", test.name, len(data), len(test.expected))
+		}
+	}
+
+	errorTests := []struct {
+		name         string
+		imageType    ImageType
+		segments     []hexSegment
+		startAddress *uint32
+		err          string
+	}{
+		{"start address above data", ImageTypeApplication, []hexSegment{application}, address(0x26010), "below start address"},
+		{"softdevice start address in mbr", ImageTypeSoftDevice, []hexSegment{mbr, softDevice}, address(0x1100), "below start address"},
+		{"softdevice without firmware", ImageTypeSoftDevice, []hexSegment{mbr, uicr}, nil, "is empty"},
+		{"only uicr", ImageTypeApplication, []hexSegment{uicr}, nil, "is empty"},
+		{"softdevice and bootloader", ImageTypeSoftDeviceBootloader, []hexSegment{softDevice}, nil, "cannot be read from an Intel HEX file"},
+	}
+
+	for i, test := range errorTests {
+		filename := writeHexFile(t, dir, fmt.Sprintf("error%d.hex", i), test.segments...)
+		_, err := ReadFirmware(filename, test.imageType, test.startAddress)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	filename := filepath.Join(dir, "raw.bin")
+	if err := ioutil.WriteFile(filename, mbr.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFirmware(filename, ImageTypeSoftDevice, nil); err != nil || !bytes.Equal(data, mbr.data) {
+		t.Errorf("binary file was not read unmodified: %v", err)
+	}
+	if _, err := ReadFirmware(filename, ImageTypeApplication, address(0x26000)); err == nil {
+		t.Error("expected an error for a start address with a binary file")
+	}
+}
+
+func TestNewImagePackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firmware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mbr := hexSegment{0x0000, testFirmware(mbrSize, 1)}
+	softDevice := hexSegment{mbrSize, testFirmware(0x2000, 2)}
+	uicr := hexSegment{0x10001014, []byte{0x00, 0x00, 0x07, 0x00}}
+
+	image := testImage(t, ImageTypeSoftDevice, softDevice.data)
+	initDataFile := filepath.Join(dir, "softdevice.dat")
+	if err := ioutil.WriteFile(initDataFile, image.InitData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	firmwareFile := writeHexFile(t, dir, "softdevice.hex", mbr, softDevice, uicr)
+
+	pkg, err := NewImagePackage(initDataFile, firmwareFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkg.Images) != 1 || pkg.Images[0].Type != ImageTypeSoftDevice || !bytes.Equal(pkg.Images[0].Firmware, softDevice.data) {
+		t.Fatal("unexpected package contents")
+	}
+	if pkg.Manifest.SoftDevice == nil || pkg.Manifest.SoftDevice.BinFile != "softdevice.hex" || pkg.Manifest.SoftDevice.DatFile != "softdevice.dat" {
+		t.Errorf("unexpected manifest %+v", pkg.Manifest.SoftDevice)
+	}
+	if err := pkg.Verify(nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const (
+	deviceInformationServiceUUID = "180a"
+	firmwareRevisionUUID         = "2a26"
+)
+
+const DefaultVerifyDelay = time.Second
+
+// Verification describes the check, made after an update, that the device
+// left the bootloader and runs the new firmware.
+type Verification struct {
+	// Time the device is given to start the new firmware before reconnecting.
+	Delay time.Duration
+	// Firmware revision string the Device Information Service must report.
+	// The revision is not checked if empty.
+	FirmwareRevision string
+}
+
+var errStillInBootloader = withClass(ErrorClassDiscovery, errors.New("device is still in bootloader mode"))
+
+// checkFirmwareRevision compares the firmware revision string of the Device
+// Information Service with the expected revision.
+func checkFirmwareRevision(peripheral ble.Peripheral, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	if peripheral.FindService(deviceInformationServiceUUID) == nil {
+		return errors.New("Device Information Service not found")
+	}
+	data, err := peripheral.ReadCharacteristic(firmwareRevisionUUID)
+	if err != nil {
+		return errors.Wrap(err, "failed to read firmware revision")
+	}
+
+	revision := strings.TrimRight(string(data), "\x00")
+	if revision != expected {
+		return errors.Errorf("device reports firmware revision '%s' instead of '%s'", revision, expected)
+	}
+	jww.INFO.Printf("Device reports firmware revision '%s'\n", revision)
+	return nil
+}
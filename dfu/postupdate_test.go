@@ -0,0 +1,82 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+)
+
+func TestSimVerifyRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		revision string
+		expected string
+		err      string
+	}{
+		{"match", "1.2.0", "1.2.0", ""},
+		{"match with terminator", "1.2.0\x00", "1.2.0", ""},
+		{"mismatch", "1.2.0", "2.0.0", "'1.2.0' instead of '2.0.0'"},
+		{"not checked", "", "", ""},
+		{"no device information service", "", "1.2.0", "Device Information Service not found"},
+	}
+
+	for _, test := range tests {
+		device := newSimDevice(sim.ButtonlessBonded)
+		device.FirmwareRevision = test.revision
+		firmware := testFirmware(3000, 7)
+
+		dfu := newSimDfu(device, noRetries)
+		dfu.SetVerification(&Verification{Delay: 10 * time.Millisecond, FirmwareRevision: test.expected})
+		err := dfu.UpdatePackage(context.Background(), testPackage(testImage(t, ImageTypeApplication, firmware)), nil)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+		checkImages(t, device, firmware)
+	}
+}
+
+func TestSimVerifyStillInBootloader(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessBonded)
+	device.FirmwareRevision = "1.2.0"
+
+	// The device stays in the bootloader after receiving a bootloader.
+	dfu := newSimDfu(device, testRetryPolicy())
+	dfu.SetVerification(&Verification{Delay: 10 * time.Millisecond})
+	err := dfu.UpdatePackage(context.Background(), testPackage(testImage(t, ImageTypeBootloader, testFirmware(2000, 8))), nil)
+	if !errors.Is(err, errStillInBootloader) {
+		t.Fatalf("expected errStillInBootloader, got %v", err)
+	}
+	if ClassOf(err) != ErrorClassDiscovery {
+		t.Errorf("error class is %q", ClassOf(err))
+	}
+	if device.Mode() != sim.ModeBootloader {
+		t.Error("device left the bootloader")
+	}
+}
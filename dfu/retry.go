@@ -0,0 +1,189 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// ErrorClass groups errors by what failed, so that a RetryPolicy can decide
+// which failures are worth another attempt.
+type ErrorClass string
+
+const (
+	// The connection to the device could not be established.
+	ErrorClassConnect ErrorClass = "connect"
+	// The DFU service or characteristics were not found, e.g. because the
+	// device has not finished rebooting into the bootloader.
+	ErrorClassDiscovery ErrorClass = "discovery"
+	// The device did not respond within the response timeout.
+	ErrorClassTimeout ErrorClass = "timeout"
+	// The device reported a different offset or CRC than was sent.
+	ErrorClassChecksum ErrorClass = "checksum"
+	// Writing to the device failed.
+	ErrorClassTransport ErrorClass = "transport"
+	// The device rejected a request.
+	ErrorClassProtocol ErrorClass = "protocol"
+)
+
+// ErrorClasses lists all error classes.
+var ErrorClasses = []ErrorClass{
+	ErrorClassConnect,
+	ErrorClassDiscovery,
+	ErrorClassTimeout,
+	ErrorClassChecksum,
+	ErrorClassTransport,
+	ErrorClassProtocol,
+}
+
+// RetryPolicy describes how connecting, service discovery and sending an
+// object are retried. The delay before a retry starts at Backoff, is
+// multiplied by Multiplier after every retry up to MaxBackoff, and is varied
+// randomly by up to Jitter times the delay.
+type RetryPolicy struct {
+	// Number of attempts, including the first. Less than 2 disables retries.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+	Jitter     float64
+	Retryable  []ErrorClass
+}
+
+// DefaultRetryPolicy retries all failures except rejected requests.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   5,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+	Retryable: []ErrorClass{
+		ErrorClassConnect,
+		ErrorClassDiscovery,
+		ErrorClassTimeout,
+		ErrorClassChecksum,
+		ErrorClassTransport,
+	},
+}
+
+// classifiedError attaches an error class to an error without changing its
+// message or cause.
+type classifiedError struct {
+	class ErrorClass
+	err   error
+}
+
+func withClass(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Cause() error {
+	return e.err
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// ClassOf returns the class of err, or an empty class if the error is not
+// classified.
+func ClassOf(err error) ErrorClass {
+	for e := err; e != nil; {
+		if classified, ok := e.(*classifiedError); ok {
+			return classified.class
+		}
+		cause, ok := e.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		e = cause.Cause()
+	}
+
+	switch errors.Cause(err).(type) {
+	case *ProtocolError, *ButtonlessError, *LegacyProtocolError:
+		return ErrorClassProtocol
+	}
+	if errors.Cause(err) == ErrResponseTimeout {
+		return ErrorClassTimeout
+	}
+	return ""
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	class := ClassOf(err)
+	if class == "" {
+		return false
+	}
+	for _, retryable := range p.Retryable {
+		if class == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	delay := float64(p.Backoff)
+	for i := 1; i < retry; i++ {
+		delay *= p.Multiplier
+		if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+			delay = float64(p.MaxBackoff)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+// do calls f until it succeeds, fails with an error that is not retryable,
+// or all attempts are used. f is passed the number of the attempt, starting
+// at 1.
+func (p *RetryPolicy) do(ctx context.Context, what string, f func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := f(attempt)
+		if err == nil || ctx.Err() != nil || attempt >= p.Attempts || !p.retryable(err) {
+			return err
+		}
+
+		delay := p.delay(attempt)
+		jww.WARN.Printf("Failed to %s (attempt %d of %d), retrying in %v: %v\n", what, attempt, p.Attempts, delay.Round(time.Millisecond), err)
+		if err = sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/serial"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+const defaultSerialMtu = 64
+
+type serialTransport struct {
+	port     serial.Port
+	mtu      int
+	pingId   byte
+	mutex    sync.Mutex
+	callback func([]byte)
+	done     chan struct{}
+}
+
+func NewSerialDfu(port string, baudRate int, timeout time.Duration) FirmwareUpdater {
+	dfu := new(Dfu)
+	dfu.responses = newResponseQueue()
+	dfu.port = port
+	dfu.baudRate = baudRate
+	dfu.timeout = timeout
+	dfu.responseTimeout = DefaultResponseTimeout
+	dfu.prn = DefaultPacketReceiptNotification
+	dfu.retryPolicy = DefaultRetryPolicy
+	return dfu
+}
+
+func newSerialTransport(port serial.Port) *serialTransport {
+	t := &serialTransport{
+		port: port,
+		mtu:  defaultSerialMtu,
+		done: make(chan struct{}),
+	}
+	go t.receive()
+	return t
+}
+
+func (dfu *Dfu) connectSerial(ctx context.Context) error {
+	jww.INFO.Printf("Opening '%s'\n", dfu.port)
+
+	// The port disappears for a while when a USB CDC bootloader resets.
+	deadline := time.Now().Add(dfu.timeout)
+	for {
+		port, err := serial.Open(dfu.port, dfu.baudRate)
+		if err == nil {
+			dfu.transport = newSerialTransport(port)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return withClass(ErrorClassConnect, errors.Wrap(err, "failed to open serial port"))
+		}
+		if err = sleep(ctx, 500*time.Millisecond); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *serialTransport) receive() {
+	var decoder serial.SlipDecoder
+	buf := make([]byte, 512)
+
+	for {
+		n, err := t.port.Read(buf)
+
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+
+		// A read timeout is reported as io.EOF.
+		if err != nil && err != io.EOF {
+			jww.ERROR.Printf("Failed to read from serial port: %v\n", err)
+			return
+		}
+
+		for _, frame := range decoder.Decode(buf[:n]) {
+			t.mutex.Lock()
+			callback := t.callback
+			t.mutex.Unlock()
+
+			if callback != nil {
+				callback(frame)
+			} else {
+				jww.DEBUG.Printf("Dropping unexpected serial frame % x\n", frame)
+			}
+		}
+	}
+}
+
+func (t *serialTransport) Subscribe(callback func([]byte)) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.callback = callback
+	return nil
+}
+
+func (t *serialTransport) Unsubscribe() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.callback = nil
+	return nil
+}
+
+func (t *serialTransport) write(data []byte) error {
+	_, err := t.port.Write(serial.EncodeSlip(data))
+	if err != nil {
+		return withClass(ErrorClassTransport, errors.Wrap(err, "failed to write to serial port"))
+	}
+	return nil
+}
+
+func (t *serialTransport) WriteControl(data []byte) error {
+	return t.write(data)
+}
+
+func (t *serialTransport) WriteData(data []byte) error {
+	return t.write(append([]byte{byte(DFU_OP_OBJECT_WRITE)}, data...))
+}
+
+func (t *serialTransport) DataChunkSize() int {
+	// Leave room for the opcode and for the worst case SLIP escaping.
+	return (t.mtu-1)/2 - 1
+}
+
+func (t *serialTransport) Close() error {
+	close(t.done)
+	return t.port.Close()
+}
+
+func (t *serialTransport) handshake(ctx context.Context, dfu *Dfu) error {
+	t.pingId++
+	response, err := dfu.sendControl(ctx, DFU_OP_PING, []byte{t.pingId})
+	if err != nil {
+		return errors.Wrap(err, "failed to ping bootloader")
+	}
+	if len(response) < 1 || response[0] != t.pingId {
+		return errors.New("bootloader returned incorrect ping response")
+	}
+
+	response, err = dfu.sendControl(ctx, DFU_OP_MTU_GET, []byte{})
+	if err != nil {
+		return errors.Wrap(err, "failed to get MTU")
+	}
+	if len(response) < 2 {
+		return errors.New("bootloader returned incorrect MTU response")
+	}
+	t.mtu = int(binary.LittleEndian.Uint16(response))
+	jww.DEBUG.Printf("Serial MTU is %d\n", t.mtu)
+
+	return nil
+}
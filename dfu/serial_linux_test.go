@@ -0,0 +1,229 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/rcaelers/nrf-dfu/serial"
+)
+
+// openPty opens a pseudo-terminal pair, and returns the master and the name
+// of the slave device.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Fatalf("failed to unlock pty: %v", errno)
+	}
+	var index uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&index))); errno != 0 {
+		master.Close()
+		t.Fatalf("failed to get pty number: %v", errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", index)
+}
+
+// fakeSerialBootloader implements the serial Secure DFU protocol on the
+// master side of a pty.
+type fakeSerialBootloader struct {
+	port io.ReadWriter
+	mtu  uint16
+
+	mutex         sync.Mutex
+	objects       map[byte][]byte
+	current       byte
+	pings         []byte
+	mtuRequests   int
+	maxFrameSize  int
+	protocolError error
+}
+
+func newFakeSerialBootloader(port io.ReadWriter, mtu uint16) *fakeSerialBootloader {
+	return &fakeSerialBootloader{port: port, mtu: mtu, objects: map[byte][]byte{}}
+}
+
+func (b *fakeSerialBootloader) run() {
+	var decoder serial.SlipDecoder
+	var frameSize int
+	buf := make([]byte, 1024)
+
+	for {
+		n, err := b.port.Read(buf)
+		if err != nil {
+			return
+		}
+
+		// Measure the encoded frames, the MTU applies to those.
+		for _, c := range buf[:n] {
+			frameSize++
+			if c == 0xC0 {
+				b.mutex.Lock()
+				if frameSize > b.maxFrameSize {
+					b.maxFrameSize = frameSize
+				}
+				b.mutex.Unlock()
+				frameSize = 0
+			}
+		}
+
+		for _, frame := range decoder.Decode(buf[:n]) {
+			if response := b.handle(frame); response != nil {
+				b.port.Write(serial.EncodeSlip(response))
+			}
+		}
+	}
+}
+
+func (b *fakeSerialBootloader) handle(frame []byte) []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	opcode := dfuOperation(frame[0])
+	response := []byte{byte(DFU_OP_RESPONSE), frame[0], byte(DFU_RESULT_SUCCESS)}
+	checksum := func() []byte {
+		data := b.objects[b.current]
+		return le32(uint32(len(data)), crc32.ChecksumIEEE(data))
+	}
+
+	switch opcode {
+	case DFU_OP_PING:
+		b.pings = append(b.pings, frame[1])
+		return append(response, frame[1])
+	case DFU_OP_MTU_GET:
+		b.mtuRequests++
+		return append(response, byte(b.mtu), byte(b.mtu>>8))
+	case DFU_OP_RECEIPT_NOTIF_SET:
+		return response
+	case DFU_OP_OBJECT_SELECT:
+		b.current = frame[1]
+		return append(append(response, le32(4096)...), checksum()...)
+	case DFU_OP_OBJECT_CREATE:
+		b.current = frame[1]
+		return response
+	case DFU_OP_OBJECT_WRITE:
+		b.objects[b.current] = append(b.objects[b.current], frame[1:]...)
+		return nil
+	case DFU_OP_CRC_GET:
+		return append(response, checksum()...)
+	case DFU_OP_OBJECT_EXECUTE:
+		return response
+	}
+
+	b.protocolError = fmt.Errorf("unexpected opcode %s", opcode)
+	response[2] = byte(DFU_RESULT_OPCODE_NOT_SUPPORTED)
+	return response
+}
+
+func le32(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], value)
+	}
+	return data
+}
+
+func TestSerialUpdate(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+
+	bootloader := newFakeSerialBootloader(master, 64)
+	go bootloader.run()
+
+	// Lots of bytes that need escaping.
+	firmware := bytes.Repeat([]byte{0xC0, 0xDB, 0x01, 0xDC, 0xDD}, 2000)
+	image := testImage(t, ImageTypeApplication, firmware)
+
+	dfu := NewSerialDfu(slave, 115200, 2*time.Second)
+	dfu.SetPacketReceiptNotification(0)
+	err := dfu.UpdatePackage(context.Background(), testPackage(image), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootloader.mutex.Lock()
+	defer bootloader.mutex.Unlock()
+
+	if bootloader.protocolError != nil {
+		t.Fatal(bootloader.protocolError)
+	}
+	if len(bootloader.pings) == 0 || bootloader.mtuRequests == 0 {
+		t.Fatalf("handshake incomplete: %d pings, %d MTU requests", len(bootloader.pings), bootloader.mtuRequests)
+	}
+	for i := 1; i < len(bootloader.pings); i++ {
+		if bootloader.pings[i] == bootloader.pings[i-1] {
+			t.Errorf("ping id %d reused", bootloader.pings[i])
+		}
+	}
+	if bootloader.maxFrameSize > int(bootloader.mtu) {
+		t.Errorf("frame of %d bytes exceeds MTU %d", bootloader.maxFrameSize, bootloader.mtu)
+	}
+	if !bytes.Equal(bootloader.objects[dfuObjectCommand], image.InitData) {
+		t.Error("init packet corrupted")
+	}
+	if !bytes.Equal(bootloader.objects[dfuObjectData], firmware) {
+		t.Error("firmware corrupted")
+	}
+}
+
+func TestSerialPingMismatch(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+
+	go func() {
+		var decoder serial.SlipDecoder
+		buf := make([]byte, 256)
+		for {
+			n, err := master.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, frame := range decoder.Decode(buf[:n]) {
+				master.Write(serial.EncodeSlip([]byte{byte(DFU_OP_RESPONSE), frame[0], byte(DFU_RESULT_SUCCESS), frame[1] + 1}))
+			}
+		}
+	}()
+
+	dfu := NewSerialDfu(slave, 115200, time.Second)
+	dfu.SetRetryPolicy(RetryPolicy{Attempts: 1})
+	image := testImage(t, ImageTypeApplication, testFirmware(100, 1))
+	err := dfu.UpdatePackage(context.Background(), testPackage(image), nil)
+	if err == nil || !strings.Contains(err.Error(), "incorrect ping response") {
+		t.Fatalf("expected ping failure, got %v", err)
+	}
+}
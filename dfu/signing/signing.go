@@ -0,0 +1,200 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package signing implements the ECDSA P-256 signatures used by Nordic's
+// Secure DFU bootloader. The bootloader expects the signature as the r and s
+// values, each 32 bytes in little-endian byte order.
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+const coordinateSize = 32
+
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+	return key, nil
+}
+
+// EncodePrivateKey returns the key as a SEC 1 PEM block, like nrfutil does.
+func EncodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func EncodePublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// RawPublicKey returns the x and y coordinates of the key, each 32 bytes in
+// little-endian byte order, as the bootloader expects them.
+func RawPublicKey(key *ecdsa.PublicKey) []byte {
+	return append(littleEndian(key.X), littleEndian(key.Y)...)
+}
+
+// RawPrivateKey returns the private scalar in big-endian byte order.
+func RawPrivateKey(key *ecdsa.PrivateKey) []byte {
+	data := make([]byte, coordinateSize)
+	bytes := key.D.Bytes()
+	copy(data[coordinateSize-len(bytes):], bytes)
+	return data
+}
+
+func LoadPrivateKey(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read private key")
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key in '%s'", filename)
+	}
+	return key, nil
+}
+
+func ParsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse private key")
+		}
+
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, errors.New("private key is not an ECDSA P-256 key")
+		}
+		return ecKey, nil
+	}
+}
+
+// LoadPublicKey reads a public key from a PEM file. If the file holds a
+// private key, its public part is returned.
+func LoadPublicKey(filename string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read public key")
+	}
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid public key in '%s'", filename)
+	}
+	return key, nil
+}
+
+func ParsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no public key found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		privateKey, err := ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return &privateKey.PublicKey, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("public key is not an ECDSA P-256 key")
+	}
+	return ecKey, nil
+}
+
+// Sign signs data and returns the signature in the bootloader's format.
+func Sign(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign")
+	}
+	return append(littleEndian(r), littleEndian(s)...), nil
+}
+
+// Verify checks a signature in the bootloader's format.
+func Verify(key *ecdsa.PublicKey, data []byte, signature []byte) error {
+	if len(signature) != 2*coordinateSize {
+		return errors.Errorf("invalid signature length %d", len(signature))
+	}
+	r := fromLittleEndian(signature[:coordinateSize])
+	s := fromLittleEndian(signature[coordinateSize:])
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+func littleEndian(value *big.Int) []byte {
+	data := make([]byte, coordinateSize)
+	bytes := value.Bytes()
+	for i, b := range bytes {
+		data[len(bytes)-1-i] = b
+	}
+	return data
+}
+
+func fromLittleEndian(data []byte) *big.Int {
+	bytes := make([]byte, len(data))
+	for i, b := range data {
+		bytes[len(data)-1-i] = b
+	}
+	return new(big.Int).SetBytes(bytes)
+}
@@ -0,0 +1,291 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+)
+
+const simAddress = "aa:bb:cc:dd:ee:ff"
+
+var noRetries = RetryPolicy{Attempts: 1}
+
+func testRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy
+	policy.Backoff = 10 * time.Millisecond
+	return policy
+}
+
+func newSimDevice(buttonless sim.Buttonless) *sim.Device {
+	mode := sim.ModeApplication
+	if buttonless == sim.ButtonlessNone {
+		mode = sim.ModeBootloader
+	}
+	return sim.NewDevice(simAddress, "Sensor", mode, buttonless)
+}
+
+func newSimDfu(device *sim.Device, policy RetryPolicy) FirmwareUpdater {
+	dfu := NewDfu(sim.NewClient(device), time.Second)
+	dfu.SetDeviceAddress(device.Address)
+	dfu.SetResponseTimeout(200 * time.Millisecond)
+	dfu.SetRetryPolicy(policy)
+	return dfu
+}
+
+func checkImages(t *testing.T, device *sim.Device, firmware ...[]byte) {
+	t.Helper()
+
+	images := device.Images()
+	if len(images) != len(firmware) {
+		t.Fatalf("device received %d images, expected %d", len(images), len(firmware))
+	}
+	for i := range images {
+		if !bytes.Equal(images[i].Firmware, firmware[i]) {
+			t.Errorf("image %d differs from the firmware sent", i)
+		}
+	}
+	if device.Mode() != sim.ModeApplication {
+		t.Error("device did not start the application")
+	}
+}
+
+func TestSimUpdate(t *testing.T) {
+	for _, buttonless := range []sim.Buttonless{sim.ButtonlessNone, sim.ButtonlessBonded, sim.ButtonlessUnbonded} {
+		device := newSimDevice(buttonless)
+		firmware := testFirmware(10000, 1)
+
+		var progress, maxProgress int64
+		err := newSimDfu(device, noRetries).UpdatePackage(context.Background(), testPackage(testImage(t, ImageTypeApplication, firmware)), func(value int64, maxValue int64, info string) {
+			progress, maxProgress = value, maxValue
+		})
+		if err != nil {
+			t.Fatalf("buttonless %d: %v", buttonless, err)
+		}
+		checkImages(t, device, firmware)
+		if progress != maxProgress {
+			t.Errorf("buttonless %d: progress ended at %d of %d", buttonless, progress, maxProgress)
+		}
+	}
+}
+
+func TestSimUpdateMultipleImages(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessBonded)
+	softDeviceBootloader := testFirmware(9000, 2)
+	application := testFirmware(8192, 3)
+
+	pkg := testPackage(
+		testImage(t, ImageTypeSoftDeviceBootloader, softDeviceBootloader),
+		testImage(t, ImageTypeApplication, application),
+	)
+	err := newSimDfu(device, noRetries).UpdatePackage(context.Background(), pkg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImages(t, device, softDeviceBootloader, application)
+}
+
+func TestSimFaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     sim.Fault
+		prn       uint16
+		class     ErrorClass
+		retryable bool
+	}{
+		{
+			name:      "CRC mismatch",
+			fault:     sim.Fault{Type: sim.FaultCrcMismatch, Opcode: int(DFU_OP_CRC_GET), After: 1},
+			class:     ErrorClassChecksum,
+			retryable: true,
+		},
+		{
+			name:      "CRC mismatch in receipt notification",
+			fault:     sim.Fault{Type: sim.FaultCrcMismatch, Opcode: sim.PacketData, After: 5000},
+			prn:       3,
+			class:     ErrorClassChecksum,
+			retryable: true,
+		},
+		{
+			name:      "dropped execute response",
+			fault:     sim.Fault{Type: sim.FaultDropNotification, Opcode: int(DFU_OP_OBJECT_EXECUTE), After: 1},
+			class:     ErrorClassTimeout,
+			retryable: true,
+		},
+		{
+			name:      "disconnect mid-object",
+			fault:     sim.Fault{Type: sim.FaultDisconnect, Opcode: sim.PacketData, After: 6000},
+			class:     ErrorClassTransport,
+			retryable: true,
+		},
+		{
+			name:  "insufficient resources",
+			fault: sim.Fault{Type: sim.FaultInsufficientResources, Opcode: int(DFU_OP_OBJECT_CREATE), After: 2},
+			class: ErrorClassProtocol,
+		},
+	}
+
+	for _, test := range tests {
+		firmware := testFirmware(10000, 4)
+		pkg := testPackage(testImage(t, ImageTypeApplication, firmware))
+
+		device := newSimDevice(sim.ButtonlessNone)
+		device.InjectFault(test.fault)
+		dfu := newSimDfu(device, noRetries)
+		dfu.SetPacketReceiptNotification(test.prn)
+		err := dfu.UpdatePackage(context.Background(), pkg, nil)
+		if err == nil {
+			t.Errorf("%s: update succeeded", test.name)
+			continue
+		}
+		if class := ClassOf(err); class != test.class {
+			t.Errorf("%s: failure classified as '%s', expected '%s': %v", test.name, class, test.class, err)
+		}
+
+		device = newSimDevice(sim.ButtonlessNone)
+		device.InjectFault(test.fault)
+		dfu = newSimDfu(device, testRetryPolicy())
+		dfu.SetPacketReceiptNotification(test.prn)
+		err = dfu.UpdatePackage(context.Background(), pkg, nil)
+		if !test.retryable {
+			if err == nil {
+				t.Errorf("%s: update succeeded after retrying", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: retrying did not recover: %v", test.name, err)
+			continue
+		}
+		checkImages(t, device, firmware)
+	}
+}
+
+func TestSimInsufficientResources(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessNone)
+	device.InjectFault(sim.Fault{Type: sim.FaultInsufficientResources, Opcode: int(DFU_OP_OBJECT_CREATE), After: 0})
+
+	pkg := testPackage(testImage(t, ImageTypeApplication, testFirmware(10000, 5)))
+	err := newSimDfu(device, testRetryPolicy()).UpdatePackage(context.Background(), pkg, nil)
+
+	var protocolError *ProtocolError
+	if !errors.As(err, &protocolError) {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+	if protocolError.Opcode != DFU_OP_OBJECT_CREATE || protocolError.Result != DFU_RESULT_INSUFFICIENT_RESOURCES {
+		t.Fatalf("unexpected protocol error: %v", protocolError)
+	}
+}
+
+func TestSimResume(t *testing.T) {
+	for _, offset := range []int{6000, 2 * 4096, 9999} {
+		firmware := testFirmware(10000, 6)
+		pkg := testPackage(testImage(t, ImageTypeApplication, firmware))
+
+		device := newSimDevice(sim.ButtonlessNone)
+		device.InjectFault(sim.Fault{Type: sim.FaultDisconnect, Opcode: sim.PacketData, After: offset})
+		dfu := newSimDfu(device, noRetries)
+		if err := dfu.UpdatePackage(context.Background(), pkg, nil); err == nil {
+			t.Fatalf("offset %d: interrupted update succeeded", offset)
+		}
+
+		// Objects that were executed before the disconnect are not sent
+		// again, progress skips over them.
+		var progress, skipped int64
+		err := dfu.UpdatePackage(context.Background(), pkg, func(value int64, maxValue int64, info string) {
+			if value-progress > skipped {
+				skipped = value - progress
+			}
+			progress = value
+		})
+		if err != nil {
+			t.Fatalf("offset %d: resume failed: %v", offset, err)
+		}
+		checkImages(t, device, firmware)
+
+		executed := int64((offset - 1) / 4096 * 4096)
+		if skipped < executed {
+			t.Errorf("offset %d: skipped %d bytes, expected at least %d", offset, skipped, executed)
+		}
+	}
+}
+
+func TestSimPrn(t *testing.T) {
+	for _, prn := range []uint16{0, 1, 3, 12} {
+		device := newSimDevice(sim.ButtonlessNone)
+		firmware := testFirmware(10000, 7)
+
+		dfu := newSimDfu(device, noRetries)
+		dfu.SetPacketReceiptNotification(prn)
+		err := dfu.UpdatePackage(context.Background(), testPackage(testImage(t, ImageTypeApplication, firmware)), nil)
+		if err != nil {
+			t.Fatalf("prn %d: %v", prn, err)
+		}
+		checkImages(t, device, firmware)
+	}
+}
+
+func TestSimCancel(t *testing.T) {
+	device := newSimDevice(sim.ButtonlessNone)
+	pkg := testPackage(testImage(t, ImageTypeApplication, testFirmware(10000, 8)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := newSimDfu(device, noRetries).UpdatePackage(ctx, pkg, func(value int64, maxValue int64, info string) {
+		if value > 5000 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if len(device.Images()) != 0 {
+		t.Fatal("cancelled update was activated")
+	}
+}
+
+func TestSimEnterBootloader(t *testing.T) {
+	for _, buttonless := range []sim.Buttonless{sim.ButtonlessNone, sim.ButtonlessBonded, sim.ButtonlessUnbonded} {
+		device := newSimDevice(buttonless)
+
+		err := newSimDfu(device, testRetryPolicy()).EnterBootloader(context.Background())
+		if err != nil {
+			t.Fatalf("buttonless %d: %v", buttonless, err)
+		}
+		if device.Mode() != sim.ModeBootloader {
+			t.Errorf("buttonless %d: device is not running the bootloader", buttonless)
+		}
+
+		// The bootloader is confirmed by connecting to it again.
+		connections := 2
+		if buttonless == sim.ButtonlessNone {
+			connections = 1
+		}
+		if device.Connections() != connections {
+			t.Errorf("buttonless %d: %d connections, expected %d", buttonless, device.Connections(), connections)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rcaelers/nrf-dfu/ble/sim"
+	"github.com/rcaelers/nrf-dfu/ble/trace"
+)
+
+func TestReplayUpdate(t *testing.T) {
+	for _, buttonless := range []sim.Buttonless{sim.ButtonlessNone, sim.ButtonlessUnbonded} {
+		device := newSimDevice(buttonless)
+		firmware := testFirmware(10000, 1)
+		pkg := testPackage(testImage(t, ImageTypeApplication, firmware))
+
+		var recording bytes.Buffer
+		recorder := trace.NewRecorder(sim.NewClient(device), &recording)
+		dfu := NewDfu(recorder, time.Second)
+		dfu.SetDeviceAddress(simAddress)
+		if err := dfu.UpdatePackage(context.Background(), pkg, nil); err != nil {
+			t.Fatalf("buttonless %d: %v", buttonless, err)
+		}
+		if err := recorder.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		replay := func(pkg *Package) (*trace.ReplayClient, error) {
+			client, err := trace.NewReplayClient(bytes.NewReader(recording.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			dfu := NewDfu(client, time.Second)
+			dfu.SetDeviceAddress(simAddress)
+			dfu.SetResponseTimeout(200 * time.Millisecond)
+			dfu.SetRetryPolicy(noRetries)
+			// The unbonded bootloader advertises the random name chosen
+			// while recording.
+			if names := client.Names(); len(names) > 0 {
+				dfu.(*Dfu).SetBootloaderName(names[0])
+			}
+			return client, dfu.UpdatePackage(context.Background(), pkg, nil)
+		}
+
+		client, err := replay(pkg)
+		if err != nil {
+			t.Fatalf("buttonless %d: replay failed: %v", buttonless, err)
+		}
+		if !client.Complete() || client.Err() != nil {
+			t.Errorf("buttonless %d: replay incomplete: %v", buttonless, client.Err())
+		}
+
+		client, err = replay(testPackage(testImage(t, ImageTypeApplication, testFirmware(10000, 2))))
+		if err == nil || client.Err() == nil {
+			t.Errorf("buttonless %d: replay of different firmware did not diverge: %v", buttonless, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/ble"
+)
+
+type dfuTransport interface {
+	Subscribe(callback func([]byte)) error
+	Unsubscribe() error
+	WriteControl(data []byte) error
+	WriteData(data []byte) error
+	DataChunkSize() int
+	Close() error
+
+	handshake(ctx context.Context, dfu *Dfu) error
+}
+
+type bleTransport struct {
+	control ble.Characteristic
+	packet  ble.Characteristic
+	mtu     int
+}
+
+const attOverhead = 3
+
+func newBleTransport(control ble.Characteristic, packet ble.Characteristic, mtu int) *bleTransport {
+	return &bleTransport{control: control, packet: packet, mtu: mtu}
+}
+
+func (t *bleTransport) Subscribe(callback func([]byte)) error {
+	err := t.control.Subscribe(ble.SubscriptionTypeNotification, callback)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to control characteristic")
+	}
+	return nil
+}
+
+func (t *bleTransport) Unsubscribe() error {
+	return t.control.Unsubscribe(ble.SubscriptionTypeNotification)
+}
+
+func (t *bleTransport) WriteControl(data []byte) error {
+	err := t.control.WriteCharacteristic(data, ble.WithResponse)
+	if err != nil {
+		return withClass(ErrorClassTransport, errors.Wrap(err, "failed to write to control characteristic"))
+	}
+	return nil
+}
+
+func (t *bleTransport) WriteData(data []byte) error {
+	err := t.packet.WriteCharacteristic(data, ble.NoResponse)
+	if err != nil {
+		return withClass(ErrorClassTransport, errors.Wrap(err, "failed to write to packet characteristic"))
+	}
+	return nil
+}
+
+func (t *bleTransport) DataChunkSize() int {
+	return t.mtu - attOverhead
+}
+
+func (t *bleTransport) Close() error {
+	return nil
+}
+
+func (t *bleTransport) handshake(ctx context.Context, dfu *Dfu) error {
+	return nil
+}
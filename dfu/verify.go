@@ -0,0 +1,104 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+	"github.com/rcaelers/nrf-dfu/dfu/initpacket"
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// VerifyHash checks that the hash in the init packet matches the firmware.
+// Images without a SHA-256 hash cannot be checked and are accepted.
+func (image *Image) VerifyHash() error {
+	packet, err := initpacket.Decode(image.InitData)
+	if err != nil {
+		return err
+	}
+	init := packet.GetInitCommand()
+	if init == nil {
+		return errors.New("init packet does not contain an init command")
+	}
+
+	if size := init.FirmwareSize(); size != 0 && size != uint32(len(image.Firmware)) {
+		return errors.Errorf("firmware size %d does not match size %d in init packet", len(image.Firmware), size)
+	}
+
+	if init.Hash == nil || init.Hash.HashType != initpacket.HashTypeSha256 {
+		jww.WARN.Printf("Init packet of %s has no SHA-256 hash, cannot verify firmware.\n", image.Type)
+		return nil
+	}
+
+	if !bytes.Equal(firmwareHash(image.Firmware), init.Hash.Hash) {
+		return errors.New("firmware hash does not match hash in init packet")
+	}
+	return nil
+}
+
+// VerifySignature checks the signature of the init packet against key.
+func (image *Image) VerifySignature(key *ecdsa.PublicKey) error {
+	packet, err := initpacket.Decode(image.InitData)
+	if err != nil {
+		return err
+	}
+	if !packet.IsSigned() {
+		return errors.New("init packet is not signed")
+	}
+
+	signed := packet.SignedCommand
+	if signed.SignatureType != initpacket.SignatureTypeEcdsaP256Sha256 {
+		return errors.Errorf("unsupported signature type %s", signed.SignatureType)
+	}
+	return signing.Verify(key, signed.SignedData(), signed.Signature)
+}
+
+// firmwareHash returns the SHA-256 hash of the firmware in little-endian byte
+// order, as the bootloader expects it.
+func firmwareHash(firmware []byte) []byte {
+	digest := sha256.Sum256(firmware)
+	hash := make([]byte, len(digest))
+	for i, b := range digest {
+		hash[len(digest)-1-i] = b
+	}
+	return hash
+}
+
+// Verify checks the hashes of all images, and their signatures if key is
+// not nil.
+func (pkg *Package) Verify(key *ecdsa.PublicKey) error {
+	for _, image := range pkg.Images {
+		if err := image.VerifyHash(); err != nil {
+			return errors.Wrapf(err, "invalid %s image", image.Type)
+		}
+		if key == nil {
+			continue
+		}
+		if err := image.VerifySignature(key); err != nil {
+			return errors.Wrapf(err, "invalid %s image", image.Type)
+		}
+	}
+	return nil
+}
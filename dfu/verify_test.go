@@ -0,0 +1,127 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package dfu
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/rcaelers/nrf-dfu/dfu/signing"
+)
+
+// signedTestImage returns the application in testdata. Its init packet was
+// signed by openssl with the private key of testdata/public.pem.
+func signedTestImage(t *testing.T) *Image {
+	initData, err := ioutil.ReadFile("testdata/app_signed.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firmware, err := ioutil.ReadFile("testdata/app.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Image{
+		Type:         ImageTypeApplication,
+		InitDataFile: "app_signed.dat",
+		FirmwareFile: "app.bin",
+		InitData:     initData,
+		Firmware:     firmware,
+	}
+}
+
+func TestVerifySignedImage(t *testing.T) {
+	key, err := signing.LoadPublicKey("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := signedTestImage(t)
+
+	if err := image.VerifyHash(); err != nil {
+		t.Error(err)
+	}
+	if err := image.VerifySignature(key); err != nil {
+		t.Error(err)
+	}
+	if err := testPackage(image).Verify(key); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyFlippedFirmware(t *testing.T) {
+	key, err := signing.LoadPublicKey("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := signedTestImage(t)
+	image.Firmware[1000] ^= 0x01
+
+	if err := image.VerifyHash(); err == nil {
+		t.Error("firmware with a flipped byte passed the hash check")
+	}
+	if err := image.VerifySignature(key); err != nil {
+		t.Errorf("signature of the init packet should still be valid: %v", err)
+	}
+	if err := testPackage(image).Verify(nil); err == nil {
+		t.Error("package with a flipped byte passed verification")
+	}
+}
+
+func TestVerifyTruncatedFirmware(t *testing.T) {
+	image := signedTestImage(t)
+	image.Firmware = image.Firmware[:len(image.Firmware)-1]
+
+	if err := image.VerifyHash(); err == nil {
+		t.Error("truncated firmware passed the hash check")
+	}
+}
+
+func TestVerifyOtherKey(t *testing.T) {
+	otherKey, err := signing.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := signedTestImage(t)
+
+	if err := image.VerifySignature(&otherKey.PublicKey); err == nil {
+		t.Error("signature verified against a different key")
+	}
+	if err := testPackage(image).Verify(&otherKey.PublicKey); err == nil {
+		t.Error("package verified against a different key")
+	}
+}
+
+func TestVerifyUnsignedImage(t *testing.T) {
+	key, err := signing.LoadPublicKey("testdata/public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := testImage(t, ImageTypeApplication, testFirmware(1024, 1))
+
+	if err := image.VerifyHash(); err != nil {
+		t.Error(err)
+	}
+	if err := image.VerifySignature(key); err == nil {
+		t.Error("unsigned image passed the signature check")
+	}
+	if err := testPackage(image).Verify(nil); err != nil {
+		t.Errorf("unsigned package should pass without a key: %v", err)
+	}
+}
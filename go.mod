@@ -2,10 +2,13 @@ module github.com/rcaelers/nrf-dfu
 
 require (
 	github.com/go-ble/ble v0.0.0-20180718090407-11b1dad1df3d
-	github.com/pkg/errors v0.8.0
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/jwalterweatherman v0.0.0-20180109140146-7c0cea34c8ec
+	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	gopkg.in/cheggaaa/pb.v2 v2.0.6
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
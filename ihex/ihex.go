@@ -0,0 +1,248 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package ihex reads Intel HEX files.
+package ihex
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	recordData                   = 0x00
+	recordEndOfFile              = 0x01
+	recordExtendedSegmentAddress = 0x02
+	recordStartSegmentAddress    = 0x03
+	recordExtendedLinearAddress  = 0x04
+	recordStartLinearAddress     = 0x05
+)
+
+// Segment is a contiguous block of data.
+type Segment struct {
+	Address uint32
+	Data    []byte
+}
+
+func (s *Segment) End() uint32 {
+	return s.Address + uint32(len(s.Data))
+}
+
+// File holds the data of an Intel HEX file as non-overlapping segments,
+// ordered by address.
+type File struct {
+	Segments []*Segment
+}
+
+func ReadFile(filename string) (*File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open hex file")
+	}
+	defer f.Close()
+
+	file, err := Parse(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse '%s'", filename)
+	}
+	return file, nil
+}
+
+func Parse(r io.Reader) (*File, error) {
+	file := &File{}
+	var base uint32
+	eof := false
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if eof {
+			return nil, errors.Errorf("line %d: data after end of file record", lineNumber)
+		}
+
+		record, err := parseRecord(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber)
+		}
+
+		recordType := record[3]
+		address := uint32(record[1])<<8 | uint32(record[2])
+		data := record[4 : len(record)-1]
+
+		switch recordType {
+		case recordData:
+			err = file.add(base+address, data)
+		case recordEndOfFile:
+			eof = true
+		case recordExtendedSegmentAddress:
+			if len(data) != 2 {
+				return nil, errors.Errorf("line %d: invalid extended segment address record", lineNumber)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case recordExtendedLinearAddress:
+			if len(data) != 2 {
+				return nil, errors.Errorf("line %d: invalid extended linear address record", lineNumber)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case recordStartSegmentAddress, recordStartLinearAddress:
+		default:
+			return nil, errors.Errorf("line %d: unsupported record type 0x%02X", lineNumber, recordType)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read hex file")
+	}
+	if !eof {
+		return nil, errors.New("missing end of file record")
+	}
+	return file, nil
+}
+
+func parseRecord(line string) ([]byte, error) {
+	if !strings.HasPrefix(line, ":") {
+		return nil, errors.New("record does not start with ':'")
+	}
+
+	record, err := hex.DecodeString(line[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid record")
+	}
+	if len(record) < 5 || len(record) != int(record[0])+5 {
+		return nil, errors.New("invalid record length")
+	}
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, errors.New("invalid record checksum")
+	}
+	return record, nil
+}
+
+func (f *File) add(address uint32, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	end := address + uint32(len(data))
+
+	i := sort.Search(len(f.Segments), func(i int) bool {
+		return f.Segments[i].End() > address
+	})
+	if i < len(f.Segments) && f.Segments[i].Address < end {
+		return errors.Errorf("data at 0x%08X overlaps earlier data", address)
+	}
+
+	// Records usually follow each other, so extend adjacent segments if possible.
+	joinPrevious := i > 0 && f.Segments[i-1].End() == address
+	joinNext := i < len(f.Segments) && f.Segments[i].Address == end
+
+	switch {
+	case joinPrevious && joinNext:
+		f.Segments[i-1].Data = append(append(f.Segments[i-1].Data, data...), f.Segments[i].Data...)
+		f.Segments = append(f.Segments[:i], f.Segments[i+1:]...)
+	case joinPrevious:
+		f.Segments[i-1].Data = append(f.Segments[i-1].Data, data...)
+	case joinNext:
+		f.Segments[i].Address = address
+		f.Segments[i].Data = append(append([]byte{}, data...), f.Segments[i].Data...)
+	default:
+		f.Segments = append(f.Segments, nil)
+		copy(f.Segments[i+1:], f.Segments[i:])
+		f.Segments[i] = &Segment{Address: address, Data: append([]byte{}, data...)}
+	}
+	return nil
+}
+
+func (f *File) StartAddress() uint32 {
+	if len(f.Segments) == 0 {
+		return 0
+	}
+	return f.Segments[0].Address
+}
+
+func (f *File) EndAddress() uint32 {
+	if len(f.Segments) == 0 {
+		return 0
+	}
+	return f.Segments[len(f.Segments)-1].End()
+}
+
+// Slice returns a copy of the file restricted to the address range
+// [start, end).
+func (f *File) Slice(start uint32, end uint32) *File {
+	slice := &File{}
+	for _, segment := range f.Segments {
+		from, to := segment.Address, segment.End()
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if from >= to {
+			continue
+		}
+		data := segment.Data[from-segment.Address : to-segment.Address]
+		slice.Segments = append(slice.Segments, &Segment{Address: from, Data: append([]byte{}, data...)})
+	}
+	return slice
+}
+
+// BinaryFrom returns the data of the file as one contiguous image, starting
+// at address start. Gaps are filled with fill. It fails if the file contains
+// data below start.
+func (f *File) BinaryFrom(start uint32, fill byte) ([]byte, error) {
+	if len(f.Segments) == 0 {
+		return nil, errors.New("no data")
+	}
+	if f.StartAddress() < start {
+		return nil, errors.Errorf("data at 0x%08X is below start address 0x%08X", f.StartAddress(), start)
+	}
+
+	image := make([]byte, f.EndAddress()-start)
+	for i := range image {
+		image[i] = fill
+	}
+	for _, segment := range f.Segments {
+		copy(image[segment.Address-start:], segment.Data)
+	}
+	return image, nil
+}
+
+// Binary returns the data of the file as one contiguous image, starting at
+// the lowest address. Gaps between segments are filled with fill.
+func (f *File) Binary(fill byte) []byte {
+	image, _ := f.BinaryFrom(f.StartAddress(), fill)
+	return image
+}
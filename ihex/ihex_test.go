@@ -0,0 +1,184 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package ihex
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// record returns an Intel HEX record with a valid checksum.
+func record(recordType byte, address uint16, data ...byte) string {
+	bytes := append([]byte{byte(len(data)), byte(address >> 8), byte(address), recordType}, data...)
+	var sum byte
+	for _, b := range bytes {
+		sum += b
+	}
+	return fmt.Sprintf(":%X%02X", bytes, byte(-int(sum)))
+}
+
+func hexFile(records ...string) string {
+	return strings.Join(append(records, record(recordEndOfFile, 0)), "\n") + "\n"
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		segments []Segment
+	}{
+		{
+			name:     "contiguous records",
+			input:    hexFile(record(recordData, 0x0100, 1, 2), record(recordData, 0x0102, 3, 4)),
+			segments: []Segment{{0x0100, []byte{1, 2, 3, 4}}},
+		},
+		{
+			name:     "gap between records",
+			input:    hexFile(record(recordData, 0x0100, 1, 2), record(recordData, 0x0110, 3)),
+			segments: []Segment{{0x0100, []byte{1, 2}}, {0x0110, []byte{3}}},
+		},
+		{
+			name:     "records out of order",
+			input:    hexFile(record(recordData, 0x0102, 3, 4), record(recordData, 0x0100, 1, 2), record(recordData, 0x0104, 5)),
+			segments: []Segment{{0x0100, []byte{1, 2, 3, 4, 5}}},
+		},
+		{
+			name:     "extended segment address",
+			input:    hexFile(record(recordExtendedSegmentAddress, 0, 0x10, 0x00), record(recordData, 0x0010, 1)),
+			segments: []Segment{{0x10010, []byte{1}}},
+		},
+		{
+			name: "extended linear address",
+			input: hexFile(
+				record(recordData, 0xFFFF, 1),
+				record(recordExtendedLinearAddress, 0, 0x00, 0x01),
+				record(recordData, 0x0000, 2),
+				record(recordExtendedLinearAddress, 0, 0x10, 0x00),
+				record(recordData, 0x1014, 3),
+			),
+			segments: []Segment{{0xFFFF, []byte{1, 2}}, {0x10001014, []byte{3}}},
+		},
+		{
+			name:     "start address records are ignored",
+			input:    hexFile(record(recordStartSegmentAddress, 0, 0, 0, 0, 0), record(recordStartLinearAddress, 0, 0, 0, 0, 0), record(recordData, 0x0000, 1)),
+			segments: []Segment{{0x0000, []byte{1}}},
+		},
+		{
+			name:     "lower case and blank lines",
+			input:    "\n" + strings.ToLower(hexFile(record(recordData, 0x00AB, 0xCD))) + "\n\n",
+			segments: []Segment{{0x00AB, []byte{0xCD}}},
+		},
+	}
+
+	for _, test := range tests {
+		file, err := Parse(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(file.Segments) != len(test.segments) {
+			t.Errorf("%s: got %d segments, expected %d", test.name, len(file.Segments), len(test.segments))
+			continue
+		}
+		for i, segment := range file.Segments {
+			if segment.Address != test.segments[i].Address || !bytes.Equal(segment.Data, test.segments[i].Data) {
+				t.Errorf("%s: segment %d is 0x%08X % x, expected 0x%08X % x", test.name, i,
+					segment.Address, segment.Data, test.segments[i].Address, test.segments[i].Data)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := record(recordData, 0x0100, 1, 2)
+
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"checksum", hexFile(valid[:len(valid)-2] + "00"), "invalid record checksum"},
+		{"missing colon", hexFile(valid[1:]), "does not start with ':'"},
+		{"invalid hex", hexFile(":0G"), "invalid record"},
+		{"length", hexFile(":0300000001FC"), "invalid record length"},
+		{"missing end of file", valid + "\n", "missing end of file record"},
+		{"data after end of file", hexFile() + valid + "\n", "data after end of file record"},
+		{"overlap", hexFile(valid, record(recordData, 0x0101, 3)), "overlaps earlier data"},
+		{"record type", hexFile(record(0x06, 0, 1)), "unsupported record type 0x06"},
+		{"extended segment address", hexFile(record(recordExtendedSegmentAddress, 0, 1)), "invalid extended segment address record"},
+		{"extended linear address", hexFile(record(recordExtendedLinearAddress, 0, 1, 2, 3)), "invalid extended linear address record"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	file := &File{Segments: []*Segment{
+		{Address: 0x1000, Data: []byte{1, 2}},
+		{Address: 0x1004, Data: []byte{3}},
+	}}
+
+	if image := file.Binary(0xFF); !bytes.Equal(image, []byte{1, 2, 0xFF, 0xFF, 3}) {
+		t.Errorf("Binary returned % x", image)
+	}
+
+	image, err := file.BinaryFrom(0x0FFE, 0xFF)
+	if err != nil || !bytes.Equal(image, []byte{0xFF, 0xFF, 1, 2, 0xFF, 0xFF, 3}) {
+		t.Errorf("BinaryFrom returned % x, %v", image, err)
+	}
+	if _, err := file.BinaryFrom(0x1001, 0xFF); err == nil {
+		t.Error("BinaryFrom accepted a start address above the data")
+	}
+	if _, err := (&File{}).BinaryFrom(0, 0xFF); err == nil {
+		t.Error("BinaryFrom accepted an empty file")
+	}
+}
+
+func TestSlice(t *testing.T) {
+	file := &File{Segments: []*Segment{
+		{Address: 0x0000, Data: []byte{1, 2, 3, 4}},
+		{Address: 0x0010, Data: []byte{5, 6}},
+		{Address: 0x0100, Data: []byte{7}},
+	}}
+
+	slice := file.Slice(0x0002, 0x0011)
+	if len(slice.Segments) != 2 {
+		t.Fatalf("slice has %d segments", len(slice.Segments))
+	}
+	if slice.Segments[0].Address != 0x0002 || !bytes.Equal(slice.Segments[0].Data, []byte{3, 4}) {
+		t.Errorf("first segment is 0x%08X % x", slice.Segments[0].Address, slice.Segments[0].Data)
+	}
+	if slice.Segments[1].Address != 0x0010 || !bytes.Equal(slice.Segments[1].Data, []byte{5}) {
+		t.Errorf("second segment is 0x%08X % x", slice.Segments[1].Address, slice.Segments[1].Data)
+	}
+
+	slice.Segments[0].Data[0] = 0
+	if file.Segments[0].Data[2] != 3 {
+		t.Error("slice shares data with the file")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package serial
+
+import (
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+const readTimeout = 100 * time.Millisecond
+
+type Port interface {
+	io.ReadWriteCloser
+}
+
+// Open opens a serial port. Reads return io.EOF when no data arrives
+// within a short interval, so that readers can periodically check
+// whether they should stop.
+func Open(name string, baudRate int) (Port, error) {
+	port, err := serial.OpenPort(&serial.Config{
+		Name:        name,
+		Baud:        baudRate,
+		ReadTimeout: readTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open serial port '%s'", name)
+	}
+	return port, nil
+}
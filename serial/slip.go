@@ -0,0 +1,81 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package serial
+
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+func EncodeSlip(data []byte) []byte {
+	frame := make([]byte, 0, len(data)+2)
+	for _, b := range data {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, slipEnd)
+}
+
+type SlipDecoder struct {
+	frame   []byte
+	escaped bool
+}
+
+// Decode consumes received bytes and returns all frames that were completed
+// by them. Partial frames are kept until the next call.
+func (d *SlipDecoder) Decode(data []byte) (frames [][]byte) {
+	for _, b := range data {
+		if d.escaped {
+			d.escaped = false
+			switch b {
+			case slipEscEnd:
+				d.frame = append(d.frame, slipEnd)
+			case slipEscEsc:
+				d.frame = append(d.frame, slipEsc)
+			default:
+				// Protocol violation, keep the byte as is.
+				d.frame = append(d.frame, b)
+			}
+			continue
+		}
+
+		switch b {
+		case slipEnd:
+			if len(d.frame) > 0 {
+				frames = append(frames, d.frame)
+				d.frame = nil
+			}
+		case slipEsc:
+			d.escaped = true
+		default:
+			d.frame = append(d.frame, b)
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2018 Rob Caelers <rob.caelers@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package serial
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeSlip(t *testing.T) {
+	tests := []struct {
+		data  []byte
+		frame []byte
+	}{
+		{[]byte{}, []byte{0xC0}},
+		{[]byte{0x01, 0x02}, []byte{0x01, 0x02, 0xC0}},
+		{[]byte{0xC0}, []byte{0xDB, 0xDC, 0xC0}},
+		{[]byte{0xDB}, []byte{0xDB, 0xDD, 0xC0}},
+		{[]byte{0x09, 0xC0, 0xDB, 0xDC, 0xDD}, []byte{0x09, 0xDB, 0xDC, 0xDB, 0xDD, 0xDC, 0xDD, 0xC0}},
+	}
+
+	for _, test := range tests {
+		frame := EncodeSlip(test.data)
+		if !bytes.Equal(frame, test.frame) {
+			t.Errorf("EncodeSlip(% x) = % x, expected % x", test.data, frame, test.frame)
+		}
+	}
+}
+
+func TestSlipDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		frames [][]byte
+	}{
+		{
+			name:   "single frame",
+			chunks: [][]byte{{0x01, 0x02, 0xC0}},
+			frames: [][]byte{{0x01, 0x02}},
+		},
+		{
+			name:   "escaped bytes",
+			chunks: [][]byte{{0xDB, 0xDC, 0x05, 0xDB, 0xDD, 0xC0}},
+			frames: [][]byte{{0xC0, 0x05, 0xDB}},
+		},
+		{
+			name:   "frames in one chunk",
+			chunks: [][]byte{{0x01, 0xC0, 0x02, 0xC0}},
+			frames: [][]byte{{0x01}, {0x02}},
+		},
+		{
+			name:   "frame split over chunks",
+			chunks: [][]byte{{0x01, 0xDB}, {0xDC}, {0x02, 0xC0}},
+			frames: [][]byte{{0x01, 0xC0, 0x02}},
+		},
+		{
+			name:   "empty frames are skipped",
+			chunks: [][]byte{{0xC0, 0xC0, 0x01, 0xC0, 0xC0}},
+			frames: [][]byte{{0x01}},
+		},
+		{
+			name:   "invalid escape is kept",
+			chunks: [][]byte{{0xDB, 0x01, 0xC0}},
+			frames: [][]byte{{0x01}},
+		},
+	}
+
+	for _, test := range tests {
+		var decoder SlipDecoder
+		var frames [][]byte
+		for _, chunk := range test.chunks {
+			frames = append(frames, decoder.Decode(chunk)...)
+		}
+
+		if len(frames) != len(test.frames) {
+			t.Errorf("%s: got %d frames, expected %d", test.name, len(frames), len(test.frames))
+			continue
+		}
+		for i := range frames {
+			if !bytes.Equal(frames[i], test.frames[i]) {
+				t.Errorf("%s: frame %d is % x, expected % x", test.name, i, frames[i], test.frames[i])
+			}
+		}
+	}
+}
+
+func TestSlipRoundTrip(t *testing.T) {
+	data := make([]byte, 1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var decoder SlipDecoder
+	frames := decoder.Decode(EncodeSlip(data))
+	if len(frames) != 1 || !bytes.Equal(frames[0], data) {
+		t.Fatalf("round trip failed: %d frames", len(frames))
+	}
+}